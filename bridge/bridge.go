@@ -0,0 +1,211 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/usb"
+)
+
+// Setting up the buses and core as trezord does, for programs that use
+// the devices in-process, without the HTTP server; trezord itself
+// is built on this.
+//
+// Start creates the buses and core; the devices are then used through
+// Bridge.Core. Close releases the sessions and closes the buses. Only one
+// Bridge (or trezord) can use the USB devices at a time.
+//
+// Device models and protobuf messages are registered globally,
+// with core.RegisterModels and protob.RegisterDescriptorSet.
+
+// ErrNoTransports is returned by Start if neither USB nor emulators are enabled
+var ErrNoTransports = errors.New("no transports enabled")
+
+// Options select the buses and set up core
+type Options struct {
+	// USB devices, with libusb (or usbfs), and hidapi for Trezor One HID devices
+	USB bool
+	// Use /dev/hidraw instead of hidapi, without detaching the kernel driver;
+	// only if usb.HIDRawAvailable
+	HIDRaw bool
+	// UDP ports of emulators
+	Emulators []usb.PortTouple
+	// Devices to use, nil for all
+	Filter *usb.Filter
+
+	// Limit of messages read from devices, for all buses;
+	// 0 is wire.DefaultMaxMessageSize
+	MaxMessageSize uint32
+	// Limits for some buses, by name (libusb, hidapi, hidraw, usbfs, udp)
+	MaxMessageSizes map[string]uint32
+
+	// Reset USB devices on acquire
+	Reset bool
+	// Initialize the buses on first use instead of in Start,
+	// so no USB resources are held before that
+	Lazy bool
+
+	// Audit log of sessions, nil for none
+	AuditLog *core.AuditLog
+	// Writer of the detailed log, nil to keep it only in memory
+	Log io.Writer
+}
+
+// Bridge is core over the buses
+type Bridge struct {
+	Core *core.Core
+	// Detailed log, written by core and the buses
+	Log *memorywriter.MemoryWriter
+
+	lazy *usb.Lazy
+}
+
+// Start creates the buses and core; with Options.Lazy,
+// the buses are initialized on the first use
+func Start(opts Options) (*Bridge, error) {
+	if !opts.USB && len(opts.Emulators) == 0 {
+		return nil, ErrNoTransports
+	}
+	b := &Bridge{
+		Log: memorywriter.New(90000, 200, true, opts.Log),
+	}
+
+	initBuses := func() ([]core.USBBus, error) {
+		return initBuses(opts, b.Log)
+	}
+
+	var bus core.USBBus
+	if opts.Lazy {
+		b.Log.Log("Buses are initialized on first use")
+		b.lazy = usb.InitLazy(initBuses)
+		bus = b.lazy
+	} else {
+		buses, err := initBuses()
+		if err != nil {
+			return nil, err
+		}
+		bus = usb.Init(buses...)
+	}
+
+	b.Log.Log("Creating core")
+	b.Core = core.New(bus, b.Log, opts.AuditLog, allowCancel(), opts.Reset)
+	return b, nil
+}
+
+// Init initializes lazy buses now, instead of on the first use
+func (b *Bridge) Init() error {
+	if b.lazy == nil {
+		return nil
+	}
+	return b.lazy.Init()
+}
+
+// Initialized is false for lazy buses before the first use
+func (b *Bridge) Initialized() bool {
+	return b.lazy == nil || b.lazy.Initialized()
+}
+
+// Close stops the listens, releases the sessions and closes the buses;
+// calls in progress fail. The Bridge cannot be used after that.
+func (b *Bridge) Close() {
+	b.Core.Close()
+}
+
+func initBuses(opts Options, mw *memorywriter.MemoryWriter) ([]core.USBBus, error) {
+	bus, err := initUsb(opts.USB, opts.HIDRaw, opts.Filter, mw)
+	if err != nil {
+		return nil, err
+	}
+
+	mw.Log(fmt.Sprintf("UDP port count - %d", len(opts.Emulators)))
+
+	if len(opts.Emulators) > 0 {
+		e, errUDP := usb.InitUDP(opts.Emulators, mw, opts.Filter)
+		if errUDP != nil {
+			closeBuses(bus)
+			return nil, errUDP
+		}
+		bus = append(bus, e)
+	}
+	return usb.LimitMessageSize(bus, opts.MaxMessageSizes, opts.MaxMessageSize), nil
+}
+
+// closeBuses closes the buses already initialized, when the next one fails
+func closeBuses(buses []core.USBBus) {
+	for _, b := range buses {
+		b.Close()
+	}
+}
+
+func initUsb(init, hidraw bool, filter *usb.Filter, wr *memorywriter.MemoryWriter) ([]core.USBBus, error) {
+	if init {
+		wr.Log("Initing libusb (or usbfs)")
+
+		// with hidraw, libusb does not touch HID devices,
+		// so there is no kernel driver to detach
+		onlyLibusb := !usb.HIDUse && !hidraw
+		w, err := usb.InitNativeUSB(wr, onlyLibusb, allowCancel(), detachKernelDriver() && !hidraw, filter)
+		if err != nil {
+			return nil, fmt.Errorf("libusb: %w", err)
+		}
+
+		if hidraw {
+			wr.Log("Initing hidraw")
+			h, err := usb.InitHIDRaw(wr, filter)
+			if err != nil {
+				w.Close()
+				return nil, fmt.Errorf("hidraw: %w", err)
+			}
+			return []core.USBBus{w, h}, nil
+		}
+
+		if !usb.HIDUse {
+			return []core.USBBus{w}, nil
+		}
+
+		wr.Log("Initing hidapi")
+		h, err := usb.InitHIDAPI(wr, filter)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("hidapi: %w", err)
+		}
+		return []core.USBBus{w, h}, nil
+	}
+	return nil, nil
+}
+
+// ParseEmulator parses emulator ports, either PORT or PORT:DEBUGPORT
+func ParseEmulator(value string) (usb.PortTouple, error) {
+	split := strings.SplitN(value, ":", 2)
+	n, err := strconv.Atoi(split[0])
+	if err != nil {
+		return usb.PortTouple{}, err
+	}
+	d := 0
+	if len(split) == 2 {
+		d, err = strconv.Atoi(split[1])
+		if err != nil {
+			return usb.PortTouple{}, err
+		}
+	}
+	return usb.PortTouple{
+		Normal: n,
+		Debug:  d,
+	}, nil
+}
+
+// Does OS allow sync canceling via our custom libusb patches?
+func allowCancel() bool {
+	return runtime.GOOS != "freebsd" && runtime.GOOS != "openbsd"
+}
+
+// Does OS detach kernel driver in libusb?
+func detachKernelDriver() bool {
+	return runtime.GOOS == "linux"
+}
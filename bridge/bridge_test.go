@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/usb"
+)
+
+// fakeEmulator answers pings on UDP port and sends every other packet back
+func fakeEmulator(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			res := buf[:n]
+			if bytes.Equal(res, []byte("PINGPING")) {
+				res = []byte("PONGPONG")
+			}
+			_, err = conn.WriteTo(res, addr)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestParseEmulator(t *testing.T) {
+	p, err := ParseEmulator("21324")
+	if err != nil || p != (usb.PortTouple{Normal: 21324}) {
+		t.Errorf("unexpected %+v, %v", p, err)
+	}
+	p, err = ParseEmulator("21324:21326")
+	if err != nil || p != (usb.PortTouple{Normal: 21324, Debug: 21326}) {
+		t.Errorf("unexpected %+v, %v", p, err)
+	}
+	_, err = ParseEmulator("21324:")
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestNoTransports(t *testing.T) {
+	_, err := Start(Options{})
+	if !errors.Is(err, ErrNoTransports) {
+		t.Errorf("expected ErrNoTransports, got %v", err)
+	}
+}
+
+func TestStartEmulator(t *testing.T) {
+	port := fakeEmulator(t)
+	for _, lazy := range []bool{false, true} {
+		b, err := Start(Options{
+			Emulators: []usb.PortTouple{{Normal: port}},
+			Lazy:      lazy,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Initialized() == lazy {
+			t.Errorf("lazy %t, initialized %t", lazy, b.Initialized())
+		}
+
+		e, err := b.Core.Enumerate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e) != 1 || e[0].Type != core.TypeEmulator {
+			t.Fatalf("expected emulator, got %+v", e)
+		}
+		if !b.Initialized() {
+			t.Errorf("expected initialized buses after enumerate")
+		}
+
+		session, err := b.Core.Acquire(e[0].Path, "", false, context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte{0x00, 0x37, 0x00, 0x00, 0x00, 0x02, 0x08, 0x01}
+		res, err := b.Core.Call(msg, session, core.CallModeReadWrite, false, context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, msg) {
+			t.Errorf("expected echo %x, got %x", msg, res)
+		}
+		b.Close()
+	}
+}
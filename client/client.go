@@ -0,0 +1,324 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// Client of the bridge HTTP API, for Go programs talking to a running bridge.
+// Messages are passed as in core: 2 bytes of message type, 4 bytes of length,
+// then the protobuf data; hex encoding of the API is done here.
+//
+// Errors of the bridge are returned as *Error; errors of core are unwrapped
+// from it, so errors.Is(err, core.ErrWrongPrevSession) works as with core.
+// Calls on devices and sessions use the v2 API, so the errors are recognized
+// by their code; enumerate and listen stay on v1, with core.EnumerateEntry.
+//
+// Cancelling the context of a call closes the request, and the bridge
+// then stops the call as for any other client; see core.Call.
+
+// DefaultURL is where the bridge listens by default
+const DefaultURL = "http://127.0.0.1:21325"
+
+// DefaultOrigin is sent as Origin header; the bridge allows
+// only some origins, see corsValidator in server/api.
+// Local development origins are allowed, so this is one of them.
+const DefaultOrigin = "http://localhost:8000"
+
+// Client calls the bridge on URL
+type Client struct {
+	URL        string
+	Origin     string
+	HTTPClient *http.Client
+}
+
+// New returns client of the bridge on url, like DefaultURL
+func New(url string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(url, "/"),
+		Origin:     DefaultOrigin,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Info is the version of the bridge
+type Info struct {
+	Version string `json:"version"`
+	Githash string `json:"githash"`
+}
+
+// Error is an error response of the bridge
+type Error struct {
+	StatusCode int
+	Code       string // code of the v2 API, like "session_not_found"; empty on v1
+	Message    string
+	RetryAfter time.Duration // set on rate limited requests
+
+	err error // error of core with the same message, if known
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// coreCodes are the errors of core, by their code in the v2 API
+var coreCodes = map[string]error{
+	"session_not_found":      core.ErrSessionNotFound,
+	"device_not_found":       core.ErrDeviceNotFound,
+	"no_debug_link":          core.ErrNotDebug,
+	"wrong_previous_session": core.ErrWrongPrevSession,
+	"other_call_in_progress": core.ErrOtherCall,
+	"session_stolen":         core.ErrSessionStolen,
+	"device_disconnected":    core.ErrDisconnected,
+	"device_closed":          core.ErrClosedDevice,
+	"malformed_data":         core.ErrMalformedData,
+	"deadline_not_supported": core.ErrNoDeadline,
+	"read_timeout":           core.ErrTimeout,
+	"shutting_down":          core.ErrClosed,
+}
+
+// coreErrors are the errors of core, recognized by their message on v1
+var coreErrors = []error{
+	core.ErrWrongPrevSession,
+	core.ErrSessionNotFound,
+	core.ErrMalformedData,
+	core.ErrOtherCall,
+	core.ErrClosed,
+	core.ErrSessionStolen,
+	core.ErrTimeout,
+	core.ErrNoDeadline,
+	core.ErrDeviceNotFound,
+	core.ErrDisconnected,
+	core.ErrClosedDevice,
+	core.ErrNotDebug,
+}
+
+// coreCodeError returns the error of core with the v2 code, or nil
+func coreCodeError(code, origin string) error {
+	if code == "session_stolen" {
+		return &core.SessionStolenError{Origin: origin}
+	}
+	return coreCodes[code]
+}
+
+// coreError returns the error of core with the message, or nil
+func coreError(message string) error {
+	for _, err := range coreErrors {
+		if message == err.Error() {
+			return err
+		}
+	}
+	stolenBy := core.ErrSessionStolen.Error() + " by "
+	if strings.HasPrefix(message, stolenBy) {
+		return &core.SessionStolenError{Origin: strings.TrimPrefix(message, stolenBy)}
+	}
+	return nil
+}
+
+func responseError(res *http.Response, body []byte) error {
+	var jsonError struct {
+		Error  string `json:"error"`
+		Code   string `json:"code"`
+		Origin string `json:"origin"`
+	}
+	message := http.StatusText(res.StatusCode)
+	if json.Unmarshal(body, &jsonError) == nil && jsonError.Error != "" {
+		message = jsonError.Error
+	}
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Code:       jsonError.Code,
+		Message:    message,
+	}
+	if e.Code != "" {
+		e.err = coreCodeError(e.Code, jsonError.Origin)
+	} else {
+		e.err = coreError(message)
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// post sends the request and returns the response body
+func (c *Client) post(path string, body []byte, ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.Origin != "" {
+		req.Header.Set("Origin", c.Origin)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// v2 post returns 204 No Content
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return nil, responseError(res, resBody)
+	}
+	return resBody, nil
+}
+
+func (c *Client) postJSON(path string, in, out interface{}, ctx context.Context) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	res, err := c.post(path, body, ctx)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(res, out)
+}
+
+// sessionPrefix is the prefix of calls on devices and sessions
+func sessionPrefix(debug bool) string {
+	if debug {
+		return "/v2/debug"
+	}
+	return "/v2"
+}
+
+// Info returns the version of the bridge
+func (c *Client) Info(ctx context.Context) (Info, error) {
+	var res Info
+	err := c.postJSON("/", nil, &res, ctx)
+	return res, err
+}
+
+// Enumerate returns the connected devices
+func (c *Client) Enumerate(ctx context.Context) ([]core.EnumerateEntry, error) {
+	var res []core.EnumerateEntry
+	err := c.postJSON("/enumerate", nil, &res, ctx)
+	return res, err
+}
+
+// Listen waits until the devices differ from entries, and returns them;
+// the bridge returns entries unchanged after some time
+func (c *Client) Listen(entries []core.EnumerateEntry, ctx context.Context) ([]core.EnumerateEntry, error) {
+	if entries == nil {
+		entries = []core.EnumerateEntry{}
+	}
+	var res []core.EnumerateEntry
+	err := c.postJSON("/listen", entries, &res, ctx)
+	return res, err
+}
+
+// Acquire acquires the device on path and returns the new session;
+// prev is the current session of the device, or empty if there is none
+func (c *Client) Acquire(path, prev string, ctx context.Context) (string, error) {
+	return c.acquire(path, prev, false, ctx)
+}
+
+// AcquireDebug acquires the debug link of the device
+func (c *Client) AcquireDebug(path, prev string, ctx context.Context) (string, error) {
+	return c.acquire(path, prev, true, ctx)
+}
+
+func (c *Client) acquire(path, prev string, debug bool, ctx context.Context) (string, error) {
+	if prev == "" {
+		prev = "null"
+	}
+	var res struct {
+		Session string `json:"session"`
+	}
+	err := c.postJSON(
+		sessionPrefix(debug)+"/acquire/"+url.PathEscape(path)+"/"+url.PathEscape(prev),
+		nil, &res, ctx,
+	)
+	return res.Session, err
+}
+
+// Release releases the session
+func (c *Client) Release(session string, ctx context.Context) error {
+	return c.postJSON(sessionPrefix(false)+"/release/"+url.PathEscape(session), nil, nil, ctx)
+}
+
+// ReleaseDebug releases the debug link session
+func (c *Client) ReleaseDebug(session string, ctx context.Context) error {
+	return c.postJSON(sessionPrefix(true)+"/release/"+url.PathEscape(session), nil, nil, ctx)
+}
+
+// Cancel sends Cancel message to the device of the session,
+// stopping the running call
+func (c *Client) Cancel(session string, ctx context.Context) error {
+	return c.postJSON(sessionPrefix(false)+"/cancel/"+url.PathEscape(session), nil, nil, ctx)
+}
+
+// Call writes the message to the device and returns the response
+func (c *Client) Call(session string, msg []byte, ctx context.Context) ([]byte, error) {
+	return c.call("/call/", session, msg, false, ctx)
+}
+
+// CallDebug calls on the debug link
+func (c *Client) CallDebug(session string, msg []byte, ctx context.Context) ([]byte, error) {
+	return c.call("/call/", session, msg, true, ctx)
+}
+
+// Post writes the message to the device, without reading the response
+func (c *Client) Post(session string, msg []byte, ctx context.Context) error {
+	_, err := c.call("/post/", session, msg, false, ctx)
+	return err
+}
+
+// PostDebug writes on the debug link
+func (c *Client) PostDebug(session string, msg []byte, ctx context.Context) error {
+	_, err := c.call("/post/", session, msg, true, ctx)
+	return err
+}
+
+// Read reads one message from the device
+func (c *Client) Read(session string, ctx context.Context) ([]byte, error) {
+	return c.call("/read/", session, nil, false, ctx)
+}
+
+// ReadDebug reads from the debug link
+func (c *Client) ReadDebug(session string, ctx context.Context) ([]byte, error) {
+	return c.call("/read/", session, nil, true, ctx)
+}
+
+func (c *Client) call(route, session string, msg []byte, debug bool, ctx context.Context) ([]byte, error) {
+	body := []byte(hex.EncodeToString(msg))
+	res, err := c.post(sessionPrefix(debug)+route+url.PathEscape(session), body, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if route == "/post/" {
+		return nil, nil
+	}
+	binres, err := hex.DecodeString(string(res))
+	if err != nil {
+		return nil, errors.New("malformed response: " + err.Error())
+	}
+	return binres, nil
+}
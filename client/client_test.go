@@ -0,0 +1,220 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/core/coretest"
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/server/api"
+)
+
+// newTestClient runs the API over the fake bus on in-process server
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	mw := memorywriter.New(1000, 10, false, nil)
+	c := core.New(coretest.NewBus(), mw, nil, true, false)
+	r := mux.NewRouter()
+	api.ServeAPI(r.Methods("POST").Subrouter(), c, "2.0.0", "abcdef", mw, api.RateLimits{})
+	s := httptest.NewServer(r)
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	return New(s.URL)
+}
+
+// enumerateTestDevice returns the path of the device
+func enumerateTestDevice(t *testing.T, cl *Client) string {
+	t.Helper()
+	e, err := cl.Enumerate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 1 {
+		t.Fatalf("expected one device, got %+v", e)
+	}
+	return e[0].Path
+}
+
+// message of type 0x0037 with varint field 1 set to 1
+var testMessage = []byte{0x00, 0x37, 0x00, 0x00, 0x00, 0x02, 0x08, 0x01}
+
+func TestInfoAndEnumerate(t *testing.T) {
+	cl := newTestClient(t)
+	ctx := context.Background()
+
+	info, err := cl.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "2.0.0" || info.Githash != "abcdef" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	e, err := cl.Enumerate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 1 || !e[0].Debug || e[0].Session != nil {
+		t.Errorf("unexpected devices %+v", e)
+	}
+}
+
+func TestCallPostRead(t *testing.T) {
+	cl := newTestClient(t)
+	ctx := context.Background()
+	path := enumerateTestDevice(t, cl)
+
+	session, err := cl.Acquire(path, "", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := cl.Call(session, testMessage, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, testMessage) {
+		t.Errorf("expected echo %x, got %x", testMessage, res)
+	}
+
+	err = cl.Post(session, testMessage, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = cl.Read(session, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, testMessage) {
+		t.Errorf("expected echo %x, got %x", testMessage, res)
+	}
+
+	debugSession, err := cl.AcquireDebug(path, "", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = cl.CallDebug(debugSession, testMessage, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, testMessage) {
+		t.Errorf("expected echo %x, got %x", testMessage, res)
+	}
+	err = cl.ReleaseDebug(debugSession, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cl.Release(session, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cl.Release(session, ctx)
+	if !errors.Is(err, core.ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	cl := newTestClient(t)
+	ctx := context.Background()
+	path := enumerateTestDevice(t, cl)
+
+	_, err := cl.Acquire(path, "42", ctx)
+	if !errors.Is(err, core.ErrWrongPrevSession) {
+		t.Errorf("expected ErrWrongPrevSession, got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Code != "wrong_previous_session" {
+		t.Errorf("expected *Error with status 409 and code, got %#v", err)
+	}
+
+	session, err := cl.Acquire(path, "", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read waits, as there is nothing to read
+	done := make(chan error)
+	go func() {
+		_, err := cl.Read(session, ctx)
+		done <- err
+	}()
+	for {
+		_, err = cl.Call(session, testMessage, ctx)
+		if err != nil {
+			break
+		}
+		// the call came before read
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, core.ErrOtherCall) {
+		t.Errorf("expected ErrOtherCall, got %v", err)
+	}
+	// the fake device has no read deadlines, needed for cancelling
+	err = cl.Cancel(session, ctx)
+	if !errors.Is(err, core.ErrNoDeadline) {
+		t.Errorf("expected ErrNoDeadline, got %v", err)
+	}
+	// post can write during the read; its echo ends the read
+	err = cl.Post(session, testMessage, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := New(cl.URL)
+	other.Origin = "https://suite.trezor.io"
+	_, err = other.Acquire(path, session, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cl.Call(session, testMessage, ctx)
+	var stolen *core.SessionStolenError
+	if !errors.As(err, &stolen) || stolen.Origin != other.Origin || !errors.Is(err, core.ErrSessionStolen) {
+		t.Errorf("expected session stolen by %s, got %v", other.Origin, err)
+	}
+
+	denied := New(cl.URL)
+	denied.Origin = "https://example.com"
+	_, err = denied.Enumerate(ctx)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected *Error with status 403, got %#v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	cl := newTestClient(t)
+	ctx := context.Background()
+	e, err := cl.Enumerate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := e[0].Path
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := cl.Acquire(path, "", ctx)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	res, err := cl.Listen(e, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Session == nil {
+		t.Errorf("expected acquired device, got %+v", res)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/trezor/trezord-go/bridge"
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/udev"
+)
+
+// Subcommands, run instead of the HTTP server:
+//
+//	trezord-go [flags] COMMAND [command flags]
+
+// commandEnv is what the commands take from the global flags
+type commandEnv struct {
+	transports *transports
+	opts       bridge.Options // without the transports
+}
+
+var errUdevCheck = errors.New("udev check found problems")
+
+func runCommand(args []string, env *commandEnv) error {
+	switch args[0] {
+	case "udev":
+		return runUdev(args[1:])
+	case "enumerate":
+		return runEnumerate(args[1:], env)
+	case "call":
+		return runCall(args[1:], env)
+	case "monitor":
+		return runMonitor(args[1:], env)
+	}
+	return fmt.Errorf("unknown command %q; commands are: enumerate, call, monitor, udev", args[0])
+}
+
+// parseCommandFlags parses the command flags, with the transport flags
+func parseCommandFlags(fs *flag.FlagSet, args []string, env *commandEnv) error {
+	env.transports.registerFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if !env.transports.enabled() {
+		return bridge.ErrNoTransports
+	}
+	return nil
+}
+
+// startBridge creates core over the transports, without HTTP server;
+// it needs to be closed, so the devices are released
+func startBridge(env *commandEnv) (*bridge.Bridge, error) {
+	opts := env.opts
+	env.transports.apply(&opts)
+	return bridge.Start(opts)
+}
+
+// commandContext is done on SIGINT or SIGTERM
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func runEnumerate(args []string, env *commandEnv) error {
+	fs := flag.NewFlagSet("enumerate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trezord-go enumerate [-e PORT] [-ed PORT:PORT] [-u=false]\n")
+		fmt.Fprintf(fs.Output(), "Prints the devices as JSON, like /enumerate.\n")
+		fs.PrintDefaults()
+	}
+	err := parseCommandFlags(fs, args, env)
+	if err != nil {
+		return err
+	}
+
+	b, err := startBridge(env)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	c := b.Core
+
+	e, err := c.Enumerate()
+	if err != nil {
+		return err
+	}
+	return printJSON(e)
+}
+
+func runCall(args []string, env *commandEnv) error {
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	path := fs.String(
+		"path",
+		"",
+		"Path of the device, from enumerate. Can be omitted if there is only one device.",
+	)
+	body := fs.String(
+		"hex",
+		"",
+		"Message to send, in hex, as in /call body: 2 bytes of message type, 4 bytes of length, then the data.",
+	)
+	debug := fs.Bool(
+		"debug",
+		false,
+		"Call on debug link.",
+	)
+	timeout := fs.Duration(
+		"timeout",
+		0,
+		"Stop waiting for the response after this time, like 30s. Default is no timeout.",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trezord-go call [-path PATH] -hex MESSAGE [-debug] [-timeout DURATION]\n")
+		fmt.Fprintf(fs.Output(), "Sends one message and prints the response in hex.\n")
+		fs.PrintDefaults()
+	}
+	err := parseCommandFlags(fs, args, env)
+	if err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(*body)
+	if err != nil {
+		return fmt.Errorf("hex: %w", err)
+	}
+
+	b, err := startBridge(env)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	c := b.Core
+
+	e, err := c.Enumerate()
+	if err != nil {
+		return err
+	}
+	if *path == "" {
+		if len(e) != 1 {
+			return fmt.Errorf("found %d devices; select one with -path", len(e))
+		}
+		*path = e[0].Path
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	session, err := c.Acquire(*path, "", *debug, ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errRelease := c.Release(session, *debug, context.Background())
+		if errRelease != nil && !errors.Is(errRelease, core.ErrSessionNotFound) {
+			b.Log.Log("release err " + errRelease.Error())
+		}
+	}()
+
+	if *timeout != 0 {
+		ctx = core.WithReadDeadline(ctx, time.Now().Add(*timeout))
+	}
+	res, err := c.Call(data, session, core.CallModeReadWrite, *debug, ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(res))
+	return nil
+}
+
+// monitorEvent is one line of monitor output
+type monitorEvent struct {
+	Time   time.Time           `json:"time"`
+	Event  string              `json:"event"` // connect, disconnect or change
+	Device core.EnumerateEntry `json:"device"`
+}
+
+func runMonitor(args []string, env *commandEnv) error {
+	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trezord-go monitor [-e PORT] [-ed PORT:PORT] [-u=false]\n")
+		fmt.Fprintf(fs.Output(), "Prints connected and disconnected devices as JSON lines, until interrupted.\n")
+		fs.PrintDefaults()
+	}
+	err := parseCommandFlags(fs, args, env)
+	if err != nil {
+		return err
+	}
+
+	b, err := startBridge(env)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	c := b.Core
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	enc := json.NewEncoder(os.Stdout)
+
+	var prev []core.EnumerateEntry
+	for {
+		e, err := c.Listen(prev, ctx)
+		if err != nil {
+			return err
+		}
+		if e == nil && ctx.Err() != nil {
+			// interrupted
+			return nil
+		}
+		for _, ev := range monitorEvents(prev, e) {
+			err = enc.Encode(ev)
+			if err != nil {
+				return err
+			}
+		}
+		prev = e
+	}
+}
+
+func monitorEvents(prev, next []core.EnumerateEntry) []monitorEvent {
+	now := time.Now()
+	var res []monitorEvent
+	old := make(map[string]core.EnumerateEntry)
+	for _, dev := range prev {
+		old[dev.Path] = dev
+	}
+	for _, dev := range next {
+		o, ok := old[dev.Path]
+		delete(old, dev.Path)
+		if !ok {
+			res = append(res, monitorEvent{Time: now, Event: "connect", Device: dev})
+		} else if !reflect.DeepEqual(o, dev) {
+			res = append(res, monitorEvent{Time: now, Event: "change", Device: dev})
+		}
+	}
+	for _, dev := range prev {
+		if _, ok := old[dev.Path]; ok {
+			res = append(res, monitorEvent{Time: now, Event: "disconnect", Device: dev})
+		}
+	}
+	return res
+}
+
+func runUdev(args []string) error {
+	if runtime.GOOS != "linux" {
+		return errors.New("udev is only on linux")
+	}
+	fs := flag.NewFlagSet("udev", flag.ExitOnError)
+	file := fs.String(
+		"file",
+		udev.DefaultRulesFile,
+		"Write the rules into this file on install.",
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trezord-go udev check|install [-file FILE]\n")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("missing udev command")
+	}
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "check":
+		report, err := udev.Check()
+		if err != nil {
+			return err
+		}
+		err = report.Write(os.Stdout)
+		if err != nil {
+			return err
+		}
+		if !report.OK() {
+			return errUdevCheck
+		}
+		return nil
+
+	case "install":
+		err := udev.Install(*file)
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w; run with sudo", err)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rules written to %s.\n", *file)
+		// apply the rules to the devices that are already connected
+		for _, cmd := range [][]string{
+			{"udevadm", "control", "--reload-rules"},
+			{"udevadm", "trigger", "--subsystem-match=usb", "--subsystem-match=hidraw"},
+		} {
+			out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+			if err != nil {
+				fmt.Printf("%v failed: %s %s\n", cmd, err, out)
+				fmt.Println("Reconnect the devices to apply the rules.")
+				return nil
+			}
+		}
+		fmt.Println("Rules reloaded.")
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown udev command %q", args[0])
+}
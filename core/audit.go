@@ -0,0 +1,135 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Audit log is a record of who used which device,
+// one JSON object per line. Unlike the memorywriter logs,
+// it is meant to be kept, so it has only the session lifecycle.
+// Each record is synced, if the writer can sync (like *os.File);
+// write errors are kept and reported in /health.
+
+type AuditEvent string
+
+const (
+	AuditAcquire    AuditEvent = "acquire"
+	AuditSteal      AuditEvent = "steal"      // acquire of a device used by other session
+	AuditRelease    AuditEvent = "release"    // explicit release by client
+	AuditDisconnect AuditEvent = "disconnect" // released, because device was disconnected
+	AuditCancel     AuditEvent = "cancel"     // released, because client closed the call request
+	AuditShutdown   AuditEvent = "shutdown"   // released on bridge shutdown
+	AuditAbort      AuditEvent = "abort"      // flow cancelled on device, session kept
+
+	// release is not recorded; used when the release is a part
+	// of other recorded event (steal)
+	auditNone AuditEvent = ""
+)
+
+// Client is the origin and user agent of HTTP request;
+// API puts it into request context
+type Client struct {
+	Origin    string
+	UserAgent string
+}
+
+type clientKey struct{}
+
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFrom(ctx context.Context) Client {
+	client, _ := ctx.Value(clientKey{}).(Client)
+	return client
+}
+
+type AuditEntry struct {
+	Time            time.Time  `json:"time"`
+	Event           AuditEvent `json:"event"`
+	Origin          string     `json:"origin"`
+	UserAgent       string     `json:"userAgent"`
+	Path            string     `json:"path"`
+	Serial          string     `json:"serial,omitempty"`
+	Session         string     `json:"session"`
+	PreviousSession string     `json:"previousSession,omitempty"`
+	Debug           bool       `json:"debug"`
+}
+
+type AuditLog struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	encoder *json.Encoder
+	err     error // of the last record
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// NewAuditLog writes to w; nil AuditLog does not record anything
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{
+		w:       w,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (a *AuditLog) record(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	entry.Time = time.Now().UTC()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	err := a.encoder.Encode(entry)
+	if s, ok := a.w.(syncer); ok && err == nil {
+		err = s.Sync()
+	}
+	a.err = err
+	return err
+}
+
+// Err returns the error of the last record, nil if it was written
+func (a *AuditLog) Err() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.err
+}
+
+// audit records event on session; client is the one making the request,
+// or the one that acquired the session, if there is no request
+func (c *Core) audit(event AuditEvent, s *session, client Client, prev string, debug bool) {
+	if event == auditNone {
+		return
+	}
+	err := c.auditLog.record(AuditEntry{
+		Event:           event,
+		Origin:          client.Origin,
+		UserAgent:       client.UserAgent,
+		Path:            s.path,
+		Serial:          s.serial,
+		Session:         s.id,
+		PreviousSession: prev,
+		Debug:           debug,
+	})
+	if err != nil {
+		// audit log should not break the bridge; it is reported
+		// by AuditLogError
+		c.log.Log("Error on writing audit log: " + err.Error())
+	}
+}
+
+// AuditLogError returns the error of the last audit log record,
+// nil if it was written or there is no audit log
+func (c *Core) AuditLogError() error {
+	return c.auditLog.Err()
+}
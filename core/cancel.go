@@ -0,0 +1,176 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Cancelling the flow on the device, instead of releasing the session.
+//
+// Trezor answers Cancel message with Failure, so after sending Cancel,
+// messages are read until the Failure; then the device is ready
+// for the next call.
+
+const (
+	messageTypeFailure = 3
+	messageTypeCancel  = 20
+
+	// how long to wait for the Failure after Cancel
+	cancelTimeout = 5 * time.Second
+)
+
+// states of call with cancelling on close
+const (
+	callRunning   = 0
+	callFinished  = 1
+	callCancelled = 2
+)
+
+// Cancel message, as in call body
+var cancelMessage = []byte{0, messageTypeCancel, 0, 0, 0, 0}
+
+type cancelOnCloseKey struct{}
+
+// WithCancelOnClose makes Call cancel the flow on the device when ctx is done,
+// keeping the session acquired, instead of releasing the session.
+// Devices without read deadlines are still released.
+func WithCancelOnClose(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cancelOnCloseKey{}, true)
+}
+
+func cancelOnCloseFrom(ctx context.Context) bool {
+	cancel, _ := ctx.Value(cancelOnCloseKey{}).(bool)
+	return cancel
+}
+
+// Cancel sends Cancel message to the device, keeping the session.
+// If there is a call in progress, Cancel is sent after its request,
+// and the call gets the Failure response; otherwise, the Failure
+// is read here.
+func (c *Core) Cancel(ssid string, ctx context.Context) error {
+	c.callMutex.Lock()
+	c.callsInProgress++
+	c.callMutex.Unlock()
+
+	defer func() {
+		c.callMutex.Lock()
+		c.callsInProgress--
+		c.callMutex.Unlock()
+	}()
+
+	v, ok := c.sessions(false).Load(ssid)
+	if !ok {
+		return c.sessionNotFound(ssid)
+	}
+	acquired := v.(*session)
+
+	if _, ok := acquired.dev.(DeadlineDevice); !ok {
+		return ErrNoDeadline
+	}
+
+	// the check and the send are under one lock, so a call cannot
+	// start or end in between; without a call, Cancel claims the session
+	// for reading the Failure
+	acquired.callMutex.Lock()
+	noCall := atomic.CompareAndSwapInt32(&acquired.call, 0, 1)
+	if !noCall && acquired.written != nil {
+		c.log.Log("waiting for the request of the call in progress")
+		<-acquired.written
+	}
+	err := c.sendCancel(acquired)
+	acquired.callMutex.Unlock()
+
+	if noCall {
+		if err == nil {
+			c.log.Log("no call in progress, reading failure")
+			err = c.drainUntilFailure(acquired)
+		}
+		atomic.StoreInt32(&acquired.call, 0)
+	}
+	if err != nil {
+		errStolen := c.stolenError(ssid)
+		if errStolen != nil {
+			return errStolen
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ErrTimeout
+		}
+		return err
+	}
+
+	c.audit(AuditAbort, acquired, clientFrom(ctx), "", false)
+	return nil
+}
+
+func (c *Core) sendCancel(acquired *session) error {
+	c.log.Log("sending cancel")
+	acquired.writeMutex.Lock()
+	err := c.writeDev(cancelMessage, acquired.dev)
+	acquired.writeMutex.Unlock()
+	if err != nil {
+		c.log.Log(fmt.Sprintf("Error while sending cancel: %s", err.Error()))
+	}
+	return err
+}
+
+// finishCancel reads the rest of the cancelled call; kind and err
+// are the result of the call. If the device does not answer with Failure,
+// the session is released, as without cancelling.
+func (c *Core) finishCancel(ssid string, acquired *session, kind uint16, err error, client Client) {
+	if err == nil && kind == messageTypeFailure {
+		c.log.Log("call cancelled")
+		c.audit(AuditAbort, acquired, client, "", false)
+		return
+	}
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		err = c.drainUntilFailure(acquired)
+		if err == nil {
+			c.log.Log("call cancelled")
+			c.audit(AuditAbort, acquired, client, "", false)
+			return
+		}
+	}
+
+	c.log.Log(fmt.Sprintf("cancel failed: %s, auto-release", err.Error()))
+	errRelease := c.release(ssid, false, false, AuditCancel, &client)
+	if errRelease != nil {
+		// just log, since request is already closed
+		c.log.Log(fmt.Sprintf("Error while releasing: %s", errRelease.Error()))
+	}
+}
+
+// drainUntilFailure reads and drops messages until Failure
+func (c *Core) drainUntilFailure(acquired *session) error {
+	d, ok := acquired.dev.(DeadlineDevice)
+	if !ok {
+		return ErrNoDeadline
+	}
+	err := d.SetReadDeadline(time.Now().Add(cancelTimeout))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		errReset := d.SetReadDeadline(time.Time{})
+		if errReset != nil {
+			c.log.Log(fmt.Sprintf("Error while resetting deadline: %s", errReset.Error()))
+		}
+	}()
+
+	acquired.readMutex.Lock()
+	defer acquired.readMutex.Unlock()
+	for {
+		kind, err := c.readDev(acquired.dev, io.Discard, nil)
+		if err != nil {
+			return err
+		}
+		if kind == messageTypeFailure {
+			return nil
+		}
+		c.log.Log(fmt.Sprintf("dropping message %d", kind))
+	}
+}
@@ -1,11 +1,15 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"reflect"
 	"sort"
 	"strconv"
@@ -41,6 +45,7 @@ type USBBus interface {
 	Close() // called on program exit
 }
 
+// Device types of the built-in models; see models.go
 type DeviceType int
 
 const (
@@ -57,7 +62,12 @@ type USBInfo struct {
 	VendorID  int
 	ProductID int
 	Type      DeviceType
-	Debug     bool // has debug enabled?
+	Debug     bool   // has debug enabled?
+	Serial    string // USB serial number, empty if unknown
+
+	// identifier of the physical device, not changing
+	// on replugs and reboots; filled in core, not by the buses
+	StableID string
 }
 
 type USBDevice interface {
@@ -65,17 +75,44 @@ type USBDevice interface {
 	Close(disconnected bool) error
 }
 
+// Buses can optionally report their state, for health checks
+type StatusBus interface {
+	BusStatus() []BusStatus
+}
+
+type BusStatus struct {
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"` // for example, UDP ports
+
+	// nil if not enumerated yet
+	LastEnumerate *time.Time `json:"lastEnumerate"`
+	Devices       int        `json:"devices"`
+	Error         string     `json:"error,omitempty"` // of the last enumeration
+}
+
 type session struct {
 	path       string
 	id         string
+	serial     string // USB serial number, for audit log
+	client     Client // who acquired the session
+	stole      string // session which this one replaced, if acquired by stealing
 	dev        USBDevice
 	call       int32 // atomic
+	acquired   time.Time
+	history    sessionHistory
 	readMutex  sync.Mutex
 	writeMutex sync.Mutex
+
+	// callMutex guards changes of call together with written,
+	// the channel of the call in progress that is closed when its
+	// request is written; Cancel must not reach the device before it
+	callMutex sync.Mutex
+	written   chan struct{}
 }
 
 type EnumerateEntry struct {
 	Path    string     `json:"path"`
+	ID      string     `json:"id"` // stable across replugs, see stableID
 	Vendor  int        `json:"vendor"`
 	Product int        `json:"product"`
 	Type    DeviceType `json:"-"`     // used only in status page, not in JSON
@@ -83,6 +120,10 @@ type EnumerateEntry struct {
 
 	Session      *string `json:"session"`
 	DebugSession *string `json:"debugSession"`
+
+	// set if the current session was acquired by stealing this one
+	StolenSession      *string `json:"stolenSession,omitempty"`
+	StolenDebugSession *string `json:"stolenDebugSession,omitempty"`
 }
 
 type EnumerateEntries []EnumerateEntry
@@ -102,6 +143,7 @@ type Core struct {
 
 	normalSessions sync.Map
 	debugSessions  sync.Map
+	stolenSessions sync.Map // session ID => *stolenSession
 	libusbMutex    sync.Mutex
 
 	allowStealing bool
@@ -129,9 +171,16 @@ type Core struct {
 	usbPaths  map[int]string // id => path
 	biggestID int
 
-	log *memorywriter.MemoryWriter
+	log      *memorywriter.MemoryWriter
+	auditLog *AuditLog // can be nil
 
 	latestSessionID int
+
+	// closed on Stop; ends Listen and background enumeration
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// set on Close, under libusbMutex; bus cannot be used after that
+	closed bool
 }
 
 var (
@@ -139,23 +188,51 @@ var (
 	ErrSessionNotFound  = errors.New("session not found")
 	ErrMalformedData    = errors.New("malformed data")
 	ErrOtherCall        = errors.New("other call in progress")
+	ErrClosed           = errors.New("bridge is shutting down")
+	ErrSessionStolen    = errors.New("session stolen")
+	ErrTimeout          = errors.New("read timeout")
+	ErrNoDeadline       = errors.New("device does not support read deadlines")
+	ErrDeviceNotFound   = errors.New("device not found")
+	// returned by the devices of the buses
+	ErrDisconnected = errors.New("device disconnected during action")
+	ErrClosedDevice = errors.New("closed device")
+	ErrNotDebug     = errors.New("not debug link")
 )
 
-const (
-	VendorT1            = 0x534c
-	ProductT1Firmware   = 0x0001
-	VendorT2            = 0x1209
-	ProductT2Bootloader = 0x53C0
-	ProductT2Firmware   = 0x53C1
-)
+// SessionStolenError is returned for calls on a session
+// that was stolen by other client; errors.Is(err, ErrSessionStolen) is true
+type SessionStolenError struct {
+	Origin string // of the client that stole the session
+}
+
+func (e *SessionStolenError) Error() string {
+	if e.Origin == "" {
+		return ErrSessionStolen.Error()
+	}
+	return ErrSessionStolen.Error() + " by " + e.Origin
+}
+
+func (e *SessionStolenError) Unwrap() error {
+	return ErrSessionStolen
+}
 
-func New(bus USBBus, log *memorywriter.MemoryWriter, allowStealing, reset bool) *Core {
+type stolenSession struct {
+	by   Client
+	time time.Time
+}
+
+// stolen sessions are remembered for this long
+const stolenExpiry = 10 * time.Minute
+
+func New(bus USBBus, log *memorywriter.MemoryWriter, auditLog *AuditLog, allowStealing, reset bool) *Core {
 	c := &Core{
 		bus:           bus,
 		log:           log,
+		auditLog:      auditLog,
 		allowStealing: allowStealing,
 		reset:         reset,
 		usbPaths:      make(map[int]string),
+		stopped:       make(chan struct{}),
 	}
 	go c.backgroundListen()
 	return c
@@ -175,7 +252,11 @@ const (
 // It does not spam USB that much more than listen itself
 func (c *Core) backgroundListen() {
 	for {
-		time.Sleep(iterDelay * time.Millisecond)
+		select {
+		case <-c.stopped:
+			return
+		case <-time.After(iterDelay * time.Millisecond):
+		}
 
 		c.lastInfosMutex.RLock()
 		linfos := len(c.lastInfos)
@@ -227,11 +308,28 @@ func (c *Core) saveUsbPaths(devs []USBInfo) []USBInfo {
 			ProductID: dev.ProductID,
 			Type:      dev.Type,
 			Debug:     dev.Debug,
+			Serial:    dev.Serial,
+			StableID:  stableID(dev),
 		})
 	}
 	return res
 }
 
+// The fake paths change every time the device disappears,
+// so clients cannot follow one physical device through
+// reboots to bootloader or moving to another port.
+// The stable ID is derived from the USB serial number if the bus
+// knows it, and from the bus path otherwise.
+// It is hashed so that we don't give out the serial number itself.
+func stableID(dev USBInfo) string {
+	src := "path:" + dev.Path
+	if dev.Serial != "" {
+		src = "serial:" + dev.Serial
+	}
+	digest := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(digest[:16])
+}
+
 func (c *Core) Enumerate() ([]EnumerateEntry, error) {
 
 	// avoid enumerating while acquiring the device
@@ -248,6 +346,10 @@ func (c *Core) Enumerate() ([]EnumerateEntry, error) {
 	c.lastInfosMutex.Lock()
 	defer c.lastInfosMutex.Unlock()
 
+	if c.closed {
+		return nil, ErrClosed
+	}
+
 	// Use saved info if call is in progress, otherwise enumerate.
 	infos := c.lastInfos
 
@@ -282,6 +384,14 @@ func (c *Core) findSession(e *EnumerateEntry, path string, debug bool) {
 			} else {
 				e.Session = &ssidCopy
 			}
+			if ss.stole != "" {
+				stoleCopy := ss.stole
+				if debug {
+					e.StolenDebugSession = &stoleCopy
+				} else {
+					e.StolenSession = &stoleCopy
+				}
+			}
 			return false
 		}
 		return true
@@ -291,6 +401,7 @@ func (c *Core) findSession(e *EnumerateEntry, path string, debug bool) {
 func (c *Core) createEnumerateEntry(info USBInfo) EnumerateEntry {
 	e := EnumerateEntry{
 		Path:    info.Path,
+		ID:      info.StableID,
 		Vendor:  info.VendorID,
 		Product: info.ProductID,
 		Type:    info.Type,
@@ -336,7 +447,7 @@ func (c *Core) releaseDisconnected(infos []USBInfo, debug bool) {
 		}
 		if !connected {
 			c.log.Log(fmt.Sprintf("disconnected device %s", ssid))
-			err := c.release(ssid, true, debug)
+			err := c.release(ssid, true, debug, AuditDisconnect, nil)
 			// just log if there is an error
 			// they are disconnected anyway
 			if err != nil {
@@ -347,29 +458,149 @@ func (c *Core) releaseDisconnected(infos []USBInfo, debug bool) {
 	})
 }
 
-func (c *Core) Release(session string, debug bool) error {
-	return c.release(session, false, debug)
+func (c *Core) Release(session string, debug bool, ctx context.Context) error {
+	client := clientFrom(ctx)
+	return c.release(session, false, debug, AuditRelease, &client)
 }
 
+// client is recorded in audit log; if nil, it is the one who acquired the session
 func (c *Core) release(
 	ssid string,
 	disconnected bool,
 	debug bool,
+	event AuditEvent,
+	client *Client,
 ) error {
 	c.log.Log(fmt.Sprintf("session %s", ssid))
 	s := c.sessions(debug)
-	v, ok := s.Load(ssid)
+	// load and delete atomically, so the device is not closed twice
+	// when releasing concurrently (for example on shutdown)
+	v, ok := s.LoadAndDelete(ssid)
 	if !ok {
 		c.log.Log("session not found")
-		return ErrSessionNotFound
+		return c.sessionNotFound(ssid)
 	}
-	s.Delete(ssid)
 	acquired := v.(*session)
 	c.log.Log("bus close")
 	err := acquired.dev.Close(disconnected)
+
+	if client == nil {
+		client = &acquired.client
+	}
+	c.audit(event, acquired, *client, "", debug)
 	return err
 }
 
+// BusStatus returns the state of all the buses, if the bus reports it
+func (c *Core) BusStatus() []BusStatus {
+	sb, ok := c.bus.(StatusBus)
+	if !ok {
+		return nil
+	}
+	return sb.BusStatus()
+}
+
+// SessionCount returns number of acquired sessions
+func (c *Core) SessionCount(debug bool) int {
+	res := 0
+	c.sessions(debug).Range(func(_, _ interface{}) bool {
+		res++
+		return true
+	})
+	return res
+}
+
+// SessionInfo describes an acquired session, for status
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Serial    string    `json:"serial,omitempty"`
+	Debug     bool      `json:"debug"`
+	Origin    string    `json:"origin"`
+	UserAgent string    `json:"userAgent"`
+	Acquired  time.Time `json:"acquired"`
+	InCall    bool      `json:"inCall"` // call, post or read in progress
+}
+
+func (s *session) info(debug bool) SessionInfo {
+	return SessionInfo{
+		ID:        s.id,
+		Path:      s.path,
+		Serial:    s.serial,
+		Debug:     debug,
+		Origin:    s.client.Origin,
+		UserAgent: s.client.UserAgent,
+		Acquired:  s.acquired,
+		InCall:    s.history.inCall(),
+	}
+}
+
+// Sessions returns all acquired sessions, normal and debug, sorted by path
+func (c *Core) Sessions() []SessionInfo {
+	res := make([]SessionInfo, 0)
+	for _, debug := range []bool{false, true} {
+		c.sessions(debug).Range(func(_, v interface{}) bool {
+			res = append(res, v.(*session).info(debug))
+			return true
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Path != res[j].Path {
+			return res[i].Path < res[j].Path
+		}
+		return !res[i].Debug && res[j].Debug
+	})
+	return res
+}
+
+// Stop ends all pending Listen calls and background enumeration;
+// it is the first step of shutdown, so the HTTP server does not
+// wait for long-polling requests.
+func (c *Core) Stop() {
+	c.stopOnce.Do(func() {
+		c.log.Log("stopping")
+		close(c.stopped)
+	})
+}
+
+// Stopped is closed by Stop; long-running requests other than Listen
+// should end on it
+func (c *Core) Stopped() <-chan struct{} {
+	return c.stopped
+}
+
+// Close releases all sessions, with re-attaching kernel drivers,
+// and closes the bus. Core cannot be used after that.
+func (c *Core) Close() {
+	c.Stop()
+
+	c.libusbMutex.Lock()
+	defer c.libusbMutex.Unlock()
+
+	c.lastInfosMutex.Lock()
+	c.closed = true
+	c.lastInfosMutex.Unlock()
+
+	c.log.Log("releasing all sessions")
+	c.releaseAll(true)
+	c.releaseAll(false)
+
+	c.log.Log("closing bus")
+	c.bus.Close()
+}
+
+func (c *Core) releaseAll(debug bool) {
+	s := c.sessions(debug)
+	s.Range(func(k, _ interface{}) bool {
+		ssid := k.(string)
+		err := c.release(ssid, false, debug, AuditShutdown, nil)
+		if err != nil {
+			c.log.Log(fmt.Sprintf("Error on releasing session %s: %s", ssid, err))
+		}
+		return true
+	})
+}
+
 func (c *Core) Listen(entries []EnumerateEntry, ctx context.Context) ([]EnumerateEntry, error) {
 	c.log.Log("start")
 
@@ -390,8 +621,10 @@ func (c *Core) Listen(entries []EnumerateEntry, ctx context.Context) ([]Enumerat
 			case <-ctx.Done():
 				c.log.Log(fmt.Sprintf("request closed (%s)", ctx.Err().Error()))
 				return nil, nil
-			default:
-				time.Sleep(iterDelay * time.Millisecond)
+			case <-c.stopped:
+				c.log.Log("stopped, returning current state")
+				return e, nil
+			case <-time.After(iterDelay * time.Millisecond):
 			}
 		} else {
 			c.log.Log("different")
@@ -420,6 +653,7 @@ func (c *Core) findPrevSession(path string, debug bool) string {
 func (c *Core) Acquire(
 	path, prev string,
 	debug bool,
+	ctx context.Context,
 ) (string, error) {
 
 	// avoid enumerating while acquiring the device
@@ -433,6 +667,10 @@ func (c *Core) Acquire(
 
 	c.log.Log(fmt.Sprintf("input path %s prev %s", path, prev))
 
+	if c.closed {
+		return "", ErrClosed
+	}
+
 	prevSession := c.findPrevSession(path, debug)
 
 	c.log.Log(fmt.Sprintf("actually previous %s", prevSession))
@@ -447,7 +685,11 @@ func (c *Core) Acquire(
 
 	if prev != "" {
 		c.log.Log("releasing previous")
-		err := c.release(prev, false, debug)
+		// marked before releasing, so the call in progress
+		// on the previous session already returns the right error
+		c.markStolen(prev, clientFrom(ctx))
+		// recorded as a steal below
+		err := c.release(prev, false, debug, auditNone, nil)
 		if err != nil {
 			return "", err
 		}
@@ -465,7 +707,7 @@ func (c *Core) Acquire(
 
 	usbPath, exists := c.usbPaths[pathI]
 	if !exists {
-		return "", errors.New("device not found")
+		return "", ErrDeviceNotFound
 	}
 
 	c.log.Log("trying to connect")
@@ -477,10 +719,14 @@ func (c *Core) Acquire(
 	id := c.newSession(debug)
 
 	sess := &session{
-		path: path,
-		dev:  dev,
-		call: 0,
-		id:   id,
+		path:     path,
+		serial:   c.lastSerial(path),
+		client:   clientFrom(ctx),
+		stole:    prev,
+		dev:      dev,
+		call:     0,
+		id:       id,
+		acquired: time.Now(),
 	}
 
 	c.log.Log(fmt.Sprintf("new session is %s", id))
@@ -488,9 +734,59 @@ func (c *Core) Acquire(
 	s := c.sessions(debug)
 	s.Store(id, sess)
 
+	if prev != "" {
+		c.audit(AuditSteal, sess, sess.client, prev, debug)
+	} else {
+		c.audit(AuditAcquire, sess, sess.client, "", debug)
+	}
+
 	return id, nil
 }
 
+func (c *Core) markStolen(ssid string, by Client) {
+	now := time.Now()
+	c.stolenSessions.Range(func(k, v interface{}) bool {
+		if now.Sub(v.(*stolenSession).time) > stolenExpiry {
+			c.stolenSessions.Delete(k)
+		}
+		return true
+	})
+	c.stolenSessions.Store(ssid, &stolenSession{
+		by:   by,
+		time: now,
+	})
+}
+
+// stolenError returns SessionStolenError if the session was stolen, nil otherwise
+func (c *Core) stolenError(ssid string) error {
+	v, ok := c.stolenSessions.Load(ssid)
+	if !ok {
+		return nil
+	}
+	return &SessionStolenError{
+		Origin: v.(*stolenSession).by.Origin,
+	}
+}
+
+func (c *Core) sessionNotFound(ssid string) error {
+	err := c.stolenError(ssid)
+	if err != nil {
+		return err
+	}
+	return ErrSessionNotFound
+}
+
+func (c *Core) lastSerial(path string) string {
+	c.lastInfosMutex.RLock()
+	defer c.lastInfosMutex.RUnlock()
+	for _, info := range c.lastInfos {
+		if info.Path == path {
+			return info.Serial
+		}
+	}
+	return ""
+}
+
 // Chrome tries to read from trezor immediately after connecting,
 // ans so do we.  Bad timing can produce error on s.bus.Connect.
 // Try 3 times with a 100ms delay.
@@ -538,6 +834,37 @@ func (c *Core) Call(
 	debug bool,
 	ctx context.Context,
 ) ([]byte, error) {
+	var res bytes.Buffer
+	err := c.call(body, ssid, mode, debug, ctx, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Bytes(), nil
+}
+
+// CallStream is like Call, but the response is written to w
+// as the packets come from the device, without buffering
+// the whole message. Nothing is written to w on errors before
+// the message header is read.
+func (c *Core) CallStream(
+	body []byte,
+	ssid string,
+	mode CallMode,
+	debug bool,
+	ctx context.Context,
+	w io.Writer,
+) error {
+	return c.call(body, ssid, mode, debug, ctx, w)
+}
+
+func (c *Core) call(
+	body []byte,
+	ssid string,
+	mode CallMode,
+	debug bool,
+	ctx context.Context,
+	w io.Writer,
+) (err error) {
 
 	c.callMutex.Lock()
 	c.callsInProgress++
@@ -552,11 +879,23 @@ func (c *Core) Call(
 	s := c.sessions(debug)
 	v, ok := s.Load(ssid)
 	if !ok {
-		return nil, ErrSessionNotFound
+		return c.sessionNotFound(ssid)
 	}
 
 	acquired := v.(*session)
 
+	// Cancel must not reach the device before the request
+	written := make(chan struct{})
+	markWritten := sync.OnceFunc(func() {
+		close(written)
+	})
+
+	var kind uint16
+	record := acquired.history.begin(mode, body, clientFrom(ctx))
+	defer func() {
+		acquired.history.end(record, kind, err)
+	}()
+
 	if mode != CallModeWrite {
 		// This check is implemented only for /call and /read:
 		// - /call: Two /calls should not run concurrently. Otherwise the "message writes" and "message reads"
@@ -566,17 +905,31 @@ func (c *Core) Call(
 		// is in progress (but there are some read/write locks later on).
 
 		c.log.Log("checking other call on same session")
+		acquired.callMutex.Lock()
 		freeToCall := atomic.CompareAndSwapInt32(&acquired.call, 0, 1)
+		if freeToCall {
+			acquired.written = written
+		}
+		acquired.callMutex.Unlock()
 		if !freeToCall {
-			return nil, ErrOtherCall
+			return ErrOtherCall
 		}
 
 		c.log.Log("checking other call on same session done")
 		defer func() {
+			acquired.callMutex.Lock()
+			acquired.written = nil
 			atomic.StoreInt32(&acquired.call, 0)
+			acquired.callMutex.Unlock()
 		}()
 	}
 
+	// cancelling on device needs the deadline, so the drain cannot get stuck
+	_, hasDeadline := acquired.dev.(DeadlineDevice)
+	cancelOnClose := mode != CallModeWrite && !debug && hasDeadline && cancelOnCloseFrom(ctx)
+	var state int32 // atomic, callRunning etc.
+	cancelSent := make(chan struct{})
+
 	finished := make(chan bool, 1)
 	defer func() {
 		finished <- true
@@ -587,8 +940,25 @@ func (c *Core) Call(
 		case <-finished:
 			return
 		case <-ctx.Done():
+			// the request is closed also right after a finished call;
+			// select does not prefer finished, so check it again
+			select {
+			case <-finished:
+				return
+			default:
+			}
+			if cancelOnClose {
+				if atomic.CompareAndSwapInt32(&state, callRunning, callCancelled) {
+					c.log.Log(fmt.Sprintf("detected request close %s, cancel on device", ctx.Err().Error()))
+					<-written
+					c.sendCancel(acquired)
+					close(cancelSent)
+				}
+				return
+			}
 			c.log.Log(fmt.Sprintf("detected request close %s, auto-release", ctx.Err().Error()))
-			errRelease := c.release(ssid, false, debug)
+			client := clientFrom(ctx)
+			errRelease := c.release(ssid, false, debug, AuditCancel, &client)
 			if errRelease != nil {
 				// just log, since request is already closed
 				c.log.Log(fmt.Sprintf("Error while releasing: %s", errRelease.Error()))
@@ -597,10 +967,31 @@ func (c *Core) Call(
 	}()
 
 	c.log.Log("before actual logic")
-	bytes, err := c.readWriteDev(body, acquired, mode)
+	kind, err = c.readWriteDev(body, acquired, mode, readDeadlineFrom(ctx), w, markWritten)
+	markWritten() // also when the write failed
 	c.log.Log("after actual logic")
 
-	return bytes, err
+	if cancelOnClose && !atomic.CompareAndSwapInt32(&state, callRunning, callFinished) {
+		<-cancelSent
+		c.finishCancel(ssid, acquired, kind, err, clientFrom(ctx))
+		return ctx.Err()
+	}
+
+	if err != nil {
+		// the device was closed under us by stealing;
+		// tell the client instead of a closed device error
+		errStolen := c.stolenError(ssid)
+		if errStolen != nil {
+			c.log.Log("session was stolen")
+			return errStolen
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.log.Log("read deadline exceeded")
+			return ErrTimeout
+		}
+	}
+
+	return err
 }
 
 func (c *Core) writeDev(body []byte, device io.Writer) error {
@@ -615,26 +1006,98 @@ func (c *Core) writeDev(body []byte, device io.Writer) error {
 	return err
 }
 
-func (c *Core) readDev(device io.Reader) ([]byte, error) {
-	c.log.Log("readFrom")
-	msg, err := wire.ReadFrom(device, c.log)
+// Devices can optionally support read deadlines, for calls with a deadline;
+// reads after the deadline fail with os.ErrDeadlineExceeded.
+// Zero time means no deadline.
+type DeadlineDevice interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type readDeadlineKey struct{}
+
+// WithReadDeadline sets the deadline of reading the response in Call.
+// After the deadline, Call returns ErrTimeout, but unlike with context
+// cancellation, the session stays acquired; the late response is then
+// returned by the next read. The deadline is only for the start of the
+// response; once its first packet is read, the rest of the message
+// is read without deadline, so a message is never cut in the middle.
+func WithReadDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, readDeadlineKey{}, deadline)
+}
+
+func readDeadlineFrom(ctx context.Context) time.Time {
+	deadline, _ := ctx.Value(readDeadlineKey{}).(time.Time)
+	return deadline
+}
+
+// Devices can optionally limit the size of messages read from them;
+// otherwise wire.DefaultMaxMessageSize is used
+type MessageSizeLimiter interface {
+	MaxMessageSize() uint32
+}
+
+// readDev reads one message; onHeader, if not nil, is called
+// after the first packet with the header is read
+func (c *Core) readDev(device USBDevice, w io.Writer, onHeader func()) (uint16, error) {
+	maxSize := uint32(wire.DefaultMaxMessageSize)
+	if l, ok := device.(MessageSizeLimiter); ok {
+		maxSize = l.MaxMessageSize()
+	}
+
+	c.log.Log("newReader")
+	msg, err := wire.NewReader(device, maxSize, c.log)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	if onHeader != nil {
+		onHeader()
 	}
 
 	c.log.Log("encoding back")
-	return c.encodeRaw(msg)
+	var header [6]byte
+	binary.BigEndian.PutUint16(header[0:2], msg.Kind)
+	binary.BigEndian.PutUint32(header[2:6], msg.Size)
+	_, err = w.Write(header[:])
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(w, msg)
+	return msg.Kind, err
 }
 
 func (c *Core) readWriteDev(
 	body []byte,
 	acquired *session,
 	mode CallMode,
-) ([]byte, error) {
+	deadline time.Time,
+	w io.Writer,
+	onWritten func(),
+) (uint16, error) {
+
+	// before writing, so that unsupported deadline does not leave the response unread
+	var resetDeadline func()
+	if !deadline.IsZero() && mode != CallModeWrite {
+		d, ok := acquired.dev.(DeadlineDevice)
+		if !ok {
+			return 0, ErrNoDeadline
+		}
+		err := d.SetReadDeadline(deadline)
+		if err != nil {
+			return 0, err
+		}
+		resetDeadline = func() {
+			// just log, the deadline is set again on every call
+			errReset := d.SetReadDeadline(time.Time{})
+			if errReset != nil {
+				c.log.Log(fmt.Sprintf("Error while resetting deadline: %s", errReset.Error()))
+			}
+		}
+		defer resetDeadline()
+	}
 
 	if mode == CallModeRead {
 		if len(body) != 0 {
-			return nil, errors.New("non-empty body on read mode")
+			return 0, errors.New("non-empty body on read mode")
 		}
 		c.log.Log("skipping write")
 	} else {
@@ -642,17 +1105,20 @@ func (c *Core) readWriteDev(
 		err := c.writeDev(body, acquired.dev)
 		acquired.writeMutex.Unlock()
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 	}
+	onWritten()
 
 	if mode == CallModeWrite {
 		c.log.Log("skipping read")
-		return []byte{0}, nil
+		_, err := w.Write([]byte{0})
+		return 0, err
 	}
 	acquired.readMutex.Lock()
 	defer acquired.readMutex.Unlock()
-	return c.readDev(acquired.dev)
+	// the deadline is for the start of the response only
+	return c.readDev(acquired.dev, w, resetDeadline)
 }
 
 func (c *Core) decodeRaw(body []byte) (*wire.Message, error) {
@@ -686,18 +1152,3 @@ func (c *Core) decodeRaw(body []byte) (*wire.Message, error) {
 		Log: c.log,
 	}, nil
 }
-
-func (c *Core) encodeRaw(msg *wire.Message) ([]byte, error) {
-	c.log.Log("start")
-	var header [6]byte
-	data := msg.Data
-	kind := msg.Kind
-	size := uint32(len(msg.Data))
-
-	binary.BigEndian.PutUint16(header[0:2], kind)
-	binary.BigEndian.PutUint32(header[2:6], size)
-
-	res := append(header[:], data...)
-
-	return res, nil
-}
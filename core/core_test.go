@@ -1,7 +1,18 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/trezor/trezord-go/memorywriter"
 )
 
 func TestEnumerateEntriesSort(t *testing.T) {
@@ -15,3 +26,743 @@ func TestEnumerateEntriesSort(t *testing.T) {
 		t.Errorf("EnumerateEntries(entries).Sort() did not work well. The result: %v", entries)
 	}
 }
+
+func TestStableID(t *testing.T) {
+	a := stableID(USBInfo{Path: "lib0101", Serial: "ABCD"})
+	b := stableID(USBInfo{Path: "lib0203", Serial: "ABCD"})
+	if a != b {
+		t.Errorf("stableID should not depend on path when serial is known: %s != %s", a, b)
+	}
+	c := stableID(USBInfo{Path: "lib0101"})
+	if a == c {
+		t.Errorf("stableID without serial should differ from stableID with serial")
+	}
+	if c != stableID(USBInfo{Path: "lib0101"}) {
+		t.Errorf("stableID without serial should be derived from path")
+	}
+}
+
+func TestFindModel(t *testing.T) {
+	testcases := []struct {
+		vid, pid int
+		bcd      uint16
+		typ      DeviceType
+	}{
+		{VendorT1, ProductT1Firmware, 0x0100, TypeT1Hid},
+		{VendorT2, ProductT2Firmware, 0x0100, TypeT1Webusb},
+		{VendorT2, ProductT2Firmware, 0x0200, TypeT2},
+		{VendorT2, ProductT2Bootloader, 0x0100, TypeT1WebusbBoot},
+		{VendorT2, ProductT2Bootloader, 0x0200, TypeT2Boot},
+	}
+	for _, tc := range testcases {
+		m, ok := FindModel(tc.vid, tc.pid, tc.bcd)
+		if !ok || m.Type != tc.typ {
+			t.Errorf("FindModel(%x, %x, %x): expected type %d, got %d (found %v)", tc.vid, tc.pid, tc.bcd, tc.typ, m.Type, ok)
+		}
+	}
+	if _, ok := FindModel(0x1234, 0x5678, 0); ok {
+		t.Errorf("FindModel found unknown device")
+	}
+}
+
+func TestRegisterModels(t *testing.T) {
+	defer func() {
+		modelsMutex.Lock()
+		models = builtinModels
+		modelsMutex.Unlock()
+	}()
+	err := RegisterModels(strings.NewReader(`[
+		{"id":"devboard","name":"Dev board","vendor":4617,"product":1,"interface":"webusb","debugLink":true},
+		{"id":"devboard2","name":"Dev board 2","vendor":4617,"product":2,"interface":"webusb",
+			"usbInterface":{"number":2,"epIn":131,"epOut":3}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := FindModel(0x1209, 1, 0)
+	if !ok || m.ID != "devboard" || m.Type <= TypeEmulator {
+		t.Errorf("registered model not found, got %+v", m)
+	}
+	if ModelName(m.Type) != "Dev board" {
+		t.Errorf("wrong model name %s", ModelName(m.Type))
+	}
+	if m.USBInterface != DefaultUSBInterface || m.DebugUSBInterface != DefaultDebugUSBInterface {
+		t.Errorf("expected default interfaces, got %+v %+v", m.USBInterface, m.DebugUSBInterface)
+	}
+	m, _ = FindModel(0x1209, 2, 0)
+	if m.USBInterface != (USBInterface{Number: 2, EpIn: 0x83, EpOut: 0x03}) {
+		t.Errorf("wrong interface %+v", m.USBInterface)
+	}
+	if _, err = RegisterModel(Model{ID: "t2", Name: "dup", Interface: InterfaceWebUSB}); err == nil {
+		t.Errorf("duplicate model registered")
+	}
+}
+
+// fake bus with one device on path "dev"; reads block until close or deadline,
+// only Cancel message is answered, with Failure
+type fakeBus struct {
+	mutex        sync.Mutex
+	closed       bool
+	disconnected bool
+	devices      []*fakeDevice
+}
+
+type fakeDevice struct {
+	mutex        sync.Mutex
+	closed       bool
+	disconnected bool
+	closedC      chan struct{}
+	deadline     time.Time
+	packets      chan []byte
+	writes       []uint16       // message types written
+	deadlineGate chan struct{}  // if set, SetReadDeadline waits for it
+	reads        chan time.Time // deadline of each read, when it starts
+}
+
+func (b *fakeBus) disconnect() {
+	b.mutex.Lock()
+	b.disconnected = true
+	b.mutex.Unlock()
+}
+
+func (b *fakeBus) Enumerate() ([]USBInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.disconnected {
+		return nil, nil
+	}
+	return []USBInfo{{Path: "dev", Type: TypeT2, Debug: true, Serial: "SN1"}}, nil
+}
+
+func (b *fakeBus) Connect(path string, debug bool, reset bool) (USBDevice, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	d := &fakeDevice{closedC: make(chan struct{}), packets: make(chan []byte, 10), reads: make(chan time.Time, 10)}
+	b.devices = append(b.devices, d)
+	return d, nil
+}
+
+func (b *fakeBus) Has(path string) bool {
+	return true
+}
+
+func (b *fakeBus) Close() {
+	b.mutex.Lock()
+	b.closed = true
+	b.mutex.Unlock()
+}
+
+func (d *fakeDevice) Read(p []byte) (int, error) {
+	d.mutex.Lock()
+	deadline := d.deadline
+	d.mutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+	select {
+	case d.reads <- deadline:
+	default:
+		// nobody waits for so many reads
+	}
+	select {
+	case <-d.closedC:
+		return 0, errors.New("closed device")
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case packet := <-d.packets:
+		return copy(p, packet), nil
+	}
+}
+
+func (d *fakeDevice) SetReadDeadline(t time.Time) error {
+	d.mutex.Lock()
+	gate := d.deadlineGate
+	d.mutex.Unlock()
+	if gate != nil && !t.IsZero() {
+		<-gate
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deadline = t
+	return nil
+}
+
+func (d *fakeDevice) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte{'?', '#', '#'}) {
+		d.mutex.Lock()
+		d.writes = append(d.writes, binary.BigEndian.Uint16(p[3:5]))
+		d.mutex.Unlock()
+	}
+	if bytes.HasPrefix(p, []byte{'?', '#', '#', 0, messageTypeCancel}) {
+		failure := make([]byte, 64)
+		copy(failure, []byte{'?', '#', '#', 0, messageTypeFailure})
+		d.packets <- failure
+	}
+	return len(p), nil
+}
+
+func (d *fakeDevice) Close(disconnected bool) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		panic("device closed twice")
+	}
+	d.closed = true
+	d.disconnected = disconnected
+	close(d.closedC)
+	return nil
+}
+
+func newTestCore(auditLog *AuditLog) (*Core, *fakeBus) {
+	c, bus, _ := newTestCoreLog(auditLog)
+	return c, bus
+}
+
+// testLog gets the lines of the log of core, so tests can wait
+// until core gets to some point
+type testLog chan string
+
+func (l testLog) Write(p []byte) (int, error) {
+	select {
+	case l <- string(p):
+	default:
+		// nobody waits for so many lines
+	}
+	return len(p), nil
+}
+
+// wait returns the first of texts that is logged
+func (l testLog) wait(t *testing.T, texts ...string) string {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case line := <-l:
+			for _, text := range texts {
+				if strings.Contains(line, text) {
+					return text
+				}
+			}
+		case <-timeout:
+			t.Fatalf("expected %q in log", texts)
+		}
+	}
+}
+
+// clear drops the lines logged so far
+func (l testLog) clear() {
+	for {
+		select {
+		case <-l:
+		default:
+			return
+		}
+	}
+}
+
+func newTestCoreLog(auditLog *AuditLog) (*Core, *fakeBus, testLog) {
+	bus := &fakeBus{}
+	log := make(testLog, 1000)
+	mw := memorywriter.New(1000, 10, false, log)
+	return New(bus, mw, auditLog, true, false), bus, log
+}
+
+func acquireTestDevice(t *testing.T, c *Core, debug bool) string {
+	t.Helper()
+	return acquireTestDeviceAs(t, c, debug, context.Background())
+}
+
+func acquireTestDeviceAs(t *testing.T, c *Core, debug bool, ctx context.Context) string {
+	t.Helper()
+	e, err := c.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := ""
+	if debug && e[0].DebugSession != nil {
+		prev = *e[0].DebugSession
+	}
+	if !debug && e[0].Session != nil {
+		prev = *e[0].Session
+	}
+	session, err := c.Acquire(e[0].Path, prev, debug, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestClose(t *testing.T) {
+	c, bus, log := newTestCoreLog(nil)
+	session := acquireTestDevice(t, c, false)
+	acquireTestDevice(t, c, true)
+
+	e, err := c.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range e {
+		e[i].Type = 0 // as if it came from JSON
+	}
+	listenDone := make(chan struct{})
+	go func() {
+		_, err := c.Listen(e, context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		close(listenDone)
+	}()
+	log.wait(t, "equal, waiting")
+
+	callDone := make(chan error)
+	go func() {
+		_, err := c.Call(nil, session, CallModeRead, false, context.Background())
+		callDone <- err
+	}()
+	log.wait(t, "before actual logic")
+	c.Close()
+
+	select {
+	case <-listenDone:
+	case <-time.After(time.Second):
+		t.Fatal("listen did not end after close")
+	}
+	select {
+	case err := <-callDone:
+		if err == nil {
+			t.Errorf("call should fail after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call did not end after close")
+	}
+
+	if !bus.closed {
+		t.Errorf("bus not closed")
+	}
+	for _, d := range bus.devices {
+		if !d.closed || d.disconnected {
+			t.Errorf("device not released properly: %+v", d)
+		}
+	}
+	if _, err = c.Enumerate(); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Enumerate, got %v", err)
+	}
+	if _, err = c.Acquire("1", "", false, context.Background()); err != ErrClosed {
+		t.Errorf("expected ErrClosed from Acquire, got %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAuditLogError(t *testing.T) {
+	c, _ := newTestCore(NewAuditLog(failingWriter{}))
+	defer c.Close()
+	if c.AuditLogError() != nil {
+		t.Errorf("unexpected error before first record")
+	}
+	acquireTestDeviceAs(t, c, false, context.Background())
+	if err := c.AuditLogError(); err == nil || err.Error() != "disk full" {
+		t.Errorf("expected write error, got %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	c, bus, log := newTestCoreLog(NewAuditLog(&buf))
+	alice := WithClient(context.Background(), Client{Origin: "https://alice.trezor.io", UserAgent: "A"})
+	bob := WithClient(context.Background(), Client{Origin: "https://bob.trezor.io", UserAgent: "B"})
+
+	first := acquireTestDeviceAs(t, c, false, alice)
+	second := acquireTestDeviceAs(t, c, false, bob)
+
+	// closing the request releases the session
+	ctx, cancel := context.WithCancel(bob)
+	callDone := make(chan struct{})
+	go func() {
+		_, _ = c.Call(nil, second, CallModeRead, false, ctx)
+		close(callDone)
+	}()
+	log.wait(t, "before actual logic")
+	cancel()
+	<-callDone
+
+	third := acquireTestDeviceAs(t, c, false, alice)
+	err := c.Release(third, false, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fourth := acquireTestDeviceAs(t, c, true, bob)
+	bus.disconnect()
+	_, err = c.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	expected := []AuditEntry{
+		{Event: AuditAcquire, Origin: "https://alice.trezor.io", UserAgent: "A", Session: first},
+		{Event: AuditSteal, Origin: "https://bob.trezor.io", UserAgent: "B", Session: second, PreviousSession: first},
+		{Event: AuditCancel, Origin: "https://bob.trezor.io", UserAgent: "B", Session: second},
+		{Event: AuditAcquire, Origin: "https://alice.trezor.io", UserAgent: "A", Session: third},
+		{Event: AuditRelease, Origin: "https://bob.trezor.io", UserAgent: "B", Session: third},
+		{Event: AuditAcquire, Origin: "https://bob.trezor.io", UserAgent: "B", Session: fourth, Debug: true},
+		// disconnect is recorded with who acquired the session
+		{Event: AuditDisconnect, Origin: "https://bob.trezor.io", UserAgent: "B", Session: fourth, Debug: true},
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d entries, got %d:\n%s", len(expected), len(lines), buf.String())
+	}
+	for i, line := range lines {
+		var entry AuditEntry
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Time.IsZero() || entry.Serial != "SN1" || entry.Path == "" {
+			t.Errorf("entry %d is missing time, serial or path: %s", i, line)
+		}
+		entry.Time = time.Time{}
+		entry.Serial = ""
+		entry.Path = ""
+		if entry != expected[i] {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], entry)
+		}
+	}
+}
+
+func TestSessionStolen(t *testing.T) {
+	c, _, log := newTestCoreLog(nil)
+	alice := WithClient(context.Background(), Client{Origin: "https://alice.trezor.io"})
+	bob := WithClient(context.Background(), Client{Origin: "https://bob.trezor.io"})
+
+	first := acquireTestDeviceAs(t, c, false, alice)
+
+	callDone := make(chan error)
+	go func() {
+		_, err := c.Call(nil, first, CallModeRead, false, alice)
+		callDone <- err
+	}()
+	log.wait(t, "before actual logic")
+
+	second := acquireTestDeviceAs(t, c, false, bob)
+
+	for _, err := range []error{
+		<-callDone,
+		c.Release(first, false, alice),
+		func() error { _, err := c.Call(nil, first, CallModeRead, false, alice); return err }(),
+	} {
+		if !errors.Is(err, ErrSessionStolen) {
+			t.Errorf("expected stolen session error, got %v", err)
+		} else if err.Error() != "session stolen by https://bob.trezor.io" {
+			t.Errorf("expected origin in error, got %q", err.Error())
+		}
+	}
+
+	e, err := c.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e[0].Session == nil || *e[0].Session != second || e[0].StolenSession == nil || *e[0].StolenSession != first {
+		t.Errorf("expected session %s stolen from %s, got %+v", second, first, e[0])
+	}
+
+	err = c.Release(second, false, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Release(second, false, bob); err != ErrSessionNotFound {
+		t.Errorf("expected session not found for released session, got %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	c, bus := newTestCore(nil)
+	session := acquireTestDevice(t, c, false)
+
+	for i := 0; i < 2; i++ {
+		ctx := WithReadDeadline(context.Background(), time.Now().Add(20*time.Millisecond))
+		_, err := c.Call([]byte{0, 0, 0, 0, 0, 0}, session, CallModeReadWrite, false, ctx)
+		if err != ErrTimeout {
+			t.Errorf("expected timeout, got %v", err)
+		}
+	}
+
+	// session is kept, device is not closed, deadline is reset
+	e, err := c.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e[0].Session == nil || *e[0].Session != session {
+		t.Errorf("expected session %s kept, got %+v", session, e[0])
+	}
+	d := bus.devices[0]
+	d.mutex.Lock()
+	if d.closed || !d.deadline.IsZero() {
+		t.Errorf("expected open device without deadline, closed %v deadline %v", d.closed, d.deadline)
+	}
+	d.mutex.Unlock()
+
+	err = c.Release(session, false, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadDeadlineMidMessage(t *testing.T) {
+	c, bus := newTestCore(nil)
+	session := acquireTestDevice(t, c, false)
+	d := bus.devices[0]
+
+	// message of 100 bytes in two packets; the second comes after the deadline
+	first := make([]byte, 64)
+	copy(first, []byte{'?', '#', '#', 0, 17, 0, 0, 0, 100})
+	second := make([]byte, 64)
+	second[0] = '?'
+	d.packets <- first
+
+	ctx := WithReadDeadline(context.Background(), time.Now().Add(time.Second))
+	type result struct {
+		res []byte
+		err error
+	}
+	callDone := make(chan result)
+	go func() {
+		res, err := c.Call(nil, session, CallModeRead, false, ctx)
+		callDone <- result{res, err}
+	}()
+	if deadline := <-d.reads; deadline.IsZero() {
+		t.Errorf("expected deadline for the first packet")
+	}
+	if deadline := <-d.reads; !deadline.IsZero() {
+		t.Errorf("expected no deadline after the header, got %v", deadline)
+	}
+	d.packets <- second
+
+	r := <-callDone
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.res) != 6+100 {
+		t.Errorf("expected whole message, got %d bytes", len(r.res))
+	}
+}
+
+func TestCancelOnClose(t *testing.T) {
+	c, bus, log := newTestCoreLog(nil)
+	session := acquireTestDevice(t, c, false)
+
+	ctx, cancel := context.WithCancel(WithCancelOnClose(context.Background()))
+	callDone := make(chan error)
+	go func() {
+		_, err := c.Call([]byte{0, 55, 0, 0, 0, 0}, session, CallModeReadWrite, false, ctx)
+		callDone <- err
+	}()
+	log.wait(t, "before actual logic")
+	cancel()
+	if err := <-callDone; err != context.Canceled {
+		t.Errorf("expected canceled call, got %v", err)
+	}
+
+	// failure was read, session is kept
+	if len(bus.devices[0].packets) != 0 {
+		t.Errorf("expected failure read")
+	}
+	e, err := c.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e[0].Session == nil || *e[0].Session != session {
+		t.Errorf("expected session %s kept, got %+v", session, e[0])
+	}
+
+	// failure is read by the call in progress
+	log.clear()
+	go func() {
+		_, err := c.Call([]byte{0, 55, 0, 0, 0, 0}, session, CallModeReadWrite, false, context.Background())
+		callDone <- err
+	}()
+	log.wait(t, "before actual logic")
+	if err = c.Cancel(session, context.Background()); err != nil {
+		t.Errorf("cancel: %v", err)
+	}
+	if err = <-callDone; err != nil {
+		t.Errorf("expected call with failure, got %v", err)
+	}
+
+	// without call, failure is read by cancel
+	if err = c.Cancel(session, context.Background()); err != nil {
+		t.Errorf("cancel: %v", err)
+	}
+	if len(bus.devices[0].packets) != 0 {
+		t.Errorf("expected failure read")
+	}
+
+	err = c.Release(session, false, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelAfterRequest(t *testing.T) {
+	c, bus, log := newTestCoreLog(nil)
+	ssid := acquireTestDevice(t, c, false)
+	d := bus.devices[0]
+
+	// the deadline is set right before the write; holding it
+	// lets the closed request try the cancel first
+	gate := make(chan struct{})
+	d.mutex.Lock()
+	d.deadlineGate = gate
+	d.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(WithCancelOnClose(context.Background()))
+	ctx = WithReadDeadline(ctx, time.Now().Add(time.Second))
+	cancel()
+	callDone := make(chan error)
+	go func() {
+		_, err := c.Call([]byte{0, 55, 0, 0, 0, 0}, ssid, CallModeReadWrite, false, ctx)
+		callDone <- err
+	}()
+	log.wait(t, "cancel on device")
+	close(gate)
+	if err := <-callDone; err != context.Canceled {
+		t.Fatalf("expected canceled call, got %v", err)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.writes) != 2 || d.writes[0] != 55 || d.writes[1] != messageTypeCancel {
+		t.Fatalf("expected request before cancel, got %v", d.writes)
+	}
+}
+
+func TestCancelBeforeWrite(t *testing.T) {
+	c, bus, log := newTestCoreLog(nil)
+	ssid := acquireTestDevice(t, c, false)
+	d := bus.devices[0]
+
+	// the call holds before its write, as in TestCancelAfterRequest
+	gate := make(chan struct{})
+	d.mutex.Lock()
+	d.deadlineGate = gate
+	d.mutex.Unlock()
+
+	ctx := WithReadDeadline(context.Background(), time.Now().Add(time.Second))
+	callDone := make(chan error)
+	go func() {
+		_, err := c.Call([]byte{0, 55, 0, 0, 0, 0}, ssid, CallModeReadWrite, false, ctx)
+		callDone <- err
+	}()
+	log.wait(t, "checking other call on same session done")
+
+	cancelDone := make(chan error)
+	go func() {
+		cancelDone <- c.Cancel(ssid, context.Background())
+	}()
+	if log.wait(t, "waiting for the request", "sending cancel") != "waiting for the request" {
+		t.Error("cancel sent before the request was written")
+	}
+	close(gate)
+	if err := <-cancelDone; err != nil {
+		t.Errorf("cancel: %v", err)
+	}
+	if err := <-callDone; err != nil {
+		t.Errorf("expected call with failure, got %v", err)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.writes) != 2 || d.writes[0] != 55 || d.writes[1] != messageTypeCancel {
+		t.Fatalf("expected request before cancel, got %v", d.writes)
+	}
+}
+
+// the request is often closed right after the call finished;
+// that must not release the session
+func TestCloseAfterCall(t *testing.T) {
+	c, bus := newTestCore(nil)
+	session := acquireTestDevice(t, c, false)
+
+	response := make([]byte, 64)
+	copy(response, []byte{'?', '#', '#', 0, 57})
+	for i := 0; i < 100; i++ {
+		bus.devices[0].packets <- response
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := c.Call([]byte{0, 55, 0, 0, 0, 0}, session, CallModeReadWrite, false, ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+
+	err := c.Release(session, false, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionDetail(t *testing.T) {
+	c, bus, log := newTestCoreLog(nil)
+	client := Client{Origin: "https://example.com"}
+	session := acquireTestDeviceAs(t, c, false, WithClient(context.Background(), client))
+
+	ctx := WithReadDeadline(context.Background(), time.Now().Add(20*time.Millisecond))
+	_, err := c.Call([]byte{0, 55, 0, 0, 0, 0}, session, CallModeReadWrite, false, ctx)
+	if err != ErrTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	log.clear()
+	callDone := make(chan error)
+	go func() {
+		_, err := c.Call([]byte{0, 56, 0, 0, 0, 0}, session, CallModeReadWrite, false, context.Background())
+		callDone <- err
+	}()
+	log.wait(t, "before actual logic")
+
+	detail, err := c.SessionDetail(session, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Origin != client.Origin || detail.Acquired.IsZero() || !detail.InCall {
+		t.Errorf("unexpected session info %+v", detail.SessionInfo)
+	}
+	if len(detail.Running) != 1 || detail.Running[0].Request != 56 {
+		t.Errorf("expected running call, got %+v", detail.Running)
+	}
+	if len(detail.Calls) != 1 || detail.LastError == nil || detail.LastError.Err != ErrTimeout.Error() {
+		t.Errorf("expected failed call, got %+v %+v", detail.Calls, detail.LastError)
+	}
+
+	response := make([]byte, 64)
+	copy(response, []byte{'?', '#', '#', 0, 57})
+	bus.devices[0].packets <- response
+	if err = <-callDone; err != nil {
+		t.Fatal(err)
+	}
+
+	detail, err = c.SessionDetail(session, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.InCall || len(detail.Calls) != 2 || detail.Calls[1].Response != 57 {
+		t.Errorf("expected finished call, got %+v", detail)
+	}
+
+	if _, err = c.SessionDetail(session, true); err != ErrSessionNotFound {
+		t.Errorf("expected session not found, got %v", err)
+	}
+
+	err = c.Release(session, false, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+// Package coretest has a fake USB bus, for tests of the packages
+// that run core without devices.
+package coretest
+
+import (
+	"sync"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// Bus has the fixed devices; each connection is a new Device,
+// which sends every written packet back
+type Bus struct {
+	Devices []core.USBInfo
+	Status  []core.BusStatus // returned by BusStatus
+
+	mutex      sync.Mutex
+	enumerates int
+}
+
+// NewBus returns a bus with one Model T with debug link,
+// on path "dev" with serial number "SN1"
+func NewBus() *Bus {
+	return &Bus{
+		Devices: []core.USBInfo{{Path: "dev", Type: core.TypeT2, Debug: true, Serial: "SN1"}},
+	}
+}
+
+func (b *Bus) Enumerate() ([]core.USBInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.enumerates++
+	return append([]core.USBInfo(nil), b.Devices...), nil
+}
+
+// Enumerates returns how many times the bus was enumerated
+func (b *Bus) Enumerates() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.enumerates
+}
+
+func (b *Bus) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	for _, info := range b.Devices {
+		if info.Path != path {
+			continue
+		}
+		if debug && !info.Debug {
+			return nil, core.ErrNotDebug
+		}
+		return NewDevice(), nil
+	}
+	return nil, core.ErrDeviceNotFound
+}
+
+func (b *Bus) Has(path string) bool {
+	for _, info := range b.Devices {
+		if info.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bus) Close() {}
+
+func (b *Bus) BusStatus() []core.BusStatus {
+	return b.Status
+}
+
+// Device reads back the written packets; reading waits for a write
+type Device struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+	packets   chan []byte
+}
+
+func NewDevice() *Device {
+	return &Device{closed: make(chan struct{}), packets: make(chan []byte, 10)}
+}
+
+func (d *Device) Read(p []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, core.ErrClosedDevice
+	case packet := <-d.packets:
+		return copy(p, packet), nil
+	}
+}
+
+func (d *Device) Write(p []byte) (int, error) {
+	select {
+	case <-d.closed:
+		return 0, core.ErrClosedDevice
+	case d.packets <- append([]byte(nil), p...):
+		return len(p), nil
+	}
+}
+
+func (d *Device) Close(disconnected bool) error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// History of calls on a session, for the status page;
+// it is the first thing to look at when a client says "device busy".
+
+// calls remembered for each session
+const sessionHistorySize = 20
+
+func (m CallMode) String() string {
+	switch m {
+	case CallModeRead:
+		return "read"
+	case CallModeWrite:
+		return "post"
+	case CallModeReadWrite:
+		return "call"
+	}
+	return "unknown"
+}
+
+// CallRecord is one call, post or read on a session
+type CallRecord struct {
+	Mode     CallMode
+	Client   Client
+	Request  uint16 // message type written; not for read
+	Response uint16 // message type read; not for post
+	Start    time.Time
+	Duration time.Duration // until now, for calls in progress
+	Err      string
+}
+
+// SessionDetail is SessionInfo with the call history
+type SessionDetail struct {
+	SessionInfo
+	Running   []CallRecord // calls in progress
+	Calls     []CallRecord // last finished calls, oldest first
+	LastError *CallRecord  // last failed call, even if older than Calls
+}
+
+type sessionHistory struct {
+	mutex     sync.Mutex
+	running   []*CallRecord
+	calls     []CallRecord
+	lastError *CallRecord
+}
+
+func (h *sessionHistory) begin(mode CallMode, body []byte, client Client) *CallRecord {
+	record := &CallRecord{
+		Mode:   mode,
+		Client: client,
+		Start:  time.Now(),
+	}
+	if mode != CallModeRead && len(body) >= 2 {
+		record.Request = binary.BigEndian.Uint16(body[0:2])
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.running = append(h.running, record)
+	return record
+}
+
+func (h *sessionHistory) end(record *CallRecord, response uint16, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, r := range h.running {
+		if r == record {
+			h.running = append(h.running[:i], h.running[i+1:]...)
+			break
+		}
+	}
+
+	record.Response = response
+	record.Duration = time.Since(record.Start)
+	if err != nil {
+		record.Err = err.Error()
+		h.lastError = record
+	}
+	if len(h.calls) >= sessionHistorySize {
+		h.calls = h.calls[1:]
+	}
+	h.calls = append(h.calls, *record)
+}
+
+func (h *sessionHistory) inCall() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.running) > 0
+}
+
+func (h *sessionHistory) detail(info SessionInfo) SessionDetail {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	res := SessionDetail{
+		SessionInfo: info,
+		Running:     make([]CallRecord, 0, len(h.running)),
+		Calls:       make([]CallRecord, len(h.calls)),
+	}
+	for _, r := range h.running {
+		running := *r
+		running.Duration = time.Since(running.Start)
+		res.Running = append(res.Running, running)
+	}
+	copy(res.Calls, h.calls)
+	if h.lastError != nil {
+		lastError := *h.lastError
+		res.LastError = &lastError
+	}
+	return res
+}
+
+// SessionDetail returns the session with its call history
+func (c *Core) SessionDetail(ssid string, debug bool) (SessionDetail, error) {
+	v, ok := c.sessions(debug).Load(ssid)
+	if !ok {
+		return SessionDetail{}, ErrSessionNotFound
+	}
+	s := v.(*session)
+	return s.history.detail(s.info(debug)), nil
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Table of known device models.
+// Both USB detection (in usb package) and the names
+// on the status page use this table, so a new model
+// (or a development board with its own VID/PID)
+// can be added from config without changing code.
+
+type ModelInterface string
+
+const (
+	// T1 firmware HID interface, read with hidapi
+	// (or with libusb on platforms where we don't use hidapi)
+	InterfaceHID ModelInterface = "hid"
+	// vendor-specific interface, read with libusb
+	InterfaceWebUSB ModelInterface = "webusb"
+	// not on USB at all
+	InterfaceUDP ModelInterface = "udp"
+)
+
+// USB interface with one interrupt IN and one interrupt OUT endpoint
+type USBInterface struct {
+	Number     uint8 `json:"number"`
+	AltSetting uint8 `json:"altSetting"`
+	EpIn       uint8 `json:"epIn"`
+	EpOut      uint8 `json:"epOut"`
+}
+
+// Interfaces of all current Trezors; models from config
+// that do not set their interfaces get these
+var (
+	DefaultUSBInterface = USBInterface{
+		Number: 0,
+		EpIn:   0x81,
+		EpOut:  0x01,
+	}
+	DefaultDebugUSBInterface = USBInterface{
+		Number: 1,
+		EpIn:   0x82,
+		EpOut:  0x02,
+	}
+)
+
+type Model struct {
+	ID   string     `json:"id"`   // short name, used in command line flags
+	Name string     `json:"name"` // human readable name
+	Type DeviceType `json:"-"`    // assigned on registration for models from config
+
+	VendorID  int `json:"vendor"`
+	ProductID int `json:"product"`
+	// major byte of bcdDevice; nil matches any.
+	// Needed because T1 with WebUSB has the same VID/PID as T2
+	BcdDeviceMajor *int `json:"bcdDeviceMajor,omitempty"`
+
+	Bootloader bool           `json:"bootloader"`
+	Interface  ModelInterface `json:"interface"`
+	DebugLink  bool           `json:"debugLink"` // can have debug link interface
+
+	USBInterface      USBInterface `json:"usbInterface"`
+	DebugUSBInterface USBInterface `json:"debugUsbInterface"`
+	// Old T1 bootloader has the same VID/PID, but different epOut.
+	// We need it, since on Linux,
+	// we use libusb instead of hidapi for old BL
+	OldBootloaderUSBInterface *USBInterface `json:"-"`
+}
+
+const (
+	VendorT1            = 0x534c
+	ProductT1Firmware   = 0x0001
+	VendorT2            = 0x1209
+	ProductT2Bootloader = 0x53C0
+	ProductT2Firmware   = 0x53C1
+)
+
+var (
+	bcdT1 = 1
+
+	oldT1BootloaderUSBInterface = USBInterface{
+		Number: 0,
+		EpIn:   0x81,
+		EpOut:  0x02,
+	}
+)
+
+// Models are matched in order, first match wins,
+// so more specific models need to go first
+var builtinModels = []Model{
+	{
+		ID:        "t1-hid",
+		Name:      "Trezor One (HID)",
+		Type:      TypeT1Hid,
+		VendorID:  VendorT1,
+		ProductID: ProductT1Firmware,
+		Interface: InterfaceHID,
+
+		USBInterface:              DefaultUSBInterface,
+		OldBootloaderUSBInterface: &oldT1BootloaderUSBInterface,
+	},
+	{
+		ID:             "t1-webusb-boot",
+		Name:           "Trezor One (WebUSB, bootloader)",
+		Type:           TypeT1WebusbBoot,
+		VendorID:       VendorT2,
+		ProductID:      ProductT2Bootloader,
+		BcdDeviceMajor: &bcdT1,
+		Bootloader:     true,
+		Interface:      InterfaceWebUSB,
+
+		USBInterface: DefaultUSBInterface,
+	},
+	{
+		ID:         "t2-boot",
+		Name:       "Trezor Model T (bootloader)",
+		Type:       TypeT2Boot,
+		VendorID:   VendorT2,
+		ProductID:  ProductT2Bootloader,
+		Bootloader: true,
+		Interface:  InterfaceWebUSB,
+		DebugLink:  true,
+
+		USBInterface:      DefaultUSBInterface,
+		DebugUSBInterface: DefaultDebugUSBInterface,
+	},
+	{
+		ID:             "t1-webusb",
+		Name:           "Trezor One (WebUSB)",
+		Type:           TypeT1Webusb,
+		VendorID:       VendorT2,
+		ProductID:      ProductT2Firmware,
+		BcdDeviceMajor: &bcdT1,
+		Interface:      InterfaceWebUSB,
+		DebugLink:      true,
+
+		USBInterface:      DefaultUSBInterface,
+		DebugUSBInterface: DefaultDebugUSBInterface,
+	},
+	{
+		ID:        "t2",
+		Name:      "Trezor Model T",
+		Type:      TypeT2,
+		VendorID:  VendorT2,
+		ProductID: ProductT2Firmware,
+		Interface: InterfaceWebUSB,
+		DebugLink: true,
+
+		USBInterface:      DefaultUSBInterface,
+		DebugUSBInterface: DefaultDebugUSBInterface,
+	},
+	{
+		ID:        "emulator",
+		Name:      "Trezor Emulator",
+		Type:      TypeEmulator,
+		Interface: InterfaceUDP,
+		DebugLink: true,
+	},
+}
+
+var (
+	modelsMutex sync.RWMutex
+	models      = builtinModels
+)
+
+// RegisterModel adds the model to the table, before the built-in ones,
+// so it can also override them. It returns the assigned device type.
+func RegisterModel(m Model) (DeviceType, error) {
+	if m.ID == "" || m.Name == "" {
+		return 0, errors.New("model needs id and name")
+	}
+	if m.Interface != InterfaceHID && m.Interface != InterfaceWebUSB {
+		return 0, fmt.Errorf("model %s: unsupported interface %q", m.ID, m.Interface)
+	}
+	// endpoint 0 is the control endpoint, so zero means not set
+	if m.USBInterface.EpIn == 0 && m.USBInterface.EpOut == 0 {
+		m.USBInterface = DefaultUSBInterface
+	}
+	if m.DebugLink && m.DebugUSBInterface.EpIn == 0 && m.DebugUSBInterface.EpOut == 0 {
+		m.DebugUSBInterface = DefaultDebugUSBInterface
+	}
+	m.OldBootloaderUSBInterface = nil
+
+	modelsMutex.Lock()
+	defer modelsMutex.Unlock()
+
+	var maxType DeviceType
+	for _, other := range models {
+		if other.ID == m.ID {
+			return 0, fmt.Errorf("model %s already exists", m.ID)
+		}
+		if other.Type > maxType {
+			maxType = other.Type
+		}
+	}
+	m.Type = maxType + 1
+
+	models = append([]Model{m}, models...)
+	return m.Type, nil
+}
+
+// RegisterModels reads JSON array of models and registers all of them.
+func RegisterModels(r io.Reader) error {
+	var ms []Model
+	err := json.NewDecoder(r).Decode(&ms)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		_, err = RegisterModel(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Models returns copy of the model table.
+func Models() []Model {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+	res := make([]Model, len(models))
+	copy(res, models)
+	return res
+}
+
+// FindModel finds model by USB descriptor values.
+func FindModel(vid, pid int, bcdDevice uint16) (Model, bool) {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+	for _, m := range models {
+		if m.Interface == InterfaceUDP {
+			continue
+		}
+		if m.VendorID != vid || m.ProductID != pid {
+			continue
+		}
+		if m.BcdDeviceMajor != nil && *m.BcdDeviceMajor != int(bcdDevice>>8) {
+			continue
+		}
+		return m, true
+	}
+	return Model{}, false
+}
+
+func ModelByType(t DeviceType) (Model, bool) {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+	for _, m := range models {
+		if m.Type == t {
+			return m, true
+		}
+	}
+	return Model{}, false
+}
+
+func ModelByID(id string) (Model, bool) {
+	modelsMutex.RLock()
+	defer modelsMutex.RUnlock()
+	for _, m := range models {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return Model{}, false
+}
+
+// ModelName returns human readable name of the device type.
+func ModelName(t DeviceType) string {
+	m, ok := ModelByType(t)
+	if !ok {
+		return "Unknown device"
+	}
+	return m.Name
+}
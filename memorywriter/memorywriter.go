@@ -25,6 +25,7 @@ type MemoryWriter struct {
 	startCount   int
 	startLines   [][]byte
 	startTime    time.Time
+	written      int // count of all lines written
 	printTime    bool
 	mutex        sync.Mutex
 
@@ -100,6 +101,7 @@ func (m *MemoryWriter) Write(p []byte) (int, error) {
 
 		m.lines = append(m.lines, newline)
 	}
+	m.written++
 	if m.outWriter != nil {
 		_, wrErr := m.outWriter.Write(newline)
 		if wrErr != nil {
@@ -149,6 +151,53 @@ func (m *MemoryWriter) writeTo(start string, w io.Writer) error {
 	return nil
 }
 
+// Tail returns the last n lines, oldest first, without newlines
+func (m *MemoryWriter) Tail(n int) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	all := make([][]byte, 0, len(m.startLines)+len(m.lines))
+	all = append(all, m.startLines...)
+	all = append(all, m.lines...)
+	if len(all) > n {
+		all = all[len(all)-n:]
+	}
+	res := make([]string, 0, len(all))
+	for _, line := range all {
+		res = append(res, strings.TrimSuffix(string(line), "\n"))
+	}
+	return res
+}
+
+// Since returns the lines after the first n written lines, oldest first,
+// without newlines, and the count of written lines to use as the next n;
+// lines that were already rotated out are skipped
+func (m *MemoryWriter) Since(n int) ([]string, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	res := make([]string, 0)
+	for i, line := range m.startLines {
+		if i >= n {
+			res = append(res, strings.TrimSuffix(string(line), "\n"))
+		}
+	}
+	first := m.written - len(m.lines)
+	for i, line := range m.lines {
+		if first+i >= n {
+			res = append(res, strings.TrimSuffix(string(line), "\n"))
+		}
+	}
+	return res, m.written
+}
+
+// Written returns the count of all lines written
+func (m *MemoryWriter) Written() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.written
+}
+
 // String exports as string
 func (m *MemoryWriter) String(start string) (string, error) {
 	var b bytes.Buffer
@@ -0,0 +1,33 @@
+package memorywriter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSince(t *testing.T) {
+	m := New(3, 2, false, nil)
+	for i := 0; i < 4; i++ {
+		m.println(fmt.Sprint(i))
+	}
+
+	lines, n := m.Since(0)
+	if n != 4 || !reflect.DeepEqual(lines, []string{"0", "1", "2", "3"}) {
+		t.Errorf("unexpected lines %v, %d", lines, n)
+	}
+
+	for i := 4; i < 7; i++ {
+		m.println(fmt.Sprint(i))
+	}
+	// 2 and 3 are already rotated out
+	lines, n = m.Since(1)
+	if n != 7 || !reflect.DeepEqual(lines, []string{"1", "4", "5", "6"}) {
+		t.Errorf("unexpected lines %v, %d", lines, n)
+	}
+
+	lines, n = m.Since(n)
+	if n != 7 || len(lines) != 0 {
+		t.Errorf("unexpected lines %v, %d", lines, n)
+	}
+}
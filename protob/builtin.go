@@ -0,0 +1,283 @@
+package protob
+
+// Subset of trezor-common messages, for the basic workflow
+// (features, PIN/passphrase/button requests, ping, cancel, xpubs
+// and addresses), used only if the embedded descriptor set
+// (see messages.go) was not generated.
+// For all other messages, load descriptor set with -protob.
+//
+// Full names are the same as in trezor-common, so the messages
+// are replaced by the ones from the descriptor set, if it is loaded.
+
+const (
+	pkgCommon     = "hw.trezor.messages.common."
+	pkgManagement = "hw.trezor.messages.management."
+	pkgBitcoin    = "hw.trezor.messages.bitcoin."
+)
+
+func field(name string, number uint64, t FieldType) Field {
+	return Field{Name: name, Number: number, Type: t}
+}
+
+func repeated(name string, number uint64, t FieldType) Field {
+	return Field{Name: name, Number: number, Type: t, Repeated: true}
+}
+
+func typed(name string, number uint64, t FieldType, typeName string) Field {
+	return Field{Name: name, Number: number, Type: t, TypeName: typeName}
+}
+
+// values are mostly numbered from 1 in trezor-common
+func enumValues(prefix string, names ...string) []EnumValue {
+	return enumValuesFrom(prefix, 1, names...)
+}
+
+func enumValuesFrom(prefix string, first int32, names ...string) []EnumValue {
+	res := make([]EnumValue, 0, len(names))
+	for i, name := range names {
+		res = append(res, EnumValue{Name: prefix + name, Number: first + int32(i)})
+	}
+	return res
+}
+
+var builtinSchema = Schema{
+	Messages: []Message{
+		// messages-common.proto
+		{
+			Name: pkgCommon + "Success",
+			Fields: []Field{
+				field("message", 1, TypeString),
+			},
+		},
+		{
+			Name: pkgCommon + "Failure",
+			Fields: []Field{
+				typed("code", 1, TypeEnum, pkgCommon+"Failure.FailureType"),
+				field("message", 2, TypeString),
+			},
+		},
+		{
+			Name: pkgCommon + "ButtonRequest",
+			Fields: []Field{
+				typed("code", 1, TypeEnum, pkgCommon+"ButtonRequest.ButtonRequestType"),
+				field("pages", 2, TypeUint32),
+			},
+		},
+		{
+			Name: pkgCommon + "ButtonAck",
+		},
+		{
+			Name: pkgCommon + "PinMatrixRequest",
+			Fields: []Field{
+				typed("type", 1, TypeEnum, pkgCommon+"PinMatrixRequest.PinMatrixRequestType"),
+			},
+		},
+		{
+			Name: pkgCommon + "PinMatrixAck",
+			Fields: []Field{
+				field("pin", 1, TypeString),
+			},
+		},
+		{
+			Name: pkgCommon + "PassphraseRequest",
+			Fields: []Field{
+				field("_on_device", 1, TypeBool),
+			},
+		},
+		{
+			Name: pkgCommon + "PassphraseAck",
+			Fields: []Field{
+				field("passphrase", 1, TypeString),
+				field("_state", 2, TypeBytes),
+				field("on_device", 3, TypeBool),
+			},
+		},
+		{
+			Name: pkgCommon + "HDNodeType",
+			Fields: []Field{
+				field("depth", 1, TypeUint32),
+				field("fingerprint", 2, TypeUint32),
+				field("child_num", 3, TypeUint32),
+				field("chain_code", 4, TypeBytes),
+				field("private_key", 5, TypeBytes),
+				field("public_key", 6, TypeBytes),
+			},
+		},
+
+		// messages-management.proto
+		{
+			Name: pkgManagement + "Initialize",
+			Fields: []Field{
+				field("session_id", 1, TypeBytes),
+				field("_skip_passphrase", 2, TypeBool),
+				field("derive_cardano", 3, TypeBool),
+			},
+		},
+		{
+			Name: pkgManagement + "GetFeatures",
+		},
+		{
+			Name: pkgManagement + "Features",
+			Fields: []Field{
+				field("vendor", 1, TypeString),
+				field("major_version", 2, TypeUint32),
+				field("minor_version", 3, TypeUint32),
+				field("patch_version", 4, TypeUint32),
+				field("bootloader_mode", 5, TypeBool),
+				field("device_id", 6, TypeString),
+				field("pin_protection", 7, TypeBool),
+				field("passphrase_protection", 8, TypeBool),
+				field("language", 9, TypeString),
+				field("label", 10, TypeString),
+				field("initialized", 12, TypeBool),
+				field("revision", 13, TypeBytes),
+				field("bootloader_hash", 14, TypeBytes),
+				field("imported", 15, TypeBool),
+				field("unlocked", 16, TypeBool),
+				field("firmware_present", 18, TypeBool),
+				field("needs_backup", 19, TypeBool),
+				field("flags", 20, TypeUint32),
+				field("model", 21, TypeString),
+				field("fw_major", 22, TypeUint32),
+				field("fw_minor", 23, TypeUint32),
+				field("fw_patch", 24, TypeUint32),
+				field("fw_vendor", 25, TypeString),
+				field("unfinished_backup", 27, TypeBool),
+				field("no_backup", 28, TypeBool),
+				field("recovery_mode", 29, TypeBool),
+				{Name: "capabilities", Number: 30, Type: TypeEnum, Repeated: true, TypeName: pkgManagement + "Features.Capability"},
+				field("sd_card_present", 32, TypeBool),
+				field("sd_protection", 33, TypeBool),
+				field("wipe_code_protection", 34, TypeBool),
+				field("session_id", 35, TypeBytes),
+				field("passphrase_always_on_device", 36, TypeBool),
+			},
+		},
+		{
+			Name: pkgManagement + "Ping",
+			Fields: []Field{
+				field("message", 1, TypeString),
+				field("button_protection", 2, TypeBool),
+			},
+		},
+		{
+			Name: pkgManagement + "Cancel",
+		},
+		{
+			Name: pkgManagement + "LockDevice",
+		},
+		{
+			Name: pkgManagement + "EndSession",
+		},
+
+		// messages-bitcoin.proto, without multisig
+		{
+			Name: pkgBitcoin + "GetPublicKey",
+			Fields: []Field{
+				repeated("address_n", 1, TypeUint32),
+				field("ecdsa_curve_name", 2, TypeString),
+				field("show_display", 3, TypeBool),
+				field("coin_name", 4, TypeString),
+				typed("script_type", 5, TypeEnum, pkgBitcoin+"InputScriptType"),
+				field("ignore_xpub_magic", 6, TypeBool),
+			},
+		},
+		{
+			Name: pkgBitcoin + "PublicKey",
+			Fields: []Field{
+				typed("node", 1, TypeMessage, pkgCommon+"HDNodeType"),
+				field("xpub", 2, TypeString),
+				field("root_fingerprint", 3, TypeUint32),
+			},
+		},
+		{
+			Name: pkgBitcoin + "GetAddress",
+			Fields: []Field{
+				repeated("address_n", 1, TypeUint32),
+				field("coin_name", 2, TypeString),
+				field("show_display", 3, TypeBool),
+				typed("script_type", 5, TypeEnum, pkgBitcoin+"InputScriptType"),
+				field("ignore_xpub_magic", 6, TypeBool),
+			},
+		},
+		{
+			Name: pkgBitcoin + "Address",
+			Fields: []Field{
+				field("address", 1, TypeString),
+				field("mac", 2, TypeBytes),
+			},
+		},
+	},
+	Enums: []Enum{
+		{
+			Name: pkgCommon + "Failure.FailureType",
+			Values: append(enumValues("Failure_",
+				"UnexpectedMessage", "ButtonExpected", "DataError", "ActionCancelled",
+				"PinExpected", "PinCancelled", "PinInvalid", "InvalidSignature",
+				"ProcessError", "NotEnoughFunds", "NotInitialized", "PinMismatch",
+				"WipeCodeMismatch", "InvalidSession",
+			), EnumValue{Name: "Failure_FirmwareError", Number: 99}),
+		},
+		{
+			Name: pkgCommon + "ButtonRequest.ButtonRequestType",
+			Values: append(append(enumValues("ButtonRequest_",
+				"Other", "FeeOverThreshold", "ConfirmOutput", "ResetDevice",
+				"ConfirmWord", "WipeDevice", "ProtectCall", "SignTx",
+				"FirmwareCheck", "Address", "PublicKey", "MnemonicWordCount",
+				"MnemonicInput",
+			), EnumValue{Name: "_Deprecated_ButtonRequest_PassphraseType", Number: 14}),
+				enumValuesFrom("ButtonRequest_", 15,
+					"UnknownDerivationPath", "RecoveryHomepage", "Success", "Warning",
+					"PassphraseEntry", "PinEntry",
+				)...),
+		},
+		{
+			Name: pkgCommon + "PinMatrixRequest.PinMatrixRequestType",
+			Values: enumValues("PinMatrixRequestType_",
+				"Current", "NewFirst", "NewSecond", "WipeCodeFirst", "WipeCodeSecond",
+			),
+		},
+		{
+			Name: pkgManagement + "Features.Capability",
+			Values: enumValues("Capability_",
+				"Bitcoin", "Bitcoin_like", "Binance", "Cardano",
+				"Crypto", "EOS", "Ethereum", "Lisk",
+				"Monero", "NEM", "Ripple", "Stellar",
+				"Tezos", "U2F", "Shamir", "ShamirGroups",
+				"PassphraseEntry",
+			),
+		},
+		{
+			Name: pkgBitcoin + "InputScriptType",
+			Values: []EnumValue{
+				{Name: "SPENDADDRESS", Number: 0},
+				{Name: "SPENDMULTISIG", Number: 1},
+				{Name: "EXTERNAL", Number: 2},
+				{Name: "SPENDWITNESS", Number: 3},
+				{Name: "SPENDP2SHWITNESS", Number: 4},
+				{Name: "SPENDTAPROOT", Number: 5},
+			},
+		},
+	},
+	Types: map[uint16]string{
+		0:  pkgManagement + "Initialize",
+		1:  pkgManagement + "Ping",
+		2:  pkgCommon + "Success",
+		3:  pkgCommon + "Failure",
+		11: pkgBitcoin + "GetPublicKey",
+		12: pkgBitcoin + "PublicKey",
+		17: pkgManagement + "Features",
+		18: pkgCommon + "PinMatrixRequest",
+		19: pkgCommon + "PinMatrixAck",
+		20: pkgManagement + "Cancel",
+		24: pkgManagement + "LockDevice",
+		26: pkgCommon + "ButtonRequest",
+		27: pkgCommon + "ButtonAck",
+		29: pkgBitcoin + "GetAddress",
+		30: pkgBitcoin + "Address",
+		41: pkgCommon + "PassphraseRequest",
+		42: pkgCommon + "PassphraseAck",
+		55: pkgManagement + "GetFeatures",
+		83: pkgManagement + "EndSession",
+	},
+}
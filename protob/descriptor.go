@@ -0,0 +1,218 @@
+package protob
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Descriptor sets are protobuf messages themselves, so they are
+// decoded with the same code, using the part of descriptor.proto
+// that we need.
+
+const (
+	descriptorPackage = "google.protobuf."
+	labelRepeated     = 3
+
+	// trezor-common puts all message types into one enum,
+	// with values like MessageType_GetFeatures
+	messageTypeEnum   = "MessageType"
+	messageTypePrefix = "MessageType_"
+)
+
+func descriptorField(name string, number uint64, t FieldType, repeated bool, typeName string) Field {
+	if typeName != "" {
+		typeName = descriptorPackage + typeName
+	}
+	return Field{
+		Name:     name,
+		Number:   number,
+		Type:     t,
+		Repeated: repeated,
+		TypeName: typeName,
+	}
+}
+
+var descriptorSchema = Schema{
+	Messages: []Message{
+		{
+			Name: descriptorPackage + "FileDescriptorSet",
+			Fields: []Field{
+				descriptorField("file", 1, TypeMessage, true, "FileDescriptorProto"),
+			},
+		},
+		{
+			Name: descriptorPackage + "FileDescriptorProto",
+			Fields: []Field{
+				descriptorField("name", 1, TypeString, false, ""),
+				descriptorField("package", 2, TypeString, false, ""),
+				descriptorField("message_type", 4, TypeMessage, true, "DescriptorProto"),
+				descriptorField("enum_type", 5, TypeMessage, true, "EnumDescriptorProto"),
+			},
+		},
+		{
+			Name: descriptorPackage + "DescriptorProto",
+			Fields: []Field{
+				descriptorField("name", 1, TypeString, false, ""),
+				descriptorField("field", 2, TypeMessage, true, "FieldDescriptorProto"),
+				descriptorField("nested_type", 3, TypeMessage, true, "DescriptorProto"),
+				descriptorField("enum_type", 4, TypeMessage, true, "EnumDescriptorProto"),
+			},
+		},
+		{
+			Name: descriptorPackage + "FieldDescriptorProto",
+			Fields: []Field{
+				descriptorField("name", 1, TypeString, false, ""),
+				descriptorField("number", 3, TypeInt32, false, ""),
+				descriptorField("label", 4, TypeInt32, false, ""),
+				descriptorField("type", 5, TypeInt32, false, ""),
+				descriptorField("type_name", 6, TypeString, false, ""),
+				descriptorField("options", 8, TypeMessage, false, "FieldOptions"),
+			},
+		},
+		{
+			Name: descriptorPackage + "FieldOptions",
+			Fields: []Field{
+				descriptorField("packed", 2, TypeBool, false, ""),
+			},
+		},
+		{
+			Name: descriptorPackage + "EnumDescriptorProto",
+			Fields: []Field{
+				descriptorField("name", 1, TypeString, false, ""),
+				descriptorField("value", 2, TypeMessage, true, "EnumValueDescriptorProto"),
+			},
+		},
+		{
+			Name: descriptorPackage + "EnumValueDescriptorProto",
+			Fields: []Field{
+				descriptorField("name", 1, TypeString, false, ""),
+				descriptorField("number", 2, TypeInt32, false, ""),
+			},
+		},
+	},
+}
+
+var descriptorRegistry = newRegistry(descriptorSchema)
+
+type object = map[string]interface{}
+
+func objects(o object, name string) []object {
+	arr, _ := o[name].([]interface{})
+	res := make([]object, 0, len(arr))
+	for _, v := range arr {
+		if obj, ok := v.(object); ok {
+			res = append(res, obj)
+		}
+	}
+	return res
+}
+
+func str(o object, name string) string {
+	s, _ := o[name].(string)
+	return s
+}
+
+func number(o object, name string) int64 {
+	n, ok := o[name].(json.Number)
+	if !ok {
+		return 0
+	}
+	i, _ := strconv.ParseInt(n.String(), 10, 64)
+	return i
+}
+
+func parseDescriptorSet(data []byte) (Schema, error) {
+	m, err := descriptorRegistry.message(descriptorPackage + "FileDescriptorSet")
+	if err != nil {
+		return Schema{}, err
+	}
+	set, err := descriptorRegistry.decodeMessage(m, data, 0)
+	if err != nil {
+		return Schema{}, fmt.Errorf("descriptor set: %w", err)
+	}
+
+	s := Schema{
+		Types: make(map[uint16]string),
+	}
+	for _, file := range objects(set, "file") {
+		prefix := ""
+		if pkg := str(file, "package"); pkg != "" {
+			prefix = pkg + "."
+		}
+		for _, e := range objects(file, "enum_type") {
+			s.Enums = append(s.Enums, parseEnum(prefix, e))
+		}
+		for _, msg := range objects(file, "message_type") {
+			parseMessage(&s, prefix, msg)
+		}
+	}
+
+	if len(s.Messages) == 0 {
+		return Schema{}, fmt.Errorf("descriptor set: no messages")
+	}
+
+	// message types are matched by short names
+	short := make(map[string]string)
+	for _, m := range s.Messages {
+		short[shortName(m.Name)] = m.Name
+	}
+	for _, e := range s.Enums {
+		if shortName(e.Name) != messageTypeEnum {
+			continue
+		}
+		for _, v := range e.Values {
+			name, ok := short[strings.TrimPrefix(v.Name, messageTypePrefix)]
+			if ok {
+				s.Types[uint16(v.Number)] = name
+			}
+		}
+	}
+	if len(s.Types) == 0 {
+		return Schema{}, fmt.Errorf("descriptor set: no %s enum", messageTypeEnum)
+	}
+	return s, nil
+}
+
+func parseEnum(prefix string, e object) Enum {
+	res := Enum{
+		Name: prefix + str(e, "name"),
+	}
+	for _, v := range objects(e, "value") {
+		res.Values = append(res.Values, EnumValue{
+			Name:   str(v, "name"),
+			Number: int32(number(v, "number")),
+		})
+	}
+	return res
+}
+
+func parseMessage(s *Schema, prefix string, msg object) {
+	name := prefix + str(msg, "name")
+	m := Message{
+		Name: name,
+	}
+	for _, f := range objects(msg, "field") {
+		packed := false
+		if options, ok := f["options"].(object); ok {
+			packed, _ = options["packed"].(bool)
+		}
+		m.Fields = append(m.Fields, Field{
+			Name:     str(f, "name"),
+			Number:   uint64(number(f, "number")),
+			Type:     FieldType(number(f, "type")),
+			Repeated: number(f, "label") == labelRepeated,
+			Packed:   packed,
+			TypeName: strings.TrimPrefix(str(f, "type_name"), "."),
+		})
+	}
+	s.Messages = append(s.Messages, m)
+
+	for _, e := range objects(msg, "enum_type") {
+		s.Enums = append(s.Enums, parseEnum(name+".", e))
+	}
+	for _, nested := range objects(msg, "nested_type") {
+		parseMessage(s, name+".", nested)
+	}
+}
@@ -0,0 +1,542 @@
+package protob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// JSON form of the messages:
+//   - field names are the names from .proto files (snake_case)
+//   - numbers are JSON numbers; strings are accepted too
+//   - bytes are hexadecimal strings, like everywhere in trezord API
+//   - enums are value names (numbers are accepted, and used for unknown values)
+//   - repeated fields are arrays, embedded messages are objects
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	maxFieldNumber = 1<<29 - 1
+
+	// embedded messages deeper than this are refused
+	maxDepth = 32
+)
+
+var (
+	ErrMalformed = errors.New("malformed protobuf")
+	errTooDeep   = errors.New("messages nested too deep")
+)
+
+// Encode encodes JSON object into protobuf message of the given type;
+// it returns the message type for wire.
+func Encode(typ string, msg json.RawMessage) (uint16, []byte, error) {
+	return reg.encode(typ, msg)
+}
+
+// Decode decodes protobuf message of the given message type into JSON;
+// it returns short name of the type
+func Decode(kind uint16, data []byte) (string, json.RawMessage, error) {
+	return reg.decode(kind, data)
+}
+
+// TypeName returns short name of the message type, if registered
+func TypeName(kind uint16) (string, bool) {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	name, ok := reg.types[kind]
+	if !ok {
+		return "", false
+	}
+	return shortName(name), true
+}
+
+func (r *registry) encode(typ string, msg json.RawMessage) (uint16, []byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	m, err := r.message(typ)
+	if err != nil {
+		return 0, nil, err
+	}
+	kind, ok := r.kinds[m.Name]
+	if !ok {
+		return 0, nil, fmt.Errorf("message %s has no message type, cannot be sent", m.Name)
+	}
+
+	var obj map[string]interface{}
+	if len(bytes.TrimSpace(msg)) != 0 {
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.UseNumber()
+		err = dec.Decode(&obj)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	data, err := r.encodeMessage(m, obj, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return kind, data, nil
+}
+
+func (r *registry) decode(kind uint16, data []byte) (string, json.RawMessage, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	name, ok := r.types[kind]
+	if !ok {
+		return "", nil, fmt.Errorf("%w %d", ErrUnknownType, kind)
+	}
+	m, err := r.message(name)
+	if err != nil {
+		return "", nil, err
+	}
+	obj, err := r.decodeMessage(m, data, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	res, err := json.Marshal(obj)
+	if err != nil {
+		return "", nil, err
+	}
+	return shortName(m.Name), res, nil
+}
+
+func (r *registry) encodeMessage(m *Message, obj map[string]interface{}, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	for name := range obj {
+		if m.field(name) == nil {
+			return nil, fmt.Errorf("unknown field %s in %s", name, m.Name)
+		}
+	}
+
+	var buf []byte
+	for i := range m.Fields {
+		f := &m.Fields[i]
+		v, ok := obj[f.Name]
+		if !ok || v == nil {
+			continue
+		}
+		var err error
+		if f.Repeated {
+			arr, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("field %s in %s should be an array", f.Name, m.Name)
+			}
+			buf, err = r.encodeRepeated(buf, f, arr, depth)
+		} else {
+			buf, err = r.encodeField(buf, f, v, depth)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (m *Message) field(name string) *Field {
+	for i := range m.Fields {
+		if m.Fields[i].Name == name {
+			return &m.Fields[i]
+		}
+	}
+	return nil
+}
+
+func (m *Message) fieldByNumber(number uint64) *Field {
+	for i := range m.Fields {
+		if m.Fields[i].Number == number {
+			return &m.Fields[i]
+		}
+	}
+	return nil
+}
+
+func wireType(t FieldType) int {
+	switch t {
+	case TypeDouble, TypeFixed64, TypeSfixed64:
+		return wireFixed64
+	case TypeFloat, TypeFixed32, TypeSfixed32:
+		return wireFixed32
+	case TypeString, TypeBytes, TypeMessage:
+		return wireBytes
+	default:
+		return wireVarint
+	}
+}
+
+func appendKey(buf []byte, number uint64, wt int) []byte {
+	return binary.AppendUvarint(buf, number<<3|uint64(wt))
+}
+
+func (r *registry) encodeRepeated(buf []byte, f *Field, arr []interface{}, depth int) ([]byte, error) {
+	if f.Packed && wireType(f.Type) != wireBytes {
+		var packed []byte
+		for _, v := range arr {
+			var err error
+			packed, err = r.encodeValue(packed, f, v, depth)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buf = appendKey(buf, f.Number, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(len(packed)))
+		return append(buf, packed...), nil
+	}
+	for _, v := range arr {
+		var err error
+		buf, err = r.encodeField(buf, f, v, depth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (r *registry) encodeField(buf []byte, f *Field, v interface{}, depth int) ([]byte, error) {
+	buf = appendKey(buf, f.Number, wireType(f.Type))
+	return r.encodeValue(buf, f, v, depth)
+}
+
+// encodeValue encodes the value without the key
+func (r *registry) encodeValue(buf []byte, f *Field, v interface{}, depth int) ([]byte, error) {
+	wrongType := fmt.Errorf("wrong value of field %s", f.Name)
+
+	switch f.Type {
+	case TypeBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, wrongType
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+
+	case TypeString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, wrongType
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		return append(buf, s...), nil
+
+	case TypeBytes:
+		s, ok := v.(string)
+		if !ok {
+			return nil, wrongType
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		return append(buf, b...), nil
+
+	case TypeMessage:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, wrongType
+		}
+		m, ok := r.messages[f.TypeName]
+		if !ok {
+			return nil, fmt.Errorf("%w %s", ErrUnknownType, f.TypeName)
+		}
+		b, err := r.encodeMessage(m, obj, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		return append(buf, b...), nil
+
+	case TypeEnum:
+		if s, ok := v.(string); ok {
+			if e, ok := r.enums[f.TypeName]; ok {
+				for _, val := range e.Values {
+					if val.Name == s {
+						return binary.AppendUvarint(buf, uint64(int64(val.Number))), nil
+					}
+				}
+			}
+		}
+		n, err := parseInt(v, 32)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: unknown enum value %v", f.Name, v)
+		}
+		return binary.AppendUvarint(buf, uint64(n)), nil
+
+	case TypeInt32, TypeInt64:
+		n, err := parseInt(v, bitSize(f.Type))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		// negative numbers are encoded as 64bit
+		return binary.AppendUvarint(buf, uint64(n)), nil
+
+	case TypeSint32, TypeSint64:
+		n, err := parseInt(v, bitSize(f.Type))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return binary.AppendVarint(buf, n), nil
+
+	case TypeUint32, TypeUint64:
+		n, err := parseUint(v, bitSize(f.Type))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return binary.AppendUvarint(buf, n), nil
+
+	case TypeFixed32, TypeFixed64:
+		n, err := parseUint(v, bitSize(f.Type))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return appendFixed(buf, n, f.Type), nil
+
+	case TypeSfixed32, TypeSfixed64:
+		n, err := parseInt(v, bitSize(f.Type))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return appendFixed(buf, uint64(n), f.Type), nil
+
+	case TypeFloat:
+		x, err := parseFloat(v, 32)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(x))), nil
+
+	case TypeDouble:
+		x, err := parseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(x)), nil
+	}
+	return nil, fmt.Errorf("field %s: unsupported type %d", f.Name, f.Type)
+}
+
+func bitSize(t FieldType) int {
+	switch t {
+	case TypeInt32, TypeSint32, TypeUint32, TypeFixed32, TypeSfixed32:
+		return 32
+	}
+	return 64
+}
+
+func appendFixed(buf []byte, n uint64, t FieldType) []byte {
+	if bitSize(t) == 32 {
+		return binary.LittleEndian.AppendUint32(buf, uint32(n))
+	}
+	return binary.LittleEndian.AppendUint64(buf, n)
+}
+
+// numbers can be both JSON numbers and strings
+func numberString(v interface{}) (string, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.String(), nil
+	case string:
+		return n, nil
+	}
+	return "", fmt.Errorf("expected number, got %v", v)
+}
+
+func parseInt(v interface{}, bits int) (int64, error) {
+	s, err := numberString(v)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, bits)
+}
+
+func parseUint(v interface{}, bits int) (uint64, error) {
+	s, err := numberString(v)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, bits)
+}
+
+func parseFloat(v interface{}, bits int) (float64, error) {
+	s, err := numberString(v)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, bits)
+}
+
+func (r *registry) decodeMessage(m *Message, data []byte, depth int) (map[string]interface{}, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+	obj := make(map[string]interface{})
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrMalformed
+		}
+		data = data[n:]
+		fieldNumber := key >> 3
+		wt := int(key & 7)
+		if fieldNumber == 0 || fieldNumber > maxFieldNumber {
+			return nil, fmt.Errorf("%w: field number %d", ErrMalformed, fieldNumber)
+		}
+
+		raw, rest, err := splitValue(data, wt)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		f := m.fieldByNumber(fieldNumber)
+		if f == nil {
+			// unknown fields, from newer firmware, are skipped
+			continue
+		}
+
+		if f.Repeated && wt == wireBytes && wireType(f.Type) != wireBytes {
+			// packed
+			values, err := r.decodePacked(f, raw)
+			if err != nil {
+				return nil, err
+			}
+			arr, _ := obj[f.Name].([]interface{})
+			obj[f.Name] = append(arr, values...)
+			continue
+		}
+
+		if wt != wireType(f.Type) {
+			return nil, fmt.Errorf("%w: wrong wire type of field %s", ErrMalformed, f.Name)
+		}
+		v, err := r.decodeValue(f, wt, raw, depth)
+		if err != nil {
+			return nil, err
+		}
+		if f.Repeated {
+			arr, _ := obj[f.Name].([]interface{})
+			obj[f.Name] = append(arr, v)
+		} else {
+			obj[f.Name] = v
+		}
+	}
+	return obj, nil
+}
+
+// splitValue returns the raw value of wire type wt (varint is still encoded)
+// and the rest of the data
+func splitValue(data []byte, wt int) ([]byte, []byte, error) {
+	switch wt {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, ErrMalformed
+		}
+		return data[:n], data[n:], nil
+	case wireFixed64:
+		if len(data) < 8 {
+			return nil, nil, ErrMalformed
+		}
+		return data[:8], data[8:], nil
+	case wireFixed32:
+		if len(data) < 4 {
+			return nil, nil, ErrMalformed
+		}
+		return data[:4], data[4:], nil
+	case wireBytes:
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, nil, ErrMalformed
+		}
+		end := n + int(size)
+		return data[n:end], data[end:], nil
+	}
+	// groups are deprecated and not used by trezor
+	return nil, nil, fmt.Errorf("%w: unsupported wire type %d", ErrMalformed, wt)
+}
+
+func (r *registry) decodePacked(f *Field, data []byte) ([]interface{}, error) {
+	var res []interface{}
+	wt := wireType(f.Type)
+	for len(data) > 0 {
+		raw, rest, err := splitValue(data, wt)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		v, err := r.decodeValue(f, wt, raw, 0)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (r *registry) decodeValue(f *Field, wt int, raw []byte, depth int) (interface{}, error) {
+	var u uint64
+	switch wt {
+	case wireVarint:
+		u, _ = binary.Uvarint(raw)
+	case wireFixed32:
+		u = uint64(binary.LittleEndian.Uint32(raw))
+	case wireFixed64:
+		u = binary.LittleEndian.Uint64(raw)
+	}
+
+	switch f.Type {
+	case TypeBool:
+		return u != 0, nil
+	case TypeString:
+		return string(raw), nil
+	case TypeBytes:
+		return hex.EncodeToString(raw), nil
+	case TypeMessage:
+		m, ok := r.messages[f.TypeName]
+		if !ok {
+			return nil, fmt.Errorf("%w %s", ErrUnknownType, f.TypeName)
+		}
+		return r.decodeMessage(m, raw, depth+1)
+	case TypeEnum:
+		n := int32(u)
+		if e, ok := r.enums[f.TypeName]; ok {
+			for _, val := range e.Values {
+				if val.Number == n {
+					return val.Name, nil
+				}
+			}
+		}
+		return json.Number(strconv.FormatInt(int64(n), 10)), nil
+	case TypeInt32:
+		return json.Number(strconv.FormatInt(int64(int32(u)), 10)), nil
+	case TypeInt64:
+		return json.Number(strconv.FormatInt(int64(u), 10)), nil
+	case TypeSint32, TypeSint64:
+		n, _ := binary.Varint(raw)
+		return json.Number(strconv.FormatInt(n, 10)), nil
+	case TypeSfixed32:
+		return json.Number(strconv.FormatInt(int64(int32(u)), 10)), nil
+	case TypeSfixed64:
+		return json.Number(strconv.FormatInt(int64(u), 10)), nil
+	case TypeUint32, TypeUint64, TypeFixed32, TypeFixed64:
+		return json.Number(strconv.FormatUint(u, 10)), nil
+	case TypeFloat:
+		return float64(math.Float32frombits(uint32(u))), nil
+	case TypeDouble:
+		return math.Float64frombits(u), nil
+	}
+	return nil, fmt.Errorf("field %s: unsupported type %d", f.Name, f.Type)
+}
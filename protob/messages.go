@@ -0,0 +1,29 @@
+package protob
+
+import (
+	_ "embed"
+)
+
+// Descriptor set of all trezor-common messages, embedded into the binary,
+// so -protob is needed only for messages newer than the build.
+// It is generated by scripts/protob.sh from a pinned trezor-common
+// version and committed; while the file is empty, only the subset
+// in builtin.go is available.
+
+//go:generate ../scripts/protob.sh
+
+//go:embed messages.pb
+var messagesDescriptorSet []byte
+
+// builtin is the schema that messages start with
+func builtin() Schema {
+	if len(messagesDescriptorSet) == 0 {
+		return builtinSchema
+	}
+	s, err := parseDescriptorSet(messagesDescriptorSet)
+	if err != nil {
+		// generated at build time, so this is a broken build
+		panic("protob: embedded descriptor set: " + err.Error())
+	}
+	return s
+}
@@ -0,0 +1,211 @@
+package protob
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func jsonEqual(t *testing.T, expected string, actual json.RawMessage) {
+	t.Helper()
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(actual, &a); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	testcases := []struct {
+		typ  string
+		msg  string
+		kind uint16
+		data string
+	}{
+		{"GetFeatures", ``, 55, ""},
+		{"GetFeatures", `{}`, 55, ""},
+		{"Ping", `{"message":"hi","button_protection":true}`, 1, "0a0268691001"},
+		{"hw.trezor.messages.common.PinMatrixAck", `{"pin":"1234"}`, 19, "0a0431323334"},
+		{"Initialize", `{"session_id":"abcd"}`, 0, "0a02abcd"},
+		// hardened path, not packed; enum by name
+		{"GetPublicKey", `{"address_n":[2147483692, "0"],"coin_name":"Bitcoin","script_type":"SPENDWITNESS"}`, 11, "08ac8080800808002207426974636f696e2803"},
+	}
+	for _, tc := range testcases {
+		kind, data, err := Encode(tc.typ, json.RawMessage(tc.msg))
+		if err != nil {
+			t.Errorf("%s: %s", tc.typ, err)
+			continue
+		}
+		if kind != tc.kind || hex.EncodeToString(data) != tc.data {
+			t.Errorf("%s: expected %d %s, got %d %x", tc.typ, tc.kind, tc.data, kind, data)
+		}
+	}
+
+	errcases := []struct {
+		typ string
+		msg string
+	}{
+		{"Unknown", `{}`},
+		{"Ping", `{"unknown":1}`},
+		{"Ping", `{"message":1}`},
+		{"GetPublicKey", `{"address_n":1}`},
+		{"GetPublicKey", `{"address_n":[-1]}`},
+		{"GetPublicKey", `{"script_type":"UNKNOWN"}`},
+		{"Initialize", `{"session_id":"xyz"}`},
+		// no message type
+		{"HDNodeType", `{}`},
+	}
+	for _, tc := range errcases {
+		_, _, err := Encode(tc.typ, json.RawMessage(tc.msg))
+		if err == nil {
+			t.Errorf("%s %s: expected error", tc.typ, tc.msg)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	testcases := []struct {
+		kind uint16
+		data string
+		typ  string
+		json string
+	}{
+		{2, "", "Success", `{}`},
+		// enum by name
+		{3, "0804120b50494e20696e76616c6964", "Failure", `{"code":"Failure_ActionCancelled","message":"PIN invalid"}`},
+		// unknown enum value is a number; unknown field 15 is skipped
+		{26, "08e807780a", "ButtonRequest", `{"code":1000}`},
+		// embedded message; bytes are hex
+		{12, "0a0808011002220201021204787075621803", "PublicKey",
+			`{"node":{"depth":1,"fingerprint":2,"chain_code":"0102"},"xpub":"xpub","root_fingerprint":3}`},
+		// repeated enum, packed and not packed
+		{17, "0a097472657a6f722e696f1002f00101f2010102", "Features",
+			`{"vendor":"trezor.io","major_version":2,"capabilities":["Capability_Bitcoin","Capability_Bitcoin_like"]}`},
+	}
+	for _, tc := range testcases {
+		data, err := hex.DecodeString(tc.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ, res, err := Decode(tc.kind, data)
+		if err != nil {
+			t.Errorf("%d: %s", tc.kind, err)
+			continue
+		}
+		if typ != tc.typ {
+			t.Errorf("expected %s, got %s", tc.typ, typ)
+		}
+		jsonEqual(t, tc.json, res)
+	}
+
+	errcases := []struct {
+		kind uint16
+		data string
+	}{
+		{9999, ""},
+		// truncated string
+		{2, "0a05"},
+		// group
+		{2, "0b"},
+		// wrong wire type of message field
+		{2, "0801"},
+	}
+	for _, tc := range errcases {
+		data, _ := hex.DecodeString(tc.data)
+		_, _, err := Decode(tc.kind, data)
+		if err == nil {
+			t.Errorf("%d %s: expected error", tc.kind, tc.data)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	msg := `{"address_n":[2147483692,2147483648,2147483648,0,5],"coin_name":"Testnet","show_display":true,"script_type":"SPENDTAPROOT"}`
+	kind, data, err := Encode("GetAddress", json.RawMessage(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, res, err := Decode(kind, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != "GetAddress" {
+		t.Errorf("expected GetAddress, got %s", typ)
+	}
+	jsonEqual(t, msg, res)
+}
+
+func TestDescriptorSet(t *testing.T) {
+	// descriptor set like protoc makes, encoded using our own encoder
+	set := `{"file":[
+		{"name":"messages.proto","package":"hw.trezor.messages","enum_type":[
+			{"name":"MessageType","value":[
+				{"name":"MessageType_Hello","number":1000},
+				{"name":"MessageType_World","number":1001}
+			]}
+		]},
+		{"name":"messages-hello.proto","package":"hw.trezor.messages.hello","message_type":[
+			{"name":"Hello","field":[
+				{"name":"numbers","number":1,"label":3,"type":17,"options":{"packed":true}},
+				{"name":"inner","number":2,"label":1,"type":11,"type_name":".hw.trezor.messages.hello.Hello.Inner"},
+				{"name":"kind","number":3,"label":1,"type":14,"type_name":".hw.trezor.messages.hello.Hello.Kind"}
+			],"nested_type":[
+				{"name":"Inner","field":[{"name":"value","number":1,"label":1,"type":7}]}
+			],"enum_type":[
+				{"name":"Kind","value":[{"name":"FIRST","number":0},{"name":"SECOND","number":1}]}
+			]},
+			{"name":"World"}
+		]}
+	]}`
+	m, err := descriptorRegistry.message("FileDescriptorSet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(set)))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	data, err := descriptorRegistry.encodeMessage(m, obj, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := parseDescriptorSet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRegistry(s)
+
+	msg := `{"numbers":[-1,2,-300],"inner":{"value":7},"kind":"SECOND"}`
+	kind, encoded, err := r.encode("Hello", json.RawMessage(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// packed sint32, fixed32 in embedded message
+	if kind != 1000 || hex.EncodeToString(encoded) != "0a040104d70412050d070000001801" {
+		t.Errorf("unexpected encoding %d %x", kind, encoded)
+	}
+	typ, res, err := r.decode(kind, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != "Hello" {
+		t.Errorf("expected Hello, got %s", typ)
+	}
+	jsonEqual(t, msg, res)
+
+	_, err = parseDescriptorSet([]byte{0x0b})
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected malformed error, got %v", err)
+	}
+}
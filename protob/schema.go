@@ -0,0 +1,172 @@
+package protob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Package for converting trezor protobuf messages from and to JSON,
+// so that clients of the JSON call API do not need to know protobuf.
+//
+// The message definitions (schema) are either the built-in subset
+// of trezor-common messages (see builtin.go), or loaded from
+// a descriptor set compiled from trezor-common by protoc, see
+// RegisterDescriptorSet. No protobuf library is used;
+// the encoding itself is simple enough.
+
+// FieldType has the same values as FieldDescriptorProto.Type
+type FieldType int32
+
+const (
+	TypeDouble   FieldType = 1
+	TypeFloat    FieldType = 2
+	TypeInt64    FieldType = 3
+	TypeUint64   FieldType = 4
+	TypeInt32    FieldType = 5
+	TypeFixed64  FieldType = 6
+	TypeFixed32  FieldType = 7
+	TypeBool     FieldType = 8
+	TypeString   FieldType = 9
+	TypeGroup    FieldType = 10 // not supported
+	TypeMessage  FieldType = 11
+	TypeBytes    FieldType = 12
+	TypeUint32   FieldType = 13
+	TypeEnum     FieldType = 14
+	TypeSfixed32 FieldType = 15
+	TypeSfixed64 FieldType = 16
+	TypeSint32   FieldType = 17
+	TypeSint64   FieldType = 18
+)
+
+type Field struct {
+	Name     string
+	Number   uint64
+	Type     FieldType
+	Repeated bool
+	Packed   bool
+	TypeName string // full name of the message or enum, for TypeMessage and TypeEnum
+}
+
+type Message struct {
+	Name   string // full name, like hw.trezor.messages.management.Features
+	Fields []Field
+}
+
+type EnumValue struct {
+	Name   string
+	Number int32
+}
+
+type Enum struct {
+	Name   string // full name
+	Values []EnumValue
+}
+
+type Schema struct {
+	Messages []Message
+	Enums    []Enum
+	Types    map[uint16]string // message type on wire => full message name
+}
+
+type registry struct {
+	mutex    sync.RWMutex
+	messages map[string]*Message
+	enums    map[string]*Enum
+	short    map[string][]string // short name => full names
+	types    map[uint16]string   // message type => full name
+	kinds    map[string]uint16   // full name => message type
+}
+
+var reg = newRegistry(builtin())
+
+func newRegistry(s Schema) *registry {
+	r := &registry{
+		messages: make(map[string]*Message),
+		enums:    make(map[string]*Enum),
+		short:    make(map[string][]string),
+		types:    make(map[uint16]string),
+		kinds:    make(map[string]uint16),
+	}
+	r.register(s)
+	return r
+}
+
+var (
+	ErrUnknownType = errors.New("unknown message type")
+)
+
+// Register adds the messages to the known ones;
+// messages with the same full name or message type are replaced
+func Register(s Schema) {
+	reg.register(s)
+}
+
+// RegisterDescriptorSet reads FileDescriptorSet, as made by
+// protoc --include_imports -o, and registers all its messages.
+// Message types are taken from the MessageType enum of trezor-common.
+func RegisterDescriptorSet(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s, err := parseDescriptorSet(data)
+	if err != nil {
+		return err
+	}
+	Register(s)
+	return nil
+}
+
+func shortName(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (r *registry) register(s Schema) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := range s.Messages {
+		m := s.Messages[i]
+		fields := make([]Field, len(m.Fields))
+		copy(fields, m.Fields)
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Number < fields[j].Number
+		})
+		m.Fields = fields
+		if _, ok := r.messages[m.Name]; !ok {
+			short := shortName(m.Name)
+			r.short[short] = append(r.short[short], m.Name)
+		}
+		r.messages[m.Name] = &m
+	}
+	for i := range s.Enums {
+		e := s.Enums[i]
+		r.enums[e.Name] = &e
+	}
+	for kind, name := range s.Types {
+		if old, ok := r.types[kind]; ok {
+			delete(r.kinds, old)
+		}
+		r.types[kind] = name
+		r.kinds[name] = kind
+	}
+}
+
+// message finds message by full name, or by short name if it is unique
+func (r *registry) message(name string) (*Message, error) {
+	if m, ok := r.messages[name]; ok {
+		return m, nil
+	}
+	full := r.short[name]
+	if len(full) == 1 {
+		return r.messages[full[0]], nil
+	}
+	if len(full) > 1 {
+		return nil, fmt.Errorf("ambiguous message type %s, use one of %s", name, strings.Join(full, ", "))
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownType, name)
+}
@@ -0,0 +1,20 @@
+#!/bin/sh
+# Generates protob/messages.pb, the descriptor set of all trezor-common
+# messages, which is embedded into trezord and committed with it.
+# Needs git and protoc.
+#
+# trezor-common is the common/ directory of trezor-firmware; the messages
+# are taken from the firmware release in TREZOR_COMMON_REF, so that
+# the generated file changes only when the tag is bumped here.
+
+set -e
+
+ref="${TREZOR_COMMON_REF:-core/v2.6.0}"
+out="$(cd "$(dirname "$0")/../protob" && pwd)/messages.pb"
+tmp="$(mktemp -d)"
+trap 'rm -rf "$tmp"' EXIT
+
+git clone --quiet --depth 1 --branch "$ref" https://github.com/trezor/trezor-firmware "$tmp/trezor-firmware"
+protob="$tmp/trezor-firmware/common/protob"
+protoc --include_imports -o "$out" -I "$protob" "$protob"/*.proto
+echo "written $out from trezor-firmware $ref"
@@ -1,14 +1,20 @@
 package api
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/trezor/trezord-go/core"
 	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/protob"
 
 	"github.com/gorilla/mux"
 )
@@ -23,35 +29,60 @@ type api struct {
 	version string
 	githash string
 	logger  *memorywriter.MemoryWriter
+	v2      bool // errors with status codes, see errors.go
 }
 
-func ServeAPI(r *mux.Router, c *core.Core, v, h string, l *memorywriter.MemoryWriter) {
+func ServeAPI(r *mux.Router, c *core.Core, v, h string, l *memorywriter.MemoryWriter, limits RateLimits) {
 	api := &api{
 		core:    c,
 		version: v,
 		githash: h,
 		logger:  l,
 	}
+	limiter := newLimiter(limits, l)
+	apiV2 := *api
+	apiV2.v2 = true
+	serveAPIv2(r.PathPrefix("/v2").Subrouter(), &apiV2, limiter)
+
 	r.HandleFunc("/", api.Info)
 	r.HandleFunc("/configure", api.Info)
-	r.HandleFunc("/listen", api.Listen)
+	r.HandleFunc("/listen", limiter.Listen(api.Listen))
 	r.HandleFunc("/enumerate", api.Enumerate)
 	r.HandleFunc("/acquire/{path}", api.Acquire)
 	r.HandleFunc("/acquire/{path}/{session}", api.Acquire)
 	r.HandleFunc("/release/{session}", api.Release)
+	r.HandleFunc("/cancel/{session}", api.Cancel)
 	r.HandleFunc("/call/{session}", api.Call)
 	r.HandleFunc("/post/{session}", api.Post)
 	r.HandleFunc("/read/{session}", api.Read)
+	r.HandleFunc("/json/call/{session}", api.CallJSON)
 	r.HandleFunc("/debug/acquire/{path}", api.AcquireDebug)
 	r.HandleFunc("/debug/acquire/{path}/{session}", api.AcquireDebug)
 	r.HandleFunc("/debug/release/{session}", api.ReleaseDebug)
 	r.HandleFunc("/debug/call/{session}", api.CallDebug)
 	r.HandleFunc("/debug/post/{session}", api.PostDebug)
 	r.HandleFunc("/debug/read/{session}", api.ReadDebug)
+	r.HandleFunc("/debug/json/call/{session}", api.CallJSONDebug)
 	if !core.IsDebugBinary() {
 		corsv := corsValidator()
 		r.Use(CORS(corsv))
 	}
+	// after CORS, so preflight requests and
+	// requests from other origins are not counted
+	r.Use(limiter.Middleware)
+	r.Use(clientContext)
+}
+
+// clientContext puts origin and user agent into request context,
+// for audit log in core
+func clientContext(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := core.WithClient(r.Context(), core.Client{
+			Origin:    r.Header.Get(corsOriginHeader),
+			UserAgent: r.UserAgent(),
+		})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func (a *api) Info(w http.ResponseWriter, r *http.Request) {
@@ -84,7 +115,7 @@ func (a *api) Listen(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	if err != nil {
-		a.respondError(w, err)
+		a.respondError(w, badRequest(err))
 		return
 	}
 
@@ -125,7 +156,7 @@ func (a *api) acquire(w http.ResponseWriter, r *http.Request, debug bool) {
 	if prev == "null" {
 		prev = ""
 	}
-	res, err := a.core.Acquire(path, prev, debug)
+	res, err := a.core.Acquire(path, prev, debug, r.Context())
 
 	if err != nil {
 		a.respondError(w, err)
@@ -156,7 +187,25 @@ func (a *api) release(w http.ResponseWriter, r *http.Request, debug bool) {
 	vars := mux.Vars(r)
 	session := vars["session"]
 
-	err := a.core.Release(session, debug)
+	err := a.core.Release(session, debug, r.Context())
+
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+
+	a.logger.Log("done, encoding")
+	err = json.NewEncoder(w).Encode(vars)
+	a.checkJSONError(w, err)
+}
+
+func (a *api) Cancel(w http.ResponseWriter, r *http.Request) {
+	a.logger.Log("start")
+
+	vars := mux.Vars(r)
+	session := vars["session"]
+
+	err := a.core.Cancel(session, r.Context())
 
 	if err != nil {
 		a.respondError(w, err)
@@ -202,22 +251,36 @@ func (a *api) call(w http.ResponseWriter, r *http.Request, mode core.CallMode, d
 	if mode != core.CallModeRead {
 		hexbody, err := io.ReadAll(r.Body)
 		if err != nil {
-			a.respondError(w, err)
+			a.respondError(w, badRequest(err))
 			return
 		}
 		binbody, err = hex.DecodeString(string(hexbody))
 		if err != nil {
-			a.respondError(w, err)
+			a.respondError(w, badRequest(err))
 			return
 		}
 	}
 
-	binres, err := a.core.Call(binbody, session, mode, debug, r.Context())
+	ctx, err := callContext(r)
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+
+	if mode != core.CallModeWrite && r.URL.Query().Get("stream") == "1" {
+		a.callStream(w, r.WithContext(ctx), binbody, session, mode, debug)
+		return
+	}
+
+	binres, err := a.core.Call(binbody, session, mode, debug, ctx)
 	if err != nil {
 		a.respondError(w, err)
 		return
 	}
 
+	if mode == core.CallModeWrite && a.v2 {
+		w.WriteHeader(http.StatusNoContent)
+	}
 	if mode != core.CallModeWrite {
 		hexres := hex.EncodeToString(binres)
 		_, err = w.Write([]byte(hexres))
@@ -228,6 +291,134 @@ func (a *api) call(w http.ResponseWriter, r *http.Request, mode core.CallMode, d
 	}
 }
 
+var errInvalidTimeout = errors.New("invalid timeout")
+
+// callContext sets the read deadline of the call from the timeout
+// parameter, either a duration like 30s or milliseconds;
+// it also sets cancelling on device with onclose=cancel
+func callContext(r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	if r.URL.Query().Get("onclose") == "cancel" {
+		ctx = core.WithCancelOnClose(ctx)
+	}
+	param := r.URL.Query().Get("timeout")
+	if param == "" {
+		return ctx, nil
+	}
+	timeout, err := time.ParseDuration(param)
+	if err != nil {
+		ms, errMs := strconv.ParseUint(param, 10, 32)
+		if errMs != nil {
+			return nil, errInvalidTimeout
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	if timeout <= 0 {
+		return nil, errInvalidTimeout
+	}
+	return core.WithReadDeadline(ctx, time.Now().Add(timeout)), nil
+}
+
+// callStream writes the hexadecimal response as the packets come from the device.
+// Errors before the response starts are reported as usual; later errors
+// abort the response, so the client sees it incomplete.
+func (a *api) callStream(w http.ResponseWriter, r *http.Request, binbody []byte, session string, mode core.CallMode, debug bool) {
+	sw := &streamWriter{w: w}
+	err := a.core.CallStream(binbody, session, mode, debug, r.Context(), hex.NewEncoder(sw))
+	if err != nil {
+		if !sw.started {
+			a.respondError(w, err)
+			return
+		}
+		a.logger.Log("aborting stream: " + err.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// streamWriter flushes every write to the client
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.started = true
+	n, err := s.w.Write(p)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (a *api) CallJSON(w http.ResponseWriter, r *http.Request) {
+	a.callJSON(w, r, false)
+}
+
+func (a *api) CallJSONDebug(w http.ResponseWriter, r *http.Request) {
+	a.callJSON(w, r, true)
+}
+
+// message in JSON, see protob package for the format
+type jsonMessage struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// callJSON is like call, but encodes and decodes the protobuf messages
+func (a *api) callJSON(w http.ResponseWriter, r *http.Request, debug bool) {
+	a.logger.Log("start")
+
+	vars := mux.Vars(r)
+	session := vars["session"]
+
+	var req jsonMessage
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		a.respondError(w, badRequest(err))
+		return
+	}
+
+	a.logger.Log("encoding " + req.Type)
+	kind, data, err := protob.Encode(req.Type, req.Message)
+	if err != nil {
+		a.respondError(w, badRequest(err))
+		return
+	}
+	binbody := make([]byte, 6, 6+len(data))
+	binary.BigEndian.PutUint16(binbody[0:2], kind)
+	binary.BigEndian.PutUint32(binbody[2:6], uint32(len(data)))
+	binbody = append(binbody, data...)
+
+	ctx, err := callContext(r)
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+
+	binres, err := a.core.Call(binbody, session, core.CallModeReadWrite, debug, ctx)
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+	if len(binres) < 6 {
+		a.respondError(w, core.ErrMalformedData)
+		return
+	}
+
+	typ, msg, err := protob.Decode(binary.BigEndian.Uint16(binres[0:2]), binres[6:])
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+	a.logger.Log("decoded " + typ)
+
+	err = json.NewEncoder(w).Encode(jsonMessage{
+		Type:    typ,
+		Message: msg,
+	})
+	a.checkJSONError(w, err)
+}
+
 func corsValidator() OriginValidator {
 	// *.trezor.io
 	trezorRegex := regexp.MustCompile(`^https://([[:alnum:]\-_]+\.)*trezor\.io$`)
@@ -271,6 +462,10 @@ func (a *api) checkJSONError(w http.ResponseWriter, err error) {
 }
 
 func (a *api) respondError(w http.ResponseWriter, err error) {
+	if a.v2 {
+		a.respondErrorV2(w, err)
+		return
+	}
 	type jsonError struct {
 		Error string `json:"error"`
 	}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/protob"
+	"github.com/trezor/trezord-go/wire"
+)
+
+// Errors of the v2 API have HTTP status and a stable code, so clients
+// do not need to match the messages; v1 returns just the message.
+// The codes are listed in README and must not change.
+
+type errorCode struct {
+	err    error
+	status int
+	code   string
+}
+
+// errorCodes are checked in order, with errors.Is
+var errorCodes = []errorCode{
+	{core.ErrSessionNotFound, http.StatusNotFound, "session_not_found"},
+	{core.ErrDeviceNotFound, http.StatusNotFound, "device_not_found"},
+	{core.ErrNotDebug, http.StatusNotFound, "no_debug_link"},
+	{core.ErrWrongPrevSession, http.StatusConflict, "wrong_previous_session"},
+	{core.ErrOtherCall, http.StatusConflict, "other_call_in_progress"},
+	{core.ErrSessionStolen, http.StatusGone, "session_stolen"},
+	{core.ErrDisconnected, http.StatusGone, "device_disconnected"},
+	{syscall.ENODEV, http.StatusGone, "device_disconnected"},
+	{core.ErrClosedDevice, http.StatusGone, "device_closed"},
+	{core.ErrMalformedData, http.StatusBadRequest, "malformed_data"},
+	{protob.ErrUnknownType, http.StatusBadRequest, "unknown_message_type"},
+	{errInvalidTimeout, http.StatusBadRequest, "invalid_timeout"},
+	{core.ErrNoDeadline, http.StatusNotImplemented, "deadline_not_supported"},
+	{core.ErrTimeout, http.StatusGatewayTimeout, "read_timeout"},
+	{wire.ErrMessageTooLarge, http.StatusBadGateway, "device_message_too_large"},
+	{wire.ErrMalformedMessage, http.StatusBadGateway, "malformed_device_message"},
+	{protob.ErrMalformed, http.StatusBadGateway, "malformed_device_message"},
+	{core.ErrClosed, http.StatusServiceUnavailable, "shutting_down"},
+	{os.ErrPermission, http.StatusForbidden, "device_access_denied"},
+	{syscall.EBUSY, http.StatusConflict, "device_busy"},
+}
+
+// requestError is a malformed request, like wrong JSON or hex;
+// the message stays the same for v1
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return &requestError{err: err}
+}
+
+// errorStatus returns HTTP status and code of the error
+func errorStatus(err error) (int, string) {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.status, c.code
+		}
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return http.StatusBadRequest, "invalid_request"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+type jsonErrorV2 struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	// of the client that stole the session, for session_stolen
+	Origin string `json:"origin,omitempty"`
+}
+
+// errorV2 replaces errors that v1 returns as they are
+func errorV2(err error) error {
+	// paths are numbers; core fails to parse the others
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return core.ErrDeviceNotFound
+	}
+	return err
+}
+
+func (a *api) respondErrorV2(w http.ResponseWriter, err error) {
+	err = errorV2(err)
+	status, code := errorStatus(err)
+	a.logger.Log("Returning error: " + code + " " + err.Error())
+	res := jsonErrorV2{
+		Error: err.Error(),
+		Code:  code,
+	}
+	var stolen *core.SessionStolenError
+	if errors.As(err, &stolen) {
+		res.Origin = stolen.Origin
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// if even the encoder of the error errors, just log the error
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		a.logger.Log("Error while writing error: " + err.Error())
+	}
+}
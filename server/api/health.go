@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+
+	"github.com/gorilla/mux"
+)
+
+// Health endpoint is for load checks and monitoring, not for browsers;
+// it does not touch USB and only reports the state from the last enumeration.
+// It is plain GET without CORS and CSRF checks, as it does not change anything.
+
+const (
+	healthOK    = "ok"
+	healthError = "error"
+	// no buses yet (lazy), or some bus was not enumerated yet
+	healthUnknown = "unknown"
+)
+
+type health struct {
+	core    *core.Core
+	version string
+	githash string
+	started time.Time
+	logger  *memorywriter.MemoryWriter
+}
+
+type healthSessions struct {
+	Normal int `json:"normal"`
+	Debug  int `json:"debug"`
+}
+
+type healthResult struct {
+	Status   string           `json:"status"`
+	Version  string           `json:"version"`
+	Githash  string           `json:"githash"`
+	Uptime   int64            `json:"uptime"` // seconds
+	Sessions healthSessions   `json:"sessions"`
+	Buses    []core.BusStatus `json:"buses"`
+	// of the last audit log record
+	AuditLogError string `json:"auditLogError,omitempty"`
+}
+
+func ServeHealth(r *mux.Router, c *core.Core, v, h string, l *memorywriter.MemoryWriter) {
+	health := &health{
+		core:    c,
+		version: v,
+		githash: h,
+		started: time.Now(),
+		logger:  l,
+	}
+	r.HandleFunc("/health", health.Health)
+}
+
+func (h *health) Health(w http.ResponseWriter, r *http.Request) {
+	buses := h.core.BusStatus()
+	if buses == nil {
+		buses = []core.BusStatus{}
+	}
+
+	status := healthOK
+	if len(buses) == 0 {
+		status = healthUnknown
+	}
+	for _, b := range buses {
+		if b.Error != "" {
+			status = healthError
+			break
+		}
+		if b.LastEnumerate == nil {
+			status = healthUnknown
+		}
+	}
+	auditErr := ""
+	if err := h.core.AuditLogError(); err != nil {
+		auditErr = err.Error()
+		status = healthError
+	}
+
+	res := healthResult{
+		Status:  status,
+		Version: h.version,
+		Githash: h.githash,
+		Uptime:  int64(time.Since(h.started).Seconds()),
+		Sessions: healthSessions{
+			Normal: h.core.SessionCount(false),
+			Debug:  h.core.SessionCount(true),
+		},
+		Buses:         buses,
+		AuditLogError: auditErr,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == healthError {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		h.logger.Log("Error on encoding health: " + err.Error())
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/core/coretest"
+	"github.com/trezor/trezord-go/memorywriter"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHealth(t *testing.T) {
+	now := time.Now()
+	testcases := []struct {
+		status     []core.BusStatus
+		code       int
+		healthText string
+	}{
+		{nil, http.StatusOK, healthUnknown},
+		{[]core.BusStatus{{Name: "udp", Detail: "21324"}}, http.StatusOK, healthUnknown},
+		{[]core.BusStatus{{Name: "udp", Detail: "21324", LastEnumerate: &now}}, http.StatusOK, healthOK},
+		{[]core.BusStatus{{Name: "udp"}, {Name: "libusb", LastEnumerate: &now, Error: "LIBUSB_ERROR_IO"}}, http.StatusServiceUnavailable, healthError},
+	}
+
+	mw := memorywriter.New(100, 10, false, nil)
+	for _, tc := range testcases {
+		c := core.New(&coretest.Bus{Status: tc.status}, mw, nil, true, false)
+		r := mux.NewRouter()
+		ServeHealth(r, c, "1.2.3", "abc", mw)
+
+		w := httptest.NewRecorder()
+		// no origin, like load checks
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		c.Stop()
+
+		if w.Code != tc.code {
+			t.Errorf("expected code %d, got %d", tc.code, w.Code)
+		}
+		var res healthResult
+		err := json.NewDecoder(w.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != tc.healthText || res.Version != "1.2.3" || len(res.Buses) != len(tc.status) {
+			t.Errorf("unexpected result %+v", res)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trezor/trezord-go/memorywriter"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits of API use per origin, so one misbehaving page cannot
+// make the bridge and the USB bus sluggish for everyone.
+//
+// Each origin has a token bucket for API requests, and a cap
+// on concurrent /listen long-polls, which each run their own enumeration loop.
+// Requests on an acquired session (call, post, read, cancel, release)
+// are not counted, as long flows like signing need many of them.
+// Clients without origin (not browsers) all share one bucket.
+type RateLimits struct {
+	Rate       float64 // requests per second, refill rate of the bucket; 0 is unlimited
+	Burst      int     // size of the bucket
+	MaxListens int     // concurrent /listen requests; 0 is unlimited
+}
+
+// DefaultRateLimits do not limit anything; the burst is used
+// when the rate is set
+var DefaultRateLimits = RateLimits{
+	Rate:       0,
+	Burst:      50,
+	MaxListens: 0,
+}
+
+const (
+	retryAfterHeader = "Retry-After"
+
+	// buckets of idle origins are forgotten
+	limiterPruneInterval = time.Minute
+
+	// we don't know when a listen ends; clients should retry soon
+	listenRetryAfter = 1 // second
+)
+
+type originLimit struct {
+	tokens  float64
+	last    time.Time // of tokens update
+	listens int
+}
+
+type limiter struct {
+	limits RateLimits
+	logger *memorywriter.MemoryWriter
+
+	mutex     sync.Mutex
+	origins   map[string]*originLimit
+	lastPrune time.Time
+
+	now func() time.Time // different only in tests
+}
+
+func newLimiter(limits RateLimits, l *memorywriter.MemoryWriter) *limiter {
+	if limits.Rate > 0 && limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	return &limiter{
+		limits:  limits,
+		logger:  l,
+		origins: make(map[string]*originLimit),
+		now:     time.Now,
+	}
+}
+
+// origin returns the state of origin, with refilled tokens;
+// must be called under mutex
+func (l *limiter) origin(origin string, now time.Time) *originLimit {
+	o, ok := l.origins[origin]
+	if !ok {
+		o = &originLimit{
+			tokens: float64(l.limits.Burst),
+			last:   now,
+		}
+		l.origins[origin] = o
+	}
+	elapsed := now.Sub(o.last).Seconds()
+	o.tokens = math.Min(float64(l.limits.Burst), o.tokens+elapsed*l.limits.Rate)
+	o.last = now
+	return o
+}
+
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < limiterPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for origin := range l.origins {
+		o := l.origin(origin, now)
+		if o.listens == 0 && o.tokens >= float64(l.limits.Burst) {
+			delete(l.origins, origin)
+		}
+	}
+}
+
+// take takes one token; if there is none, it returns
+// the number of seconds after which to retry
+func (l *limiter) take(origin string) (bool, int) {
+	if l.limits.Rate <= 0 {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.prune(now)
+	o := l.origin(origin, now)
+	if o.tokens >= 1 {
+		o.tokens--
+		return true, 0
+	}
+	wait := (1 - o.tokens) / l.limits.Rate
+	return false, int(math.Ceil(wait))
+}
+
+func (l *limiter) startListen(origin string) bool {
+	if l.limits.MaxListens <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.prune(now)
+	o := l.origin(origin, now)
+	if o.listens >= l.limits.MaxListens {
+		return false
+	}
+	o.listens++
+	return true
+}
+
+func (l *limiter) endListen(origin string) {
+	if l.limits.MaxListens <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.origin(origin, l.now()).listens--
+}
+
+func (l *limiter) respondLimited(w http.ResponseWriter, r *http.Request, what string, retryAfter int) {
+	type jsonError struct {
+		Error string `json:"error"`
+		Code  string `json:"code,omitempty"` // only in v2
+	}
+	origin := r.Header.Get(corsOriginHeader)
+	l.logger.Log("Limiting origin " + origin + " - " + what)
+	w.Header().Set(retryAfterHeader, strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	res := jsonError{
+		Error: what,
+	}
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		res.Code = "rate_limited"
+	}
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		l.logger.Log("Error while writing error: " + err.Error())
+	}
+}
+
+// Middleware limits the rate of requests, except of the ones on a session
+func (l *limiter) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if onSession(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get(corsOriginHeader)
+		ok, retryAfter := l.take(origin)
+		if !ok {
+			l.respondLimited(w, r, "too many requests", retryAfter)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// onSession is true for requests on an acquired session;
+// acquire has previous session, but also a path
+func onSession(r *http.Request) bool {
+	vars := mux.Vars(r)
+	_, session := vars["session"]
+	_, path := vars["path"]
+	return session && !path
+}
+
+// Listen limits concurrent long-polls
+func (l *limiter) Listen(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(corsOriginHeader)
+		if !l.startListen(origin) {
+			l.respondLimited(w, r, "too many listen requests", listenRetryAfter)
+			return
+		}
+		defer l.endListen(origin)
+		h(w, r)
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/trezor/trezord-go/memorywriter"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimit(t *testing.T) {
+	l := newLimiter(RateLimits{Rate: 2, Burst: 3}, memorywriter.New(100, 10, false, nil))
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/enumerate", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := request("https://trezor.io"); w.Code != http.StatusOK {
+			t.Fatalf("request %d in burst should pass, got %d", i, w.Code)
+		}
+	}
+	w := request("https://trezor.io")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected too many requests, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+	}
+
+	// other origins have their own bucket
+	if w := request("https://suite.trezor.io"); w.Code != http.StatusOK {
+		t.Errorf("other origin should pass, got %d", w.Code)
+	}
+
+	// 2 requests per second
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if w := request("https://trezor.io"); w.Code != http.StatusOK {
+			t.Fatalf("request %d after refill should pass, got %d", i, w.Code)
+		}
+	}
+	if w := request("https://trezor.io"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected too many requests, got %d", w.Code)
+	}
+
+	// idle origins are forgotten
+	now = now.Add(2 * limiterPruneInterval)
+	request("https://trezor.io")
+	if len(l.origins) != 1 {
+		t.Errorf("expected idle origin to be pruned, got %d origins", len(l.origins))
+	}
+}
+
+func TestRateLimitSession(t *testing.T) {
+	l := newLimiter(RateLimits{Rate: 1, Burst: 1}, memorywriter.New(100, 10, false, nil))
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/acquire/{path}/{session}", ok)
+	r.HandleFunc("/call/{session}", ok)
+	r.Use(l.Middleware)
+	request := func(path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		return w.Code
+	}
+
+	if code := request("/acquire/1/null"); code != http.StatusOK {
+		t.Fatalf("first acquire should pass, got %d", code)
+	}
+	if code := request("/acquire/1/2"); code != http.StatusTooManyRequests {
+		t.Errorf("acquire should be limited, got %d", code)
+	}
+	for i := 0; i < 5; i++ {
+		if code := request("/call/2"); code != http.StatusOK {
+			t.Fatalf("call %d on session should not be limited, got %d", i, code)
+		}
+	}
+}
+
+func TestListenLimit(t *testing.T) {
+	l := newLimiter(RateLimits{MaxListens: 2}, memorywriter.New(100, 10, false, nil))
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := l.Listen(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	request := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/listen", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			request("https://trezor.io")
+			done <- struct{}{}
+		}()
+		<-started
+	}
+
+	w := request("https://trezor.io")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("third listen should be refused, got %d", w.Code)
+	}
+
+	go func() {
+		request("https://suite.trezor.io")
+		done <- struct{}{}
+	}()
+	<-started
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	go func() {
+		request("https://trezor.io")
+		done <- struct{}{}
+	}()
+	<-started
+	<-done
+}
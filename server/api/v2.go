@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/trezor/trezord-go/core"
+)
+
+// The v2 API, under /v2. Calls are the same as in v1, but errors have
+// HTTP status and code (see errors.go), devices have their type,
+// and post returns 204.
+
+type deviceV2 struct {
+	Path    string `json:"path"`
+	ID      string `json:"id"`
+	Vendor  int    `json:"vendor"`
+	Product int    `json:"product"`
+	Type    string `json:"type"`  // model ID, like t2; empty for unknown
+	Model   string `json:"model"` // human readable name
+	Debug   bool   `json:"debug"` // has debug link
+
+	Session      *string `json:"session"`
+	DebugSession *string `json:"debugSession"`
+
+	StolenSession      *string `json:"stolenSession,omitempty"`
+	StolenDebugSession *string `json:"stolenDebugSession,omitempty"`
+}
+
+func makeDeviceV2(dev core.EnumerateEntry) deviceV2 {
+	m, _ := core.ModelByType(dev.Type)
+	return deviceV2{
+		Path:               dev.Path,
+		ID:                 dev.ID,
+		Vendor:             dev.Vendor,
+		Product:            dev.Product,
+		Type:               m.ID,
+		Model:              core.ModelName(dev.Type),
+		Debug:              dev.Debug,
+		Session:            dev.Session,
+		DebugSession:       dev.DebugSession,
+		StolenSession:      dev.StolenSession,
+		StolenDebugSession: dev.StolenDebugSession,
+	}
+}
+
+// entry is for comparing in core.Listen, which ignores the type
+func (d deviceV2) entry() core.EnumerateEntry {
+	return core.EnumerateEntry{
+		Path:               d.Path,
+		ID:                 d.ID,
+		Vendor:             d.Vendor,
+		Product:            d.Product,
+		Debug:              d.Debug,
+		Session:            d.Session,
+		DebugSession:       d.DebugSession,
+		StolenSession:      d.StolenSession,
+		StolenDebugSession: d.StolenDebugSession,
+	}
+}
+
+func makeDevicesV2(e []core.EnumerateEntry) []deviceV2 {
+	res := make([]deviceV2, 0, len(e))
+	for _, dev := range e {
+		res = append(res, makeDeviceV2(dev))
+	}
+	return res
+}
+
+func serveAPIv2(r *mux.Router, a *api, limiter *limiter) {
+	r.HandleFunc("/", a.Info)
+	r.HandleFunc("/listen", limiter.Listen(a.ListenV2))
+	r.HandleFunc("/enumerate", a.EnumerateV2)
+	r.HandleFunc("/acquire/{path}", a.Acquire)
+	r.HandleFunc("/acquire/{path}/{session}", a.Acquire)
+	r.HandleFunc("/release/{session}", a.Release)
+	r.HandleFunc("/cancel/{session}", a.Cancel)
+	r.HandleFunc("/call/{session}", a.Call)
+	r.HandleFunc("/post/{session}", a.Post)
+	r.HandleFunc("/read/{session}", a.Read)
+	r.HandleFunc("/json/call/{session}", a.CallJSON)
+	r.HandleFunc("/debug/acquire/{path}", a.AcquireDebug)
+	r.HandleFunc("/debug/acquire/{path}/{session}", a.AcquireDebug)
+	r.HandleFunc("/debug/release/{session}", a.ReleaseDebug)
+	r.HandleFunc("/debug/call/{session}", a.CallDebug)
+	r.HandleFunc("/debug/post/{session}", a.PostDebug)
+	r.HandleFunc("/debug/read/{session}", a.ReadDebug)
+	r.HandleFunc("/debug/json/call/{session}", a.CallJSONDebug)
+	r.NotFoundHandler = http.HandlerFunc(a.notFoundV2)
+}
+
+func (a *api) EnumerateV2(w http.ResponseWriter, r *http.Request) {
+	a.logger.Log("start")
+	e, err := a.core.Enumerate()
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+	a.logger.Log("encoding and exiting")
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(makeDevicesV2(e))
+	a.checkJSONError(w, err)
+}
+
+func (a *api) ListenV2(w http.ResponseWriter, r *http.Request) {
+	a.logger.Log("starting")
+	var devices []deviceV2
+	err := json.NewDecoder(r.Body).Decode(&devices)
+	if err != nil {
+		a.respondError(w, badRequest(err))
+		return
+	}
+	entries := make([]core.EnumerateEntry, 0, len(devices))
+	for _, d := range devices {
+		entries = append(entries, d.entry())
+	}
+
+	res, err := a.core.Listen(entries, r.Context())
+	if err != nil {
+		a.respondError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(makeDevicesV2(res))
+	a.checkJSONError(w, err)
+}
+
+func (a *api) notFoundV2(w http.ResponseWriter, r *http.Request) {
+	a.logger.Log("unknown call " + r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	err := json.NewEncoder(w).Encode(jsonErrorV2{
+		Error: "unknown call",
+		Code:  "unknown_call",
+	})
+	if err != nil {
+		a.logger.Log("Error while writing error: " + err.Error())
+	}
+}
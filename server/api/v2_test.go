@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/core/coretest"
+	"github.com/trezor/trezord-go/memorywriter"
+
+	"github.com/gorilla/mux"
+)
+
+func TestErrorStatus(t *testing.T) {
+	testcases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{core.ErrSessionNotFound, http.StatusNotFound, "session_not_found"},
+		{core.ErrWrongPrevSession, http.StatusConflict, "wrong_previous_session"},
+		{&core.SessionStolenError{Origin: "https://suite.trezor.io"}, http.StatusGone, "session_stolen"},
+		{fmt.Errorf("read: %w", core.ErrDisconnected), http.StatusGone, "device_disconnected"},
+		{core.ErrClosed, http.StatusServiceUnavailable, "shutting_down"},
+		{core.ErrTimeout, http.StatusGatewayTimeout, "read_timeout"},
+		{badRequest(errors.New("invalid character")), http.StatusBadRequest, "invalid_request"},
+		{fmt.Errorf("open: %w", os.ErrPermission), http.StatusForbidden, "device_access_denied"},
+		{errors.New("something else"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tc := range testcases {
+		status, code := errorStatus(tc.err)
+		if status != tc.status || code != tc.code {
+			t.Errorf("%v: expected %d %s, got %d %s", tc.err, tc.status, tc.code, status, code)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	mw := memorywriter.New(1000, 10, false, nil)
+	// one Model T without debug link
+	bus := &coretest.Bus{Devices: []core.USBInfo{{Path: "dev", Type: core.TypeT2, Serial: "SN1"}}}
+	c := core.New(bus, mw, nil, true, false)
+	defer c.Close()
+	r := mux.NewRouter()
+	ServeAPI(r.Methods("POST").Subrouter(), c, "1.2.3", "abc", mw, RateLimits{})
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Origin", "https://suite.trezor.io")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	expectError := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var res jsonErrorV2
+		err := json.NewDecoder(w.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != status || res.Code != code {
+			t.Errorf("expected %d %s, got %d %+v", status, code, w.Code, res)
+		}
+	}
+
+	w := post("/v2/enumerate", "")
+	var devices []deviceV2
+	err := json.NewDecoder(w.Body).Decode(&devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Type != "t2" || devices[0].Model != "Trezor Model T" {
+		t.Fatalf("unexpected devices %+v", devices)
+	}
+	path := devices[0].Path
+
+	expectError(post("/v2/acquire/"+path+"/42", ""), http.StatusConflict, "wrong_previous_session")
+	expectError(post("/v2/acquire/999", ""), http.StatusNotFound, "device_not_found")
+	expectError(post("/v2/acquire/abc", ""), http.StatusNotFound, "device_not_found")
+	// v1 keeps the error of core
+	if w := post("/acquire/abc", ""); !strings.Contains(w.Body.String(), `parsing \"abc\": invalid syntax`) {
+		t.Errorf("expected parse error on v1, got %d %s", w.Code, w.Body.String())
+	}
+	expectError(post("/v2/debug/acquire/"+path, ""), http.StatusNotFound, "no_debug_link")
+	expectError(post("/v2/release/42", ""), http.StatusNotFound, "session_not_found")
+	expectError(post("/v2/nonsense", ""), http.StatusNotFound, "unknown_call")
+
+	w = post("/v2/acquire/"+path, "")
+	var acquired struct {
+		Session string `json:"session"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&acquired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectError(post("/v2/call/"+acquired.Session, "zz"), http.StatusBadRequest, "invalid_request")
+	expectError(post("/v2/call/"+acquired.Session, "0000"), http.StatusBadRequest, "malformed_data")
+	w = post("/v2/post/"+acquired.Session, "000000000000")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected 204 on post, got %d", w.Code)
+	}
+
+	// v1 stays the same
+	w = post("/release/42", "")
+	if w.Code != http.StatusBadRequest || w.Body.String() != "{\"error\":\"session not found\"}\n" {
+		t.Errorf("unexpected v1 error %d %s", w.Code, w.Body.String())
+	}
+	w = post("/enumerate", "")
+	if strings.Contains(w.Body.String(), "type") {
+		t.Errorf("unexpected type in v1 enumerate %s", w.Body.String())
+	}
+}
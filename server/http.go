@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
@@ -33,6 +35,7 @@ func New(
 	longWriter *memorywriter.MemoryWriter,
 	version string,
 	githash string,
+	limits api.RateLimits,
 ) (*Server, error) {
 	longWriter.Log("starting")
 
@@ -54,9 +57,11 @@ func New(
 	statusRouter := r.PathPrefix("/status").Subrouter()
 	postRouter := r.Methods("POST").Subrouter()
 	redirectRouter := r.Methods("GET").Path("/").Subrouter()
+	healthRouter := r.Methods("GET", "HEAD").Subrouter()
 
 	status.ServeStatus(statusRouter, c, port, version, githash, shortWriter, longWriter)
-	api.ServeAPI(postRouter, c, version, githash, longWriter)
+	api.ServeAPI(postRouter, c, version, githash, longWriter, limits)
+	api.ServeHealth(healthRouter, c, version, githash, longWriter)
 
 	status.ServeStatusRedirect(redirectRouter)
 
@@ -85,6 +90,50 @@ func (s *Server) logRequest(handler http.Handler) http.Handler {
 	})
 }
 
+// Run listens on the configured port and serves until Shutdown;
+// it returns nil after Shutdown
 func (s *Server) Run() error {
-	return s.ListenAndServe()
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve([]net.Listener{l})
+}
+
+// Listen opens the listening socket on the configured port,
+// so that the bridge can announce it is ready before serving
+func (s *Server) Listen() (net.Listener, error) {
+	return net.Listen("tcp", s.Addr)
+}
+
+// Serve serves on all the listeners (for example, the ones
+// inherited from systemd) until Shutdown; it returns nil after Shutdown
+func (s *Server) Serve(listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.Server.Serve(l)
+		}(l)
+	}
+	for range listeners {
+		err := <-errs
+		if err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops accepting new requests and waits for the running
+// ones until ctx is done; then it closes all connections, which
+// cancels contexts of the remaining requests.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if err != nil {
+		errClose := s.Server.Close()
+		if errClose != nil {
+			return errClose
+		}
+	}
+	return err
 }
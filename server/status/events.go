@@ -0,0 +1,202 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Live updates of the status page, as server-sent events.
+//
+// "devices" event has the devices and sessions, as in JSON status,
+// and is sent on connect and on each change.
+// "log" event has the new lines of the short log, oldest first;
+// its id is the count of log lines written, so a reconnecting
+// EventSource continues where it stopped.
+//
+// Devices are enumerated by one watcher, shared by all open pages;
+// it runs only while some page is subscribed.
+
+const eventsDelay = 500 * time.Millisecond
+
+var errNoStreaming = errors.New("streaming not supported")
+
+func (s *status) statusEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, errNoStreaming)
+		return
+	}
+	since, err := s.eventsSince(r)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	s.longMemoryWriter.Log("starting status events")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	devices := s.devices.subscribe()
+	defer s.devices.unsubscribe(devices)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			s.longMemoryWriter.Log("status events closed")
+			return
+		case <-s.core.Stopped():
+			s.longMemoryWriter.Log("stopped, closing status events")
+			return
+		case d := <-devices:
+			err = writeEvent(w, "devices", "", d)
+			if err != nil {
+				s.longMemoryWriter.Log("write err " + err.Error())
+				return
+			}
+		case <-time.After(eventsDelay):
+		}
+
+		lines, n := s.shortMemoryWriter.Since(since)
+		if len(lines) > 0 {
+			log, err := json.Marshal(lines)
+			if err != nil {
+				s.longMemoryWriter.Log("json err " + err.Error())
+				return
+			}
+			err = writeEvent(w, "log", strconv.Itoa(n), log)
+			if err != nil {
+				s.longMemoryWriter.Log("write err " + err.Error())
+				return
+			}
+		}
+		since = n
+		flusher.Flush()
+	}
+}
+
+// devicesWatcher enumerates the devices for all subscribed pages
+// and sends them the devices JSON when it changes
+type devicesWatcher struct {
+	status *status
+
+	mutex       sync.Mutex
+	running     bool
+	subscribers map[chan []byte]struct{}
+	last        []byte // last sent devices JSON, nil when not running
+}
+
+func newDevicesWatcher(s *status) *devicesWatcher {
+	return &devicesWatcher{
+		status:      s,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+// subscribe returns a channel with the current devices JSON and its changes;
+// only the newest value is kept, so a slow page skips the older ones
+func (d *devicesWatcher) subscribe() chan []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ch := make(chan []byte, 1)
+	if d.last != nil {
+		ch <- d.last
+	}
+	d.subscribers[ch] = struct{}{}
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+	return ch
+}
+
+func (d *devicesWatcher) unsubscribe(ch chan []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.subscribers, ch)
+}
+
+func (d *devicesWatcher) run() {
+	d.status.longMemoryWriter.Log("starting devices watcher")
+	for {
+		devices, err := json.Marshal(d.status.enumerateJSON())
+		if err != nil {
+			d.status.longMemoryWriter.Log("json err " + err.Error())
+		}
+
+		d.mutex.Lock()
+		if len(d.subscribers) == 0 {
+			d.stop()
+			d.mutex.Unlock()
+			return
+		}
+		if err == nil && !bytes.Equal(devices, d.last) {
+			d.last = devices
+			for ch := range d.subscribers {
+				// the watcher is the only sender, so after draining
+				// the buffer, the send does not block
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- devices
+			}
+		}
+		d.mutex.Unlock()
+
+		select {
+		case <-d.status.core.Stopped():
+			d.mutex.Lock()
+			d.stop()
+			d.mutex.Unlock()
+			return
+		case <-time.After(eventsDelay):
+		}
+	}
+}
+
+// stop is called with the mutex held
+func (d *devicesWatcher) stop() {
+	d.status.longMemoryWriter.Log("stopping devices watcher")
+	d.running = false
+	d.last = nil
+}
+
+// eventsSince returns the count of log lines the client already has,
+// from Last-Event-ID on reconnect or from ?since= on the first connect;
+// without either, only the new lines are sent
+func (s *status) eventsSince(r *http.Request) (int, error) {
+	str := r.Header.Get("Last-Event-ID")
+	if str == "" {
+		str = r.URL.Query().Get("since")
+	}
+	if str == "" {
+		return s.shortMemoryWriter.Written(), nil
+	}
+	since, err := strconv.Atoi(str)
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("invalid log position %q", str)
+	}
+	return since, nil
+}
+
+// data is JSON, so it has no newlines
+func writeEvent(w http.ResponseWriter, event, id string, data []byte) error {
+	var b bytes.Buffer
+	b.WriteString("event: " + event + "\n")
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
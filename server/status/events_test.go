@@ -0,0 +1,57 @@
+package status
+
+import (
+	"testing"
+	"time"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/core/coretest"
+	"github.com/trezor/trezord-go/memorywriter"
+)
+
+func TestDevicesWatcherShared(t *testing.T) {
+	start := time.Now()
+	// without devices, core does not enumerate in background,
+	// so all the enumerations are of the watcher
+	bus := &coretest.Bus{}
+	mw := memorywriter.New(1000, 10, false, nil)
+	c := core.New(bus, mw, nil, true, false)
+	defer c.Close()
+	s := &status{core: c, shortMemoryWriter: mw, longMemoryWriter: mw}
+	s.devices = newDevicesWatcher(s)
+
+	first := s.devices.subscribe()
+	second := s.devices.subscribe()
+	for _, ch := range []chan []byte{first, second} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("expected devices")
+		}
+	}
+
+	// a late subscriber gets the last devices right away
+	third := s.devices.subscribe()
+	select {
+	case <-third:
+	default:
+		t.Fatal("expected the last devices")
+	}
+
+	time.Sleep(3 * eventsDelay)
+	// one page alone would enumerate as often
+	if n, limit := bus.Enumerates(), int(time.Since(start)/eventsDelay)+2; n > limit {
+		t.Errorf("expected at most %d enumerations for all subscribers, got %d", limit, n)
+	}
+
+	s.devices.unsubscribe(first)
+	s.devices.unsubscribe(second)
+	s.devices.unsubscribe(third)
+	time.Sleep(2 * eventsDelay)
+	s.devices.mutex.Lock()
+	running := s.devices.running
+	s.devices.mutex.Unlock()
+	if running {
+		t.Error("expected the watcher to stop without subscribers")
+	}
+}
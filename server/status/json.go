@@ -0,0 +1,89 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// JSON variant of the status page, for monitoring and support tools
+
+// lines of the short log in JSON status
+const statusLogLines = 100
+
+type statusJSONDevice struct {
+	Path         string  `json:"path"`
+	ID           string  `json:"id"`
+	Type         string  `json:"type"`  // model ID, like t2; empty for unknown
+	Model        string  `json:"model"` // human readable name
+	Debug        bool    `json:"debug"` // has debug link
+	Session      *string `json:"session"`
+	DebugSession *string `json:"debugSession"`
+}
+
+// devices and sessions, also sent as live updates of the status page
+type statusJSONDevices struct {
+	Devices  []statusJSONDevice `json:"devices"`
+	Sessions []core.SessionInfo `json:"sessions"`        // both normal and debug
+	Error    string             `json:"error,omitempty"` // of enumeration
+}
+
+type statusJSON struct {
+	Version string `json:"version"`
+	Githash string `json:"githash"`
+	statusJSONDevices
+	Buses []core.BusStatus `json:"buses"`
+	Log   []string         `json:"log"` // short log, oldest first
+}
+
+func (s *status) statusJSON(w http.ResponseWriter, r *http.Request) {
+	s.longMemoryWriter.Log("building status json")
+
+	res := statusJSON{
+		Version:           s.version,
+		Githash:           s.githash,
+		statusJSONDevices: s.enumerateJSON(),
+	}
+	res.Buses = s.core.BusStatus()
+	if res.Buses == nil {
+		res.Buses = make([]core.BusStatus, 0)
+	}
+	res.Log = s.shortMemoryWriter.Tail(statusLogLines)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(res)
+	if err != nil {
+		s.longMemoryWriter.Log("json err " + err.Error())
+	}
+}
+
+func (s *status) enumerateJSON() statusJSONDevices {
+	res := statusJSONDevices{
+		Devices: make([]statusJSONDevice, 0),
+	}
+	e, err := s.core.Enumerate()
+	if err != nil {
+		s.longMemoryWriter.Log("enumerate err" + err.Error())
+		res.Error = err.Error()
+	}
+	for _, dev := range e {
+		res.Devices = append(res.Devices, makeStatusJSONDevice(dev))
+	}
+	res.Sessions = s.core.Sessions()
+	return res
+}
+
+func makeStatusJSONDevice(dev core.EnumerateEntry) statusJSONDevice {
+	m, _ := core.ModelByType(dev.Type)
+	return statusJSONDevice{
+		Path:         dev.Path,
+		ID:           dev.ID,
+		Type:         m.ID,
+		Model:        core.ModelName(dev.Type),
+		Debug:        dev.Debug,
+		Session:      dev.Session,
+		DebugSession: dev.DebugSession,
+	}
+}
@@ -0,0 +1,312 @@
+//go:build linux
+// +build linux
+
+package status
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/udev"
+)
+
+// Linux diagnostics for the detailed log; most of the issues on linux
+// are missing udev rules or permissions of the device nodes.
+// All the files are read relative to root, so it can be tested
+// against a fake root directory.
+
+const (
+	// longer files with matching lines are shortened
+	maxRulesLines = 50
+
+	// access(2) modes, not in syscall package
+	accessRead  = 4
+	accessWrite = 2
+)
+
+type linuxDiag struct {
+	root string // "/", different only in tests
+	uid  int
+	gids []int // of this process, including the primary one
+	mw   *memorywriter.MemoryWriter
+}
+
+func linuxInfo(mw *memorywriter.MemoryWriter) (string, error) {
+	gids, err := syscall.Getgroups()
+	if err != nil {
+		return "", err
+	}
+	d := &linuxDiag{
+		root: "/",
+		uid:  os.Getuid(),
+		gids: append([]int{os.Getgid()}, gids...),
+		mw:   mw,
+	}
+	return d.collect(), nil
+}
+
+// collect never fails, errors are just a part of the output
+func (d *linuxDiag) collect() string {
+	res := "Linux diagnostics\n"
+	d.mw.Log("getting kernel")
+	res += d.kernel() + "\n"
+	d.mw.Log("getting user")
+	res += d.user() + "\n"
+	d.mw.Log("getting udev rules")
+	res += d.udevRules() + "\n"
+	d.mw.Log("getting usb devices")
+	res += d.usbDevices() + "\n"
+	d.mw.Log("getting hidraw devices")
+	res += d.hidrawDevices() + "\n"
+	return res
+}
+
+func (d *linuxDiag) path(elem ...string) string {
+	return filepath.Join(append([]string{d.root}, elem...)...)
+}
+
+func (d *linuxDiag) readTrimmed(elem ...string) string {
+	content, err := os.ReadFile(d.path(elem...))
+	if err != nil {
+		return "unknown (" + err.Error() + ")"
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func (d *linuxDiag) kernel() string {
+	return "Kernel: " + d.readTrimmed("proc", "sys", "kernel", "osrelease") + "\n" +
+		d.readTrimmed("proc", "version") + "\n"
+}
+
+// user prints the groups of the process and the groups from /etc/group;
+// if they differ, the user was added to a group without logging in again
+func (d *linuxDiag) user() string {
+	users := d.readIDNames("passwd")
+	groups := d.readIDNames("group")
+	name := users[d.uid]
+
+	res := fmt.Sprintf("User: %s (%d)\n", name, d.uid)
+
+	active := make(map[int]bool)
+	var activeNames []string
+	for _, gid := range d.gids {
+		if active[gid] {
+			continue
+		}
+		active[gid] = true
+		activeNames = append(activeNames, fmt.Sprintf("%s(%d)", groups[gid], gid))
+	}
+	res += "Process groups: " + strings.Join(activeNames, " ") + "\n"
+
+	var inactive []string
+	for _, g := range d.memberOf(name) {
+		if !active[g.id] {
+			inactive = append(inactive, fmt.Sprintf("%s(%d)", g.name, g.id))
+		}
+	}
+	if len(inactive) != 0 {
+		res += "Groups not active until next login: " + strings.Join(inactive, " ") + "\n"
+	}
+	return res
+}
+
+// readIDNames reads id => name from /etc/passwd or /etc/group
+func (d *linuxDiag) readIDNames(file string) map[int]string {
+	res := make(map[int]string)
+	for _, fields := range d.readColonFile(file) {
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err == nil {
+			res[id] = fields[0]
+		}
+	}
+	return res
+}
+
+type group struct {
+	id   int
+	name string
+}
+
+func (d *linuxDiag) memberOf(user string) []group {
+	var res []group
+	for _, fields := range d.readColonFile("group") {
+		if len(fields) < 4 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member == user {
+				res = append(res, group{id: id, name: fields[0]})
+			}
+		}
+	}
+	return res
+}
+
+func (d *linuxDiag) readColonFile(file string) [][]string {
+	f, err := os.Open(d.path("etc", file))
+	if err != nil {
+		d.mw.Log("cannot read " + file + " " + err.Error())
+		return nil
+	}
+	defer f.Close()
+
+	var res [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		res = append(res, strings.Split(line, ":"))
+	}
+	return res
+}
+
+// udevRules prints the rules that give access to Trezor devices,
+// as udev reads them, by file
+func (d *linuxDiag) udevRules() string {
+	res := "Udev rules:\n"
+	rules, err := udev.ScanRules(d.root)
+	if err != nil {
+		return res + "error: " + err.Error() + "\n"
+	}
+	if len(rules) == 0 {
+		return res + "no udev rules for Trezor found\n"
+	}
+	lines := 0
+	for i, rule := range rules {
+		if i == 0 || rules[i-1].File != rule.File {
+			res += rule.File + ":\n"
+			lines = 0
+		}
+		lines++
+		if lines > maxRulesLines {
+			continue
+		}
+		res += "  " + rule.Text + "\n"
+		if lines == maxRulesLines {
+			if more := countRules(rules[i+1:], rule.File); more > 0 {
+				res += fmt.Sprintf("  ... %d more\n", more)
+			}
+		}
+	}
+	return res
+}
+
+func countRules(rules []udev.Rule, file string) int {
+	n := 0
+	for _, rule := range rules {
+		if rule.File == file {
+			n++
+		}
+	}
+	return n
+}
+
+// usbDevices prints Trezor devices from sysfs, with their
+// descriptors, interface drivers and permissions of the device nodes
+func (d *linuxDiag) usbDevices() string {
+	res := "USB devices:\n"
+	devices, err := udev.USBDevices(d.root)
+	if err != nil {
+		return res + "error: " + err.Error() + "\n"
+	}
+	if len(devices) == 0 {
+		return res + "no Trezor found in sysfs\n"
+	}
+	for _, dev := range devices {
+		res += fmt.Sprintf("%s: %s bcd %04x (%s)\n", dev.Name, dev.ID, dev.BCD, dev.Model)
+		// not the serial, it is potentially sensitive and the log is shared
+		for _, attr := range []string{"manufacturer", "product", "speed"} {
+			content, err := os.ReadFile(filepath.Join(dev.Dir, attr))
+			if err == nil {
+				res += fmt.Sprintf("  %s: %s\n", attr, strings.TrimSpace(string(content)))
+			}
+		}
+		res += d.interfaces(dev.Dir)
+		descriptors, err := os.ReadFile(filepath.Join(dev.Dir, "descriptors"))
+		if err == nil {
+			res += "  descriptors: " + hex.EncodeToString(descriptors) + "\n"
+		}
+		res += "  " + d.node(dev.Node) + "\n"
+	}
+	return res
+}
+
+// interfaces prints class and driver of each interface;
+// usbhid on T1 is normal, other drivers on WebUSB interfaces are not
+func (d *linuxDiag) interfaces(dir string) string {
+	ifaces, err := filepath.Glob(filepath.Join(dir, filepath.Base(dir)+":*"))
+	if err != nil {
+		return ""
+	}
+	sort.Strings(ifaces)
+	res := ""
+	for _, iface := range ifaces {
+		class, err := udev.ReadSysfs(filepath.Join(iface, "bInterfaceClass"), 16)
+		if err != nil {
+			continue
+		}
+		driver := "none"
+		link, err := os.Readlink(filepath.Join(iface, "driver"))
+		if err == nil {
+			driver = filepath.Base(link)
+		}
+		res += fmt.Sprintf("  interface %s: class %02x, driver %s\n", filepath.Base(iface), class, driver)
+	}
+	return res
+}
+
+// hidrawDevices prints hidraw nodes of Trezor devices
+func (d *linuxDiag) hidrawDevices() string {
+	res := "Hidraw devices:\n"
+	devices, err := udev.HidrawDevices(d.root)
+	if err != nil {
+		return res + "error: " + err.Error() + "\n"
+	}
+	if len(devices) == 0 {
+		return res + "no Trezor hidraw nodes found\n"
+	}
+	for _, dev := range devices {
+		res += fmt.Sprintf("%s: %s\n", dev.Name, dev.ID)
+		res += "  " + d.node(dev.Node) + "\n"
+	}
+	return res
+}
+
+// node prints permissions of the device node, like /dev/hidraw0,
+// and if we can open it
+func (d *linuxDiag) node(node string) string {
+	path := d.path(node)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return node + ": " + err.Error()
+	}
+	owner := "?"
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		users := d.readIDNames("passwd")
+		groups := d.readIDNames("group")
+		owner = fmt.Sprintf("%s(%d):%s(%d)", users[int(st.Uid)], st.Uid, groups[int(st.Gid)], st.Gid)
+	}
+	access := "yes"
+	err = syscall.Access(path, accessRead|accessWrite)
+	if err != nil {
+		access = "no (" + err.Error() + ")"
+	}
+	return fmt.Sprintf("%s: %s %s, read/write: %s", node, fi.Mode().String(), owner, access)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package status
+
+import (
+	"github.com/trezor/trezord-go/memorywriter"
+)
+
+// Linux diagnostics; empty on other systems
+
+func linuxInfo(mw *memorywriter.MemoryWriter) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package status
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/udev/udevtest"
+)
+
+// fakeLinuxRoot is the fake root of udev tests, with the files
+// read only by the diagnostics
+func fakeLinuxRoot(t *testing.T) string {
+	t.Helper()
+	root := udevtest.FakeRoot(t)
+
+	udevtest.WriteFile(t, root, "proc/sys/kernel/osrelease", "6.1.0-test\n")
+	udevtest.WriteFile(t, root, "proc/version", "Linux version 6.1.0-test\n")
+	udevtest.WriteFile(t, root, "etc/passwd", "root:x:0:0::/root:/bin/sh\nalice:x:1000:1000::/home/alice:/bin/sh\n")
+	udevtest.WriteFile(t, root, "etc/group", "root:x:0:\nplugdev:x:46:alice\nalice:x:1000:\n")
+
+	udevtest.WriteFile(t, root, "etc/udev/rules.d/51-trezor.rules",
+		"# Trezor\n"+
+			`SUBSYSTEM=="usb", ATTR{idVendor}=="1209", ATTR{idProduct}=="53c1", MODE="0660", GROUP="plugdev"`+"\n")
+	return root
+}
+
+func TestLinuxDiag(t *testing.T) {
+	root := fakeLinuxRoot(t)
+	d := &linuxDiag{
+		root: root,
+		uid:  1000,
+		gids: []int{1000},
+		mw:   memorywriter.New(100, 100, false, nil),
+	}
+	res := d.collect()
+
+	expected := []string{
+		"Kernel: 6.1.0-test",
+		"User: alice (1000)",
+		"Process groups: alice(1000)",
+		"Groups not active until next login: plugdev(46)",
+		"/etc/udev/rules.d/51-trezor.rules:\n  SUBSYSTEM",
+		"1-2: 1209:53c1 bcd 0200 (Trezor Model T)",
+		"interface 1-2:1.0: class ff, driver none",
+		"descriptors: 1201",
+		"/dev/bus/usb/001/005: -rw-",
+		"hidraw0: 534c:0001",
+		"/dev/hidraw0: -rw-",
+	}
+	for _, e := range expected {
+		if !strings.Contains(res, e) {
+			t.Errorf("expected %q in diagnostics:\n%s", e, res)
+		}
+	}
+	if strings.Contains(res, "ABCDEF") {
+		t.Errorf("unexpected serial in diagnostics:\n%s", res)
+	}
+	// other device with the shared vendor ID
+	if strings.Contains(res, "60-other") {
+		t.Errorf("unexpected unrelated rules in diagnostics:\n%s", res)
+	}
+}
+
+func TestLinuxDiagEmpty(t *testing.T) {
+	d := &linuxDiag{
+		root: t.TempDir(),
+		mw:   memorywriter.New(100, 100, false, nil),
+	}
+	res := d.collect()
+	for _, e := range []string{"no udev rules for Trezor found", "no Trezor found in sysfs", "no Trezor hidraw nodes found"} {
+		if !strings.Contains(res, e) {
+			t.Errorf("expected %q in diagnostics:\n%s", e, res)
+		}
+	}
+}
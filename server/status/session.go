@@ -0,0 +1,215 @@
+package status
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/protob"
+)
+
+// Detail page of one session, with its call history,
+// on /status/session?id=SESSION (and &debug=1 for debug link)
+
+type sessionTemplateCall struct {
+	Start    string
+	Mode     string
+	Origin   string
+	Request  string
+	Response string
+	Duration string
+	Error    string
+}
+
+type sessionTemplateData struct {
+	Version string
+	Githash string
+
+	ID        string
+	Debug     bool
+	Path      string
+	Serial    string
+	Origin    string
+	UserAgent string
+	Acquired  string
+
+	Running   []sessionTemplateCall
+	Calls     []sessionTemplateCall // newest first
+	LastError *sessionTemplateCall
+}
+
+func (s *status) sessionPage(w http.ResponseWriter, r *http.Request) {
+	s.longMemoryWriter.Log("building session page")
+
+	ssid := r.URL.Query().Get("id")
+	debug := false
+	if str := r.URL.Query().Get("debug"); str != "" {
+		var err error
+		debug, err = strconv.ParseBool(str)
+		if err != nil {
+			respondError(w, errors.New("invalid debug flag"))
+			return
+		}
+	}
+
+	detail, err := s.core.SessionDetail(ssid, debug)
+	if err != nil {
+		s.longMemoryWriter.Log("session err " + err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data := &sessionTemplateData{
+		Version:   s.version,
+		Githash:   s.githash,
+		ID:        detail.ID,
+		Debug:     detail.Debug,
+		Path:      detail.Path,
+		Serial:    detail.Serial,
+		Origin:    detail.Origin,
+		UserAgent: detail.UserAgent,
+		Acquired: fmt.Sprintf("%s (%s ago)",
+			detail.Acquired.Format("2006-01-02 15:04:05"),
+			time.Since(detail.Acquired).Round(time.Second)),
+		Running: make([]sessionTemplateCall, 0, len(detail.Running)),
+		Calls:   make([]sessionTemplateCall, 0, len(detail.Calls)),
+	}
+	for _, c := range detail.Running {
+		data.Running = append(data.Running, makeSessionTemplateCall(c, true))
+	}
+	for i := len(detail.Calls) - 1; i >= 0; i-- {
+		data.Calls = append(data.Calls, makeSessionTemplateCall(detail.Calls[i], false))
+	}
+	if detail.LastError != nil {
+		lastError := makeSessionTemplateCall(*detail.LastError, false)
+		data.LastError = &lastError
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	err = sessionTemplate.Execute(w, data)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+}
+
+func makeSessionTemplateCall(c core.CallRecord, running bool) sessionTemplateCall {
+	res := sessionTemplateCall{
+		Start:    c.Start.Format("15:04:05.000"),
+		Mode:     c.Mode.String(),
+		Origin:   c.Client.Origin,
+		Request:  "-",
+		Response: "-",
+		Duration: c.Duration.Round(time.Millisecond).String(),
+		Error:    c.Err,
+	}
+	if c.Mode != core.CallModeRead {
+		res.Request = messageName(c.Request)
+	}
+	// response kind is known only after it is read
+	if c.Mode != core.CallModeWrite && !running && c.Err == "" {
+		res.Response = messageName(c.Response)
+	}
+	return res
+}
+
+func messageName(kind uint16) string {
+	name, ok := protob.TypeName(kind)
+	if !ok {
+		return strconv.Itoa(int(kind))
+	}
+	return fmt.Sprintf("%s (%d)", name, kind)
+}
+
+const sessionTemplateString = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
+  <title>Trezor Bridge session {{.ID}}</title>
+  {{template "style"}}
+  <style>
+    table {
+      margin: 20px auto;
+      border-collapse: collapse;
+      font-size: 13px;
+    }
+
+    td, th {
+      border: 1px solid lightgray;
+      padding: 4px 10px;
+      text-align: left;
+    }
+
+    .details {
+      margin: 20px auto;
+      max-width: 700px;
+      text-align: left;
+    }
+  </style>
+</head>
+
+<body>
+  <div id="container">
+    <div class="inner-container">
+      <div class="heading">
+        <h1>{{if .Debug}}Debug session{{else}}Session{{end}} {{.ID}}</h1>
+        <span class="badge">Version: {{.Version}} (rev {{.Githash}})</span>
+      </div>
+
+      <div class="details">
+        <div>Path: {{.Path}}</div>
+        {{if .Serial}}<div>Serial number: {{.Serial}}</div>{{end}}
+        <div>Acquired by: {{if .Origin}}{{.Origin}}{{else}}unknown origin{{end}}</div>
+        <div>User agent: {{.UserAgent}}</div>
+        <div>Acquired at: {{.Acquired}}</div>
+        <div>Call in progress: {{if .Running}}yes{{else}}no{{end}}</div>
+      </div>
+
+      {{with .LastError}}
+        <div class="error">
+          <b>Last error:</b> {{.Error}}<br>
+          {{.Mode}} of {{.Request}} at {{.Start}}
+        </div>
+      {{end}}
+
+      {{if .Running}}
+      <p>In progress</p>
+      <table>
+        <tr><th>Start</th><th>Mode</th><th>Origin</th><th>Request</th><th>Running for</th></tr>
+        {{range .Running}}
+        <tr><td>{{.Start}}</td><td>{{.Mode}}</td><td>{{.Origin}}</td><td>{{.Request}}</td><td>{{.Duration}}</td></tr>
+        {{end}}
+      </table>
+      {{end}}
+
+      <p>Last calls</p>
+      <table>
+        <tr><th>Start</th><th>Mode</th><th>Origin</th><th>Request</th><th>Response</th><th>Duration</th><th>Error</th></tr>
+        {{range .Calls}}
+        <tr><td>{{.Start}}</td><td>{{.Mode}}</td><td>{{.Origin}}</td><td>{{.Request}}</td><td>{{.Response}}</td><td>{{.Duration}}</td><td>{{.Error}}</td></tr>
+        {{else}}
+        <tr><td colspan="7">no calls yet</td></tr>
+        {{end}}
+      </table>
+
+      <div class="space-top">
+        <a href="/status/">
+          <div class="btn-primary">Back to status</div>
+        </a>
+        <a href="#" onClick="location.href=location.href">
+          <div class="btn-primary">Refresh page</div>
+        </a>
+      </div>
+    </div>
+  </div>
+</body>
+</html>
+`
+
+var sessionTemplate = template.Must(template.Must(statusTemplate.Clone()).New("session").Parse(sessionTemplateString))
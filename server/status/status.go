@@ -11,8 +11,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// This package serves the status page on /status/ and the
-// log file at /status/log.gz with the detailed log
+// This package serves the status page on /status/, its JSON
+// variant on /status/status.json, its live updates on /status/events,
+// session details on /status/session and the log file at /status/log.gz
+// with the detailed log
 
 type status struct {
 	core                                *core.Core
@@ -20,6 +22,7 @@ type status struct {
 	version                             string
 	githash                             string
 	shortMemoryWriter, longMemoryWriter *memorywriter.MemoryWriter
+	devices                             *devicesWatcher
 }
 
 const csrfkey = "slk0118h51w2qiw4fhrfyd84f59j81ln"
@@ -44,13 +47,20 @@ func ServeStatus(r *mux.Router, c *core.Core, p int, v, h string, mw, dmw *memor
 		shortMemoryWriter: mw,
 		longMemoryWriter:  dmw,
 	}
+	status.devices = newDevicesWatcher(status)
 	r.Methods("GET").Path("/").HandlerFunc(status.statusPage)
+	r.Methods("GET").Path("/status.json").HandlerFunc(status.statusJSON)
+	r.Methods("GET").Path("/events").HandlerFunc(status.statusEvents)
+	r.Methods("GET").Path("/session").HandlerFunc(status.sessionPage)
 	r.Methods("POST").Path("/log.gz").HandlerFunc(status.statusGzip)
 
 	r.Use(csrf.Protect([]byte(csrfkey), csrf.Secure(false)))
 	r.Use(OriginCheck(map[string]string{
-		"/status/":       "",
-		"/status/log.gz": fmt.Sprintf("http://127.0.0.1:%d", status.port),
+		"/status/":            "",
+		"/status/status.json": "",
+		"/status/events":      "",
+		"/status/session":     "",
+		"/status/log.gz":      fmt.Sprintf("http://127.0.0.1:%d", status.port),
 	}))
 }
 
@@ -102,7 +112,15 @@ func (s *status) statusGzip(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	start := s.version + " (rev " + s.githash + ")\n" + msinfo + "\n" + devconLog + devconLogD + "\n" + old + libwdi + setupapi + "\nCurrent log:\n"
+	s.longMemoryWriter.Log("getting linux info")
+	linux, err := linuxInfo(s.longMemoryWriter)
+	if err != nil {
+		s.longMemoryWriter.Log("linux info err " + err.Error())
+		respondError(w, err)
+		return
+	}
+
+	start := s.version + " (rev " + s.githash + ")\n" + msinfo + "\n" + devconLog + devconLogD + "\n" + old + libwdi + setupapi + linux + "\nCurrent log:\n"
 
 	gzip, err := s.longMemoryWriter.Gzip(start)
 	if err != nil {
@@ -138,6 +156,8 @@ func (s *status) statusPage(w http.ResponseWriter, r *http.Request) {
 
 	start := s.version + " (rev " + s.githash + ")\n" + devconLog
 
+	// lines written in between are sent twice rather than lost
+	logWritten := s.shortMemoryWriter.Written()
 	log, err := s.shortMemoryWriter.String(start)
 	if err != nil {
 		respondError(w, err)
@@ -158,6 +178,8 @@ func (s *status) statusPage(w http.ResponseWriter, r *http.Request) {
 		Devices:     tdevs,
 		DeviceCount: len(tdevs),
 		Log:         log,
+		LogStart:    start,
+		LogWritten:  logWritten,
 		IsError:     isErr,
 		Error:       strErr,
 		CSRFField:   csrf.TemplateField(r),
@@ -191,15 +213,20 @@ func (s *status) statusEnumerate() ([]statusTemplateDevice, error) {
 }
 
 func makeStatusTemplateDevice(dev core.EnumerateEntry) statusTemplateDevice {
-	var session string
+	var session, debugSession string
 	if dev.Session != nil {
 		session = *dev.Session
 	}
+	if dev.DebugSession != nil {
+		debugSession = *dev.DebugSession
+	}
 	tdev := statusTemplateDevice{
-		Path:    dev.Path,
-		Type:    dev.Type,
-		Used:    dev.Session != nil,
-		Session: session,
+		Path:         dev.Path,
+		Type:         dev.Type,
+		Model:        core.ModelName(dev.Type),
+		Used:         dev.Session != nil,
+		Session:      session,
+		DebugSession: debugSession,
 	}
 	return tdev
 }
@@ -8,9 +8,12 @@ import (
 
 type statusTemplateDevice struct {
 	Type    core.DeviceType
+	Model   string
 	Path    string
 	Used    bool
 	Session string
+
+	DebugSession string
 }
 
 type statusTemplateData struct {
@@ -19,6 +22,8 @@ type statusTemplateData struct {
 	Devices     []statusTemplateDevice
 	DeviceCount int
 	Log         string
+	LogStart    string // header of Log, before the lines
+	LogWritten  int    // count of lines in Log, for live updates
 
 	IsError   bool
 	IsWindows bool
@@ -34,6 +39,9 @@ const templateString = `
   <meta charset="utf-8">
   <meta name="viewport" content="width=device-width, initial-scale=1, shrink-to-fit=no">
   <title>Trezor Bridge status</title>
+  {{template "style"}}
+</head>
+{{define "style"}}
   <style>
     body {
       font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", "Roboto", "Helvetica Neue", Arial, sans-serif;
@@ -149,7 +157,7 @@ const templateString = `
       cursor: pointer;
     }
   </style>
-</head>
+{{end}}
 
 <body>
   <div id="container">
@@ -159,47 +167,24 @@ const templateString = `
         <span class="badge">Version: {{.Version}} (rev {{.Githash}})</span>
       </div>
 
-      <p>Connected devices: {{.DeviceCount}}</p>
+      <p>Connected devices: <span id="devicecount">{{.DeviceCount}}</span></p>
 
-      {{if .IsError}}
-        <div class="error">
-          <b>Error:</b> {{.Error}}
-        </div>
-      {{end}}
+      <div class="error" id="error" {{if not .IsError}}style="display: none"{{end}}>
+        <b>Error:</b> <span id="errortext">{{.Error}}</span>
+      </div>
 
+      <div id="devices">
       {{range .Devices}}
       <div class="item">
-        <h3>{{if eq .Type 0}}
-          Trezor One (HID)
-        {{end}}
-
-        {{if eq .Type 1}}
-          Trezor One (WebUSB)
-        {{end}}
-
-        {{if eq .Type 2}}
-          Trezor One (WebUSB, bootloader)
-        {{end}}
-
-        {{if eq .Type 3}}
-          Trezor Model T
-        {{end}}
-
-        {{if eq .Type 4}}
-          Trezor Model T (bootloader)
-        {{end}}
-
-        {{if eq .Type 5}}
-          Trezor Emulator
-        {{end}}
-
-      </h3>
+        <h3>{{.Model}}</h3>
         <span class="session">
-        {{if .Used}} Session: {{.Session}} {{end}} {{if not .Used}} Session: no session {{end}}
+        {{if .Used}} Session: <a href="/status/session?id={{.Session}}">{{.Session}}</a> {{end}} {{if not .Used}} Session: no session {{end}}
+        {{if .DebugSession}} <br>Debug session: <a href="/status/session?debug=1&id={{.DebugSession}}">{{.DebugSession}}</a> {{end}}
         </span>
         <p>Path: {{.Path}}</p>
        </div>
       {{end}}
+      </div>
 
        <div class="space-top">
        <p>Console Log
@@ -222,7 +207,7 @@ const templateString = `
      </div>
 
       <div class="space-top">
-        <p>You may need to reload the page after connecting / disconnecting device</p>
+        <p id="live">You may need to reload the page after connecting / disconnecting device</p>
         <a href="#" onClick="location.href=location.href">
           <div class="btn-primary">Refresh page</div>
         </a>
@@ -230,6 +215,68 @@ const templateString = `
     </div>
   </div>
   <script>
+  function showDevices(data) {
+    document.getElementById("devicecount").innerText = data.devices.length;
+    document.getElementById("errortext").innerText = data.error || "";
+    document.getElementById("error").style.display = data.error ? "block" : "none";
+
+    const devices = document.getElementById("devices");
+    devices.innerHTML = "";
+    for (const dev of data.devices) {
+      const item = document.createElement("div");
+      item.className = "item";
+      const model = document.createElement("h3");
+      model.innerText = dev.model;
+      const session = document.createElement("span");
+      session.className = "session";
+      session.append(sessionLink("Session: ", dev.session, ""));
+      if (dev.debugSession !== null) {
+        session.append(document.createElement("br"), sessionLink("Debug session: ", dev.debugSession, "debug=1&"));
+      }
+      const path = document.createElement("p");
+      path.innerText = "Path: " + dev.path;
+      item.append(model, session, path);
+      devices.appendChild(item);
+    }
+  }
+
+  function sessionLink(label, id, query) {
+    const span = document.createElement("span");
+    span.innerText = label;
+    if (id === null) {
+      span.append("no session");
+      return span;
+    }
+    const a = document.createElement("a");
+    a.href = "/status/session?" + query + "id=" + encodeURIComponent(id);
+    a.innerText = id;
+    span.append(a);
+    return span;
+  }
+
+  // log has the newest lines on top, under the start
+  function showLog(lines) {
+    const start = {{.LogStart}};
+    const log = document.getElementById("log");
+    log.value = start + lines.reverse().join("\n") + "\n" + log.value.slice(start.length);
+  }
+
+  if (window.EventSource) {
+    const events = new EventSource("/status/events?since={{.LogWritten}}");
+    events.addEventListener("open", function() {
+      document.getElementById("live").innerText = "The page updates live";
+    });
+    events.addEventListener("error", function() {
+      document.getElementById("live").innerText = "Live updates disconnected, reconnecting";
+    });
+    events.addEventListener("devices", function(e) {
+      showDevices(JSON.parse(e.data));
+    });
+    events.addEventListener("log", function(e) {
+      showLog(JSON.parse(e.data));
+    });
+  }
+
   function doSubmit() {
     document.getElementById("submitlog").style.display = "none";
     document.getElementById("wait").style.display = "inline";
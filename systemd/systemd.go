@@ -0,0 +1,147 @@
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Minimal implementation of systemd socket activation and of
+// the sd_notify protocol, so we don't need libsystemd nor cgo.
+//
+// See sd_listen_fds(3) and sd_notify(3).
+
+const (
+	// first inherited file descriptor; 0, 1, 2 are stdin/stdout/stderr
+	listenFdsStart = 3
+
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+)
+
+// Listeners returns the listening sockets passed by systemd,
+// or nil if the process was not socket-activated.
+// The environment variables are unset, so they are not inherited further.
+func Listeners() ([]net.Listener, error) {
+	return listeners(listenFdsStart)
+}
+
+func listeners(start int) ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		// not for us
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	res := make([]net.Listener, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			for _, l := range res {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd: fd %d is not a listening socket: %w", fd, err)
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
+
+// Notify sends the state to the service manager.
+// It returns false without error if trezord is not run by systemd
+// with a notify socket.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{
+		Name: socket,
+		Net:  "unixgram",
+	})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout set by systemd
+// (WatchdogSec= in the unit), or 0 if the watchdog is not enabled.
+// Pings should be sent more often, usually at half of the interval.
+func WatchdogInterval() (time.Duration, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("systemd: malformed WATCHDOG_USEC: %w", err)
+	}
+	if usec <= 0 {
+		return 0, errors.New("systemd: WATCHDOG_USEC must be positive")
+	}
+
+	pidStr := os.Getenv("WATCHDOG_PID")
+	if pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, fmt.Errorf("systemd: malformed WATCHDOG_PID: %w", err)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// Watchdog pings the service manager every half of the interval,
+// but only when check succeeds; so when check hangs or keeps failing,
+// systemd restarts the service.
+// It returns when stop is closed.
+func Watchdog(interval time.Duration, check func() error, onError func(error), stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := check()
+		if err == nil {
+			_, err = Notify(StateWatchdog)
+		}
+		if err != nil {
+			onError(err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+func readState(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	err := conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify(StateReady)
+	if sent || err != nil {
+		t.Fatalf("expected nothing sent without socket, got %t %v", sent, err)
+	}
+
+	conn := fakeNotifySocket(t)
+	sent, err = Notify(StateReady)
+	if !sent || err != nil {
+		t.Fatalf("expected state sent, got %t %v", sent, err)
+	}
+	if state := readState(t, conn); state != StateReady {
+		t.Errorf("expected %q, got %q", StateReady, state)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	if i, err := WatchdogInterval(); i != 0 || err != nil {
+		t.Errorf("expected disabled watchdog, got %s %v", i, err)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	if i, err := WatchdogInterval(); i != 3*time.Second || err != nil {
+		t.Errorf("expected 3s, got %s %v", i, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if i, err := WatchdogInterval(); i != 0 || err != nil {
+		t.Errorf("expected watchdog for other process to be ignored, got %s %v", i, err)
+	}
+
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "x")
+	if _, err := WatchdogInterval(); err == nil {
+		t.Errorf("expected error on malformed WATCHDOG_USEC")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := fakeNotifySocket(t)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	checks := make(chan struct{}, 10)
+	failing := errors.New("enumeration failed")
+	var failed []error
+	go func() {
+		fail := true
+		Watchdog(20*time.Millisecond, func() error {
+			checks <- struct{}{}
+			// first check fails, so no ping is sent for it
+			if fail {
+				fail = false
+				return failing
+			}
+			return nil
+		}, func(err error) {
+			failed = append(failed, err)
+		}, stop)
+		close(done)
+	}()
+
+	if state := readState(t, conn); state != StateWatchdog {
+		t.Errorf("expected %q, got %q", StateWatchdog, state)
+	}
+	close(stop)
+	<-done
+
+	if len(checks) < 2 {
+		t.Errorf("expected ping only after the second check, got %d checks", len(checks))
+	}
+	if len(failed) != 1 || failed[0] != failing {
+		t.Errorf("expected one failed check, got %v", failed)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	ls, err := Listeners()
+	if ls != nil || err != nil {
+		t.Fatalf("expected no listeners when not activated, got %v %v", ls, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the raw descriptor is closed by Listeners, as it takes
+	// ownership of the inherited ones
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	ls, err = listeners(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("expected one listener, got %v", ls)
+	}
+	defer ls[0].Close()
+	if ls[0].Addr().String() != l.Addr().String() {
+		t.Errorf("expected listener on %s, got %s", l.Addr(), ls[0].Addr())
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("expected LISTEN_FDS to be unset")
+	}
+}
@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
-	"runtime"
+	"os/signal"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/trezor/trezord-go/bridge"
 	"github.com/trezor/trezord-go/core"
 	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/protob"
 	"github.com/trezor/trezord-go/server"
+	"github.com/trezor/trezord-go/server/api"
+	"github.com/trezor/trezord-go/systemd"
 	"github.com/trezor/trezord-go/usb"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -35,19 +45,14 @@ func (i *udpTouples) String() string {
 }
 
 func (i *udpTouples) Set(value string) error {
-	split := strings.Split(value, ":")
-	n, err := strconv.Atoi(split[0])
+	p, err := bridge.ParseEmulator(value)
 	if err != nil {
 		return err
 	}
-	d, err := strconv.Atoi(split[1])
-	if err != nil {
-		return err
+	if p.Debug == 0 {
+		return errors.New("expected PORT:DEBUGPORT")
 	}
-	*i = append(*i, usb.PortTouple{
-		Normal: n,
-		Debug:  d,
-	})
+	*i = append(*i, p)
 	return nil
 }
 
@@ -73,29 +78,123 @@ func (i *udpPorts) Set(value string) error {
 	return nil
 }
 
-func initUsb(init bool, wr *memorywriter.MemoryWriter, sl *log.Logger) []core.USBBus {
-	if init {
-		wr.Log("Initing libusb")
+type stringList []string
 
-		w, err := usb.InitLibUSB(wr, !usb.HIDUse, allowCancel(), detachKernelDriver())
-		if err != nil {
-			sl.Fatalf("libusb: %s", err)
-		}
+func (i *stringList) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *stringList) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+type busNames []string
+
+func (i *busNames) String() string {
+	return strings.Join(*i, ",")
+}
 
-		if !usb.HIDUse {
-			return []core.USBBus{w}
+func (i *busNames) Set(value string) error {
+	b, err := usb.ParseFilterBus(value)
+	if err != nil {
+		return err
+	}
+	*i = append(*i, b)
+	return nil
+}
+
+// message size limits by bus; "" is for all the others
+type messageSizes map[string]uint32
+
+func (i *messageSizes) String() string {
+	res := make([]string, 0, len(*i))
+	for b, size := range *i {
+		if b == "" {
+			res = append(res, strconv.FormatUint(uint64(size), 10))
+		} else {
+			res = append(res, b+"="+strconv.FormatUint(uint64(size), 10))
 		}
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
 
-		wr.Log("Initing hidapi")
-		h, err := usb.InitHIDAPI(wr)
+func (i *messageSizes) Set(value string) error {
+	if *i == nil {
+		*i = make(messageSizes)
+	}
+	b := ""
+	if split := strings.SplitN(value, "=", 2); len(split) == 2 {
+		var err error
+		b, err = usb.ParseFilterBus(split[0])
 		if err != nil {
-			sl.Fatalf("hidapi: %s", err)
+			return err
 		}
-		return []core.USBBus{w, h}
+		value = split[1]
 	}
+	size, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	(*i)[b] = uint32(size)
 	return nil
 }
 
+// transports are the buses selected by the command line flags
+type transports struct {
+	withusb         bool
+	hidraw          bool
+	ports           udpPorts
+	touples         udpTouples
+	maxMessageSizes messageSizes
+}
+
+// registerFlags adds the flags selecting the transports;
+// the commands take them too, so they can be given after the command
+func (t *transports) registerFlags(fs *flag.FlagSet) {
+	fs.Var(
+		&t.ports,
+		"e",
+		"Use UDP port for emulator. Can be repeated for more ports. Example: trezord-go -e 21324 -e 21326",
+	)
+	fs.Var(
+		&t.touples,
+		"ed",
+		"Use UDP port for emulator with debug link. Can be repeated for more ports. Example: trezord-go -ed 21324:21326",
+	)
+	fs.BoolVar(
+		&t.withusb,
+		"u",
+		t.withusb,
+		"Use USB devices. Can be disabled for testing environments. Example: trezord-go -e 21324 -u=false",
+	)
+}
+
+func (t *transports) enabled() bool {
+	return t.withusb || len(t.ports)+len(t.touples) > 0
+}
+
+// apply sets the transports in opts
+func (t *transports) apply(opts *bridge.Options) {
+	opts.USB = t.withusb
+	opts.HIDRaw = t.hidraw
+	opts.Emulators = append(append([]usb.PortTouple{}, t.touples...), ports(t.ports)...)
+	opts.MaxMessageSize = t.maxMessageSizes[""]
+	opts.MaxMessageSizes = t.maxMessageSizes
+}
+
+func ports(p udpPorts) []usb.PortTouple {
+	res := make([]usb.PortTouple, 0, len(p))
+	for _, port := range p {
+		res = append(res, usb.PortTouple{
+			Normal: port,
+			Debug:  0,
+		})
+	}
+	return res
+}
+
 func main() {
 	// set git hash
 	info, ok := debug.ReadBuildInfo()
@@ -109,13 +208,19 @@ func main() {
 	}
 
 	var logfile string
+	var auditLogfile string
 	var port int
-	var ports udpPorts
-	var touples udpTouples
-	var withusb bool
 	var verbose bool
 	var reset bool
 	var versionFlag bool
+	var allowPorts, denyPorts stringList
+	var allowSerials, denySerials stringList
+	var allowTypes, denyTypes stringList
+	var modelsFile string
+	var protobFile string
+	var allowBuses, denyBuses busNames
+	t := &transports{withusb: true}
+	limits := api.DefaultRateLimits
 
 	flag.StringVar(
 		&logfile,
@@ -123,28 +228,19 @@ func main() {
 		"",
 		"Log into a file, rotating after 20MB",
 	)
+	flag.StringVar(
+		&auditLogfile,
+		"audit-log",
+		"",
+		"Write audit log of acquired and released sessions into a file, as JSON lines, rotating after 20MB. Rotated files are kept.",
+	)
 	flag.IntVar(
 		&port,
 		"p",
 		21325,
 		"Use a different port for the HTTP server. Default is 21325.",
 	)
-	flag.Var(
-		&ports,
-		"e",
-		"Use UDP port for emulator. Can be repeated for more ports. Example: trezord-go -e 21324 -e 21326",
-	)
-	flag.Var(
-		&touples,
-		"ed",
-		"Use UDP port for emulator with debug link. Can be repeated for more ports. Example: trezord-go -ed 21324:21326",
-	)
-	flag.BoolVar(
-		&withusb,
-		"u",
-		true,
-		"Use USB devices. Can be disabled for testing environments. Example: trezord-go -e 21324 -u=false",
-	)
+	t.registerFlags(flag.CommandLine)
 	flag.BoolVar(
 		&verbose,
 		"v",
@@ -163,6 +259,89 @@ func main() {
 		true,
 		"Reset USB device on session acquiring. Enabled by default (to prevent wrong device states); set to false if you plan to connect to debug link outside of bridge.",
 	)
+	flag.Var(
+		&allowPorts,
+		"allow-port",
+		"Use only devices on the given port path (like 1-2.3 for libusb). Can be repeated.",
+	)
+	flag.Var(
+		&denyPorts,
+		"deny-port",
+		"Never use devices on the given port path. Can be repeated.",
+	)
+	flag.Var(
+		&allowSerials,
+		"allow-serial",
+		"Use only devices with the given USB serial number. Can be repeated. Note that libusb devices are briefly opened to read the serial number.",
+	)
+	flag.Var(
+		&denySerials,
+		"deny-serial",
+		"Never use devices with the given USB serial number. Can be repeated.",
+	)
+	flag.Var(
+		&allowTypes,
+		"allow-type",
+		"Use only devices of the given type (t1-hid, t1-webusb, t1-webusb-boot, t2, t2-boot, emulator, or id from -models). Can be repeated.",
+	)
+	flag.Var(
+		&denyTypes,
+		"deny-type",
+		"Never use devices of the given type. Can be repeated.",
+	)
+	flag.Var(
+		&allowBuses,
+		"allow-bus",
+		"Use only devices on the given bus (libusb, hidapi, hidraw, usbfs, udp). Can be repeated.",
+	)
+	flag.Var(
+		&denyBuses,
+		"deny-bus",
+		"Never use devices on the given bus. Can be repeated.",
+	)
+	if usb.HIDRawAvailable {
+		flag.BoolVar(
+			&t.hidraw,
+			"hidraw",
+			false,
+			"Use /dev/hidraw for Trezor One HID devices instead of libusb, without detaching kernel driver.",
+		)
+	}
+	flag.Float64Var(
+		&limits.Rate,
+		"rate-limit",
+		limits.Rate,
+		"Limit API requests per second for each origin; 0 disables the limit.",
+	)
+	flag.IntVar(
+		&limits.Burst,
+		"rate-burst",
+		limits.Burst,
+		"Allow bursts of this many API requests for each origin over -rate-limit.",
+	)
+	flag.IntVar(
+		&limits.MaxListens,
+		"max-listen",
+		limits.MaxListens,
+		"Limit concurrent /listen requests for each origin; 0 disables the limit.",
+	)
+	flag.Var(
+		&t.maxMessageSizes,
+		"max-message-size",
+		"Limit size of messages read from devices, in bytes; either for all buses, or for one bus like udp=16777216. Can be repeated. Default is 8MB.",
+	)
+	flag.StringVar(
+		&modelsFile,
+		"models",
+		"",
+		"Read additional device models from a JSON file. Example: trezord-go -models models.json",
+	)
+	flag.StringVar(
+		&protobFile,
+		"protob",
+		"",
+		"Read protobuf messages for the JSON call API from a descriptor set, compiled from trezor-common by protoc --include_imports -o. Example: trezord-go -protob messages.pb",
+	)
 	flag.Parse()
 
 	if versionFlag {
@@ -183,71 +362,248 @@ func main() {
 
 	stderrLogger := log.New(stderrWriter, "", log.LstdFlags)
 
-	shortMemoryWriter := memorywriter.New(2000, 200, false, nil)
-
 	verboseWriter := stderrWriter
 	if !verbose {
 		verboseWriter = nil
 	}
 
-	longMemoryWriter := memorywriter.New(90000, 200, true, verboseWriter)
-
-	printWelcomeInfo(stderrLogger, port)
-	bus := initUsb(withusb, longMemoryWriter, stderrLogger)
+	var auditLog *core.AuditLog
+	if auditLogfile != "" {
+		auditLog = core.NewAuditLog(&lumberjack.Logger{
+			Filename: auditLogfile,
+			MaxSize:  20, // megabytes
+			// all backups are kept
+		})
+	}
 
-	longMemoryWriter.Log(fmt.Sprintf("UDP port count - %d", len(ports)))
+	if modelsFile != "" {
+		errModels := registerModels(modelsFile)
+		if errModels != nil {
+			stderrLogger.Fatalf("models: %s", errModels)
+		}
+	}
 
-	if len(ports)+len(touples) > 0 {
-		for _, t := range ports {
-			touples = append(touples, usb.PortTouple{
-				Normal: t,
-				Debug:  0,
-			})
+	if protobFile != "" {
+		errProtob := registerProtob(protobFile)
+		if errProtob != nil {
+			stderrLogger.Fatalf("protob: %s", errProtob)
 		}
-		e, errUDP := usb.InitUDP(touples, longMemoryWriter)
-		if errUDP != nil {
-			panic(errUDP)
+	}
+
+	allowT, err := parseTypes(allowTypes)
+	if err != nil {
+		stderrLogger.Fatalf("allow-type: %s", err)
+	}
+	denyT, err := parseTypes(denyTypes)
+	if err != nil {
+		stderrLogger.Fatalf("deny-type: %s", err)
+	}
+
+	opts := bridge.Options{
+		Filter: &usb.Filter{
+			Allow: usb.FilterRules{
+				Ports:   allowPorts,
+				Serials: allowSerials,
+				Types:   allowT,
+				Buses:   allowBuses,
+			},
+			Deny: usb.FilterRules{
+				Ports:   denyPorts,
+				Serials: denySerials,
+				Types:   denyT,
+				Buses:   denyBuses,
+			},
+		},
+		Reset:    reset,
+		AuditLog: auditLog,
+		Log:      verboseWriter,
+	}
+
+	if flag.NArg() > 0 {
+		errCommand := runCommand(flag.Args(), &commandEnv{
+			transports: t,
+			opts:       opts,
+		})
+		if errCommand != nil {
+			stderrLogger.Fatalf("%s", errCommand)
 		}
-		bus = append(bus, e)
+		return
 	}
 
-	if len(bus) == 0 {
+	if !t.enabled() {
 		stderrLogger.Fatalf("No transports enabled")
 	}
 
-	b := usb.Init(bus...)
-	defer b.Close()
-	longMemoryWriter.Log("Creating core")
-	c := core.New(b, longMemoryWriter, allowCancel(), reset)
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		stderrLogger.Fatalf("%s", err)
+	}
+	if len(listeners) > 0 {
+		// the port is given by the socket unit
+		if addr, ok := listeners[0].Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+	}
+
+	printWelcomeInfo(stderrLogger, port)
+
+	t.apply(&opts)
+	// socket-activated bridges start serving the request that
+	// activated them right away; the buses are initialized
+	// in the background (or by that request)
+	opts.Lazy = len(listeners) > 0
+	b, err := bridge.Start(opts)
+	if err != nil {
+		stderrLogger.Fatalf("%s", err)
+	}
+	longMemoryWriter := b.Log
+	shortMemoryWriter := memorywriter.New(2000, 200, false, nil)
+
 	longMemoryWriter.Log("Creating HTTP server")
-	s, err := server.New(c, port, stderrWriter, shortMemoryWriter, longMemoryWriter, version, githash)
+	s, err := server.New(b.Core, port, stderrWriter, shortMemoryWriter, longMemoryWriter, version, githash, limits)
 
 	if err != nil {
 		stderrLogger.Fatalf("https: %s", err)
 	}
 
+	if len(listeners) == 0 {
+		l, errListen := s.Listen()
+		if errListen != nil {
+			stderrLogger.Fatalf("https: %s", errListen)
+		}
+		listeners = []net.Listener{l}
+	}
+
+	// systemd is told we are ready only when the buses exist
+	go func() {
+		errInit := b.Init()
+		if errInit != nil {
+			stderrLogger.Fatalf("%s", errInit)
+		}
+		notify(systemd.StateReady, longMemoryWriter)
+	}()
+	stopWatchdog := make(chan struct{})
+	go watchdog(b, longMemoryWriter, stopWatchdog)
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		waitForSignal(stderrLogger)
+		close(stopWatchdog)
+		notify(systemd.StateStopping, longMemoryWriter)
+		shutdown(s, b, longMemoryWriter, stderrLogger)
+		close(shutdownDone)
+	}()
+
 	longMemoryWriter.Log("Running HTTP server")
-	err = s.Run()
+	err = s.Serve(listeners)
 	if err != nil {
 		stderrLogger.Fatalf("https: %s", err)
 	}
+	<-shutdownDone
 
 	longMemoryWriter.Log("Main ended successfully")
 }
 
-func printWelcomeInfo(stderrLogger *log.Logger, port int) {
-	stderrLogger.Printf("trezord v%s (rev %s) is starting on port %d", version, githash, port)
-	if core.IsDebugBinary() {
-		stderrLogger.Print("!! DEBUG mode enabled! Please contact Trezor support in case you did not initiate this. !!")
+func notify(state string, mw *memorywriter.MemoryWriter) {
+	sent, err := systemd.Notify(state)
+	if err != nil {
+		mw.Log(fmt.Sprintf("sd_notify %s: %s", state, err))
+		return
+	}
+	if sent {
+		mw.Log("sd_notify " + state)
+	}
+}
+
+// Pings systemd watchdog, if enabled, as long as enumeration completes.
+// Before the lazy buses are used for the first time, there is nothing to check.
+func watchdog(b *bridge.Bridge, mw *memorywriter.MemoryWriter, stop <-chan struct{}) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		mw.Log(err.Error())
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	mw.Log(fmt.Sprintf("watchdog enabled, interval %s", interval))
+
+	check := func() error {
+		if !b.Initialized() {
+			return nil
+		}
+		_, err := b.Core.Enumerate()
+		return err
+	}
+	onError := func(err error) {
+		mw.Log("watchdog check failed - " + err.Error())
+	}
+	systemd.Watchdog(interval, check, onError, stop)
+}
+
+func waitForSignal(stderrLogger *log.Logger) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	signal.Stop(sigs)
+	stderrLogger.Printf("received %s, shutting down", sig)
+}
+
+// In-flight calls get this much time to finish on shutdown,
+// then their connections are closed and the sessions released
+const shutdownTimeout = 10 * time.Second
+
+func shutdown(s *server.Server, b *bridge.Bridge, mw *memorywriter.MemoryWriter, stderrLogger *log.Logger) {
+	mw.Log("stopping listen")
+	b.Core.Stop()
+
+	mw.Log("shutting down HTTP server")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		stderrLogger.Printf("shutdown: %s", err)
 	}
+
+	mw.Log("releasing sessions and closing buses")
+	b.Close()
+	stderrLogger.Print("shutdown finished")
 }
 
-// Does OS allow sync canceling via our custom libusb patches?
-func allowCancel() bool {
-	return runtime.GOOS != "freebsd" && runtime.GOOS != "openbsd"
+func registerModels(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return core.RegisterModels(f)
+}
+
+func registerProtob(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return protob.RegisterDescriptorSet(f)
 }
 
-// Does OS detach kernel driver in libusb?
-func detachKernelDriver() bool {
-	return runtime.GOOS == "linux"
+// types are parsed after reading -models, so custom models can be used
+func parseTypes(names []string) ([]core.DeviceType, error) {
+	res := make([]core.DeviceType, 0, len(names))
+	for _, name := range names {
+		t, err := usb.ParseFilterType(name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+func printWelcomeInfo(stderrLogger *log.Logger, port int) {
+	stderrLogger.Printf("trezord v%s (rev %s) is starting on port %d", version, githash, port)
+	if core.IsDebugBinary() {
+		stderrLogger.Print("!! DEBUG mode enabled! Please contact Trezor support in case you did not initiate this. !!")
+	}
 }
@@ -0,0 +1,456 @@
+package udev
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// Checking and installing udev rules on linux. Without the rules,
+// device nodes are writable only by root, and libusb just reports
+// LIBUSB_ERROR_ACCESS; this is the most common issue on linux.
+//
+// All the files are relative to root, which is "/" except in tests.
+
+// DefaultRulesFile is where Install writes the rules;
+// packages install them into /lib/udev/rules.d, which this overrides
+const DefaultRulesFile = "/etc/udev/rules.d/51-trezor.rules"
+
+// RulesDirs are udev rules directories, in the order udev reads them
+var RulesDirs = []string{
+	"etc/udev/rules.d",
+	"run/udev/rules.d",
+	"usr/lib/udev/rules.d",
+	"lib/udev/rules.d",
+}
+
+// ID is USB vendor and product ID
+type ID struct {
+	Vendor  int
+	Product int
+}
+
+func (id ID) String() string {
+	return fmt.Sprintf("%04x:%04x", id.Vendor, id.Product)
+}
+
+// IDs returns IDs of all known USB models, including the ones
+// registered from config; hidraw is true for the ones with
+// a HID interface (T1 firmware, and FIDO on newer models)
+func IDs() (usb []ID, hidraw []ID) {
+	seenUSB := make(map[ID]bool)
+	seenHidraw := make(map[ID]bool)
+	for _, m := range core.Models() {
+		if m.Interface == core.InterfaceUDP {
+			continue
+		}
+		id := ID{Vendor: m.VendorID, Product: m.ProductID}
+		if !seenUSB[id] {
+			seenUSB[id] = true
+			usb = append(usb, id)
+		}
+		if !m.Bootloader && !seenHidraw[id] {
+			seenHidraw[id] = true
+			hidraw = append(hidraw, id)
+		}
+	}
+	return usb, hidraw
+}
+
+// Rules returns the content of rules file for all known models
+func Rules() string {
+	usb, hidraw := IDs()
+	var b strings.Builder
+	b.WriteString("# Trezor: The Original Hardware Wallet\n")
+	b.WriteString("# https://trezor.io/\n")
+	b.WriteString("# Generated by trezord-go udev install\n\n")
+	for _, id := range usb {
+		fmt.Fprintf(&b, `SUBSYSTEM=="usb", ATTR{idVendor}=="%04x", ATTR{idProduct}=="%04x", MODE="0660", GROUP="plugdev", TAG+="uaccess", TAG+="udev-acl", SYMLINK+="trezor%%n"`+"\n", id.Vendor, id.Product)
+	}
+	for _, id := range hidraw {
+		fmt.Fprintf(&b, `KERNEL=="hidraw*", ATTRS{idVendor}=="%04x", ATTRS{idProduct}=="%04x", MODE="0660", GROUP="plugdev", TAG+="uaccess", TAG+="udev-acl"`+"\n", id.Vendor, id.Product)
+	}
+	return b.String()
+}
+
+// Install writes the rules into file, like DefaultRulesFile;
+// udev reads new rules files, but does not apply them to the devices
+// that are already connected
+func Install(file string) error {
+	return install("/", file)
+}
+
+func install(root, file string) error {
+	path := filepath.Join(root, file)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(Rules()), 0o644)
+}
+
+var (
+	vendorRe  = regexp.MustCompile(`ATTRS?\{idVendor\}=="([0-9a-fA-F]{4})"`)
+	productRe = regexp.MustCompile(`ATTRS?\{idProduct\}=="([0-9a-fA-F]{4})"`)
+	// rules can give access by mode, group or to the logged in user
+	accessRe = regexp.MustCompile(`MODE=|GROUP=|TAG\+="uaccess"`)
+)
+
+// Rule is a line of udev rules that gives access to Trezor devices
+type Rule struct {
+	File   string
+	Line   int
+	Hidraw bool
+	ID     ID // Product is -1 for rules for all products of the vendor
+	Text   string
+}
+
+func (r Rule) matches(id ID, hidraw bool) bool {
+	return r.Hidraw == hidraw && r.ID.Vendor == id.Vendor && (r.ID.Product == -1 || r.ID.Product == id.Product)
+}
+
+// Device is a Trezor device found in sysfs, with its device node
+type Device struct {
+	Name   string // sysfs name, like 1-2 or hidraw0
+	Dir    string // sysfs directory, under root
+	ID     ID
+	BCD    uint16 // 0 for hidraw
+	Model  string
+	Hidraw bool
+	Node   string
+	Err    error // of opening the node for reading and writing; nil if it can be opened
+}
+
+// Report is the result of Check
+type Report struct {
+	Rules         []Rule
+	MissingUSB    []ID // known IDs without usb rules
+	MissingHidraw []ID // known IDs without hidraw rules
+	Devices       []Device
+}
+
+// OK is true if all the rules are installed and all the devices can be opened
+func (r *Report) OK() bool {
+	if len(r.MissingUSB) != 0 || len(r.MissingHidraw) != 0 {
+		return false
+	}
+	for _, d := range r.Devices {
+		if d.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) hasRule(id ID, hidraw bool) bool {
+	for _, rule := range r.Rules {
+		if rule.matches(id, hidraw) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check finds installed rules and connected devices, and tries to open them
+func Check() (*Report, error) {
+	return check("/", openNode)
+}
+
+func openNode(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func check(root string, open func(string) error) (*Report, error) {
+	rules, err := ScanRules(root)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{Rules: rules}
+
+	usb, hidraw := IDs()
+	for _, id := range usb {
+		if !r.hasRule(id, false) {
+			r.MissingUSB = append(r.MissingUSB, id)
+		}
+	}
+	for _, id := range hidraw {
+		if !r.hasRule(id, true) {
+			r.MissingHidraw = append(r.MissingHidraw, id)
+		}
+	}
+
+	devices, err := USBDevices(root)
+	if err != nil {
+		return nil, err
+	}
+	hidrawDevices, err := HidrawDevices(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range append(devices, hidrawDevices...) {
+		d.Err = open(filepath.Join(root, d.Node))
+		r.Devices = append(r.Devices, d)
+	}
+	return r, nil
+}
+
+// ScanRules reads the rules that give access to Trezor devices
+// from all rules directories under root; a file in /etc overrides
+// the file with the same name in /lib etc., as in udev
+func ScanRules(root string) ([]Rule, error) {
+	var res []Rule
+	seen := make(map[string]bool)
+	for _, dir := range RulesDirs {
+		files, err := filepath.Glob(filepath.Join(root, dir, "*.rules"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if seen[filepath.Base(file)] {
+				continue
+			}
+			seen[filepath.Base(file)] = true
+			rules, err := readRules(file)
+			if err != nil {
+				return nil, err
+			}
+			for i := range rules {
+				rules[i].File = "/" + filepath.Join(dir, filepath.Base(file))
+			}
+			res = append(res, rules...)
+		}
+	}
+	return res, nil
+}
+
+// readRules reads the lines that give access to some Trezor device;
+// rules with a product ID of other devices are skipped, since
+// vendor ID 1209 is shared by many open source devices
+func readRules(file string) ([]Rule, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	usb, _ := IDs()
+	vendors := make(map[int]bool)
+	known := make(map[ID]bool)
+	for _, id := range usb {
+		vendors[id.Vendor] = true
+		known[id] = true
+	}
+
+	var res []Rule
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || !accessRe.MatchString(line) {
+			continue
+		}
+		v := vendorRe.FindStringSubmatch(line)
+		if v == nil {
+			continue
+		}
+		vendor, _ := strconv.ParseInt(v[1], 16, 32)
+		if !vendors[int(vendor)] {
+			continue
+		}
+		product := int64(-1)
+		if p := productRe.FindStringSubmatch(line); p != nil {
+			product, _ = strconv.ParseInt(p[1], 16, 32)
+		}
+		id := ID{Vendor: int(vendor), Product: int(product)}
+		if product != -1 && !known[id] {
+			continue
+		}
+		res = append(res, Rule{
+			Line:   i + 1,
+			Hidraw: strings.Contains(line, `KERNEL=="hidraw`) || strings.Contains(line, `SUBSYSTEM=="hidraw"`),
+			ID:     id,
+			Text:   line,
+		})
+	}
+	return res, nil
+}
+
+// USBDevices finds Trezor devices in sysfs under root
+func USBDevices(root string) ([]Device, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "sys", "bus", "usb", "devices", "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	var res []Device
+	for _, dir := range dirs {
+		vid, errV := ReadSysfs(filepath.Join(dir, "idVendor"), 16)
+		pid, errP := ReadSysfs(filepath.Join(dir, "idProduct"), 16)
+		bcd, errB := ReadSysfs(filepath.Join(dir, "bcdDevice"), 16)
+		busnum, errBus := ReadSysfs(filepath.Join(dir, "busnum"), 10)
+		devnum, errDev := ReadSysfs(filepath.Join(dir, "devnum"), 10)
+		if errV != nil || errP != nil || errB != nil || errBus != nil || errDev != nil {
+			// interfaces, or device disconnected while reading
+			continue
+		}
+		model, ok := core.FindModel(int(vid), int(pid), uint16(bcd))
+		if !ok || model.Interface == core.InterfaceUDP {
+			continue
+		}
+		res = append(res, Device{
+			Name:  filepath.Base(dir),
+			Dir:   dir,
+			ID:    ID{Vendor: int(vid), Product: int(pid)},
+			BCD:   uint16(bcd),
+			Model: model.Name,
+			Node:  fmt.Sprintf("/dev/bus/usb/%03d/%03d", busnum, devnum),
+		})
+	}
+	return res, nil
+}
+
+// HidrawDevices finds hidraw nodes of Trezor devices in sysfs under root
+func HidrawDevices(root string) ([]Device, error) {
+	nodes, err := filepath.Glob(filepath.Join(root, "sys", "class", "hidraw", "hidraw*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(nodes)
+	_, ids := IDs()
+	var res []Device
+	for _, node := range nodes {
+		uevent, err := ReadUevent(filepath.Join(node, "device", "uevent"))
+		if err != nil {
+			continue
+		}
+		bus, id, err := ParseHIDID(uevent["HID_ID"])
+		if err != nil || bus != HIDBusUSB || !slices.Contains(ids, id) {
+			continue
+		}
+		res = append(res, Device{
+			Name:   filepath.Base(node),
+			Dir:    node,
+			ID:     id,
+			Model:  "HID interface",
+			Hidraw: true,
+			Node:   "/dev/" + filepath.Base(node),
+		})
+	}
+	return res, nil
+}
+
+// HIDBusUSB is the bus of USB devices in HID_ID
+const HIDBusUSB = 0x0003
+
+// ParseHIDID parses HID_ID from uevent of HID devices,
+// like 0003:0000534C:00000001
+func ParseHIDID(value string) (bus int, id ID, err error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != 3 {
+		return 0, ID{}, fmt.Errorf("malformed HID_ID %q", value)
+	}
+	var parsed [3]uint64
+	for i, f := range fields {
+		parsed[i], err = strconv.ParseUint(f, 16, 32)
+		if err != nil {
+			return 0, ID{}, fmt.Errorf("malformed HID_ID %q: %w", value, err)
+		}
+	}
+	return int(parsed[0]), ID{Vendor: int(parsed[1]), Product: int(parsed[2])}, nil
+}
+
+// ReadUevent reads KEY=value lines of uevent file in sysfs
+func ReadUevent(filename string) (map[string]string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			res[key] = value
+		}
+	}
+	return res, nil
+}
+
+// ReadSysfs reads a number from sysfs attribute, like idVendor (base 16)
+// or busnum (base 10)
+func ReadSysfs(filename string, base int) (uint64, error) {
+	value, err := ReadSysfsString(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(value, base, 16)
+}
+
+// ReadSysfsString reads a text sysfs attribute, like serial
+func ReadSysfsString(filename string) (string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(content)), nil
+}
+
+// Write prints the report, with the fixes for the problems
+func (r *Report) Write(w io.Writer) error {
+	var b strings.Builder
+
+	if len(r.Rules) == 0 {
+		b.WriteString("No udev rules for Trezor devices found.\n")
+	} else {
+		b.WriteString("Udev rules for Trezor devices:\n")
+		for _, rule := range r.Rules {
+			fmt.Fprintf(&b, "  %s:%d: %s\n", rule.File, rule.Line, rule.Text)
+		}
+	}
+	for _, id := range r.MissingUSB {
+		fmt.Fprintf(&b, "Missing usb rule for %s.\n", id)
+	}
+	for _, id := range r.MissingHidraw {
+		fmt.Fprintf(&b, "Missing hidraw rule for %s (needed for -hidraw and for FIDO in browsers).\n", id)
+	}
+
+	b.WriteString("\n")
+	if len(r.Devices) == 0 {
+		b.WriteString("No Trezor devices connected.\n")
+	}
+	for _, d := range r.Devices {
+		if d.Err == nil {
+			fmt.Fprintf(&b, "%s %s (%s) at %s: OK\n", d.Name, d.ID, d.Model, d.Node)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s (%s) at %s: cannot open: %s\n", d.Name, d.ID, d.Model, d.Node, d.Err)
+		switch {
+		case errors.Is(d.Err, os.ErrNotExist):
+			b.WriteString("  The device node does not exist; reconnect the device.\n")
+		case !r.hasRule(d.ID, d.Hidraw):
+			b.WriteString("  There is no udev rule for it; install the rules with\n")
+			b.WriteString("    sudo trezord-go udev install\n")
+		default:
+			b.WriteString("  The rules are installed, but were not applied to the device. Reload them with\n")
+			b.WriteString("    sudo udevadm control --reload-rules && sudo udevadm trigger\n")
+			b.WriteString("  or reconnect the device. If you were just added to the plugdev group,\n")
+			b.WriteString("  log out and in again.\n")
+		}
+	}
+
+	if len(r.MissingUSB) != 0 || len(r.MissingHidraw) != 0 {
+		b.WriteString("\nTo install the rules for all Trezor devices, run\n")
+		b.WriteString("  sudo trezord-go udev install\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
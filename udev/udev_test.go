@@ -0,0 +1,105 @@
+package udev
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/trezor/trezord-go/udev/udevtest"
+)
+
+func denyAll(path string) error {
+	return os.ErrPermission
+}
+
+func TestCheckMissingRules(t *testing.T) {
+	root := udevtest.FakeRoot(t)
+	r, err := check(root, denyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() || len(r.Rules) != 0 || len(r.MissingUSB) == 0 {
+		t.Errorf("expected missing rules, got %+v", r)
+	}
+	if len(r.Devices) != 2 || r.Devices[0].Node != "/dev/bus/usb/001/005" || r.Devices[0].Err == nil ||
+		r.Devices[1].Node != "/dev/hidraw0" || !r.Devices[1].Hidraw {
+		t.Fatalf("expected device that cannot be opened, got %+v", r.Devices)
+	}
+
+	var out bytes.Buffer
+	err = r.Write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "There is no udev rule for it") {
+		t.Errorf("expected advice to install rules, got\n%s", out.String())
+	}
+}
+
+func TestInstallAndCheck(t *testing.T) {
+	root := udevtest.FakeRoot(t)
+	err := install(root, DefaultRulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rules are installed, but not applied yet
+	r, err := check(root, denyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.MissingUSB) != 0 || len(r.MissingHidraw) != 0 {
+		t.Errorf("expected no missing rules, got %v %v", r.MissingUSB, r.MissingHidraw)
+	}
+	var out bytes.Buffer
+	err = r.Write(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "udevadm control --reload-rules") {
+		t.Errorf("expected advice to reload rules, got\n%s", out.String())
+	}
+
+	r, err = check(root, openNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Errorf("expected OK, got %+v", r)
+	}
+}
+
+func TestRulesOverride(t *testing.T) {
+	root := udevtest.FakeRoot(t)
+	err := install(root, "/lib/udev/rules.d/51-trezor.rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// masked by the empty file in /etc
+	udevtest.WriteFile(t, root, "etc/udev/rules.d/51-trezor.rules", "")
+
+	r, err := check(root, openNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Rules) != 0 {
+		t.Errorf("expected overridden rules, got %+v", r.Rules)
+	}
+}
+
+func TestParseHIDID(t *testing.T) {
+	bus, id, err := ParseHIDID("0003:0000534C:00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bus != HIDBusUSB || id != (ID{Vendor: 0x534c, Product: 0x0001}) {
+		t.Errorf("unexpected bus %d, id %s", bus, id)
+	}
+	for _, value := range []string{"", "0003:534C", "0003:zz:0001"} {
+		_, _, err = ParseHIDID(value)
+		if err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package udevtest builds fake root directories with sysfs and device
+// nodes of USB devices, for tests of the code that scans sysfs.
+//
+// As in sysfs, USB devices are under /sys/devices, linked from
+// /sys/bus/usb/devices, and hidraw nodes are linked from /sys/class/hidraw
+// to their HID device, which is under the USB interface.
+package udevtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// usbDevicesDir is where the fake USB devices are, under root
+const usbDevicesDir = "sys/devices/pci0000:00/0000:00:14.0/usb1"
+
+// WriteFile writes the file under root, with its directories
+func WriteFile(t testing.TB, root, name, content string) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlink(t testing.TB, target, name string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(target, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// USBInterface of USB device, numbered by its index
+type USBInterface struct {
+	Class     string   // hex, like "ff"
+	Endpoints []string // hex addresses, like "81"
+}
+
+// USBDevice is a configured USB device; the device node
+// is not written, so that it can be left out
+type USBDevice struct {
+	Name       string // like 1-2.3, on bus 1
+	Vendor     string // hex, like "1209"
+	Product    string
+	BCD        string
+	Devnum     string // decimal
+	Serial     string // no serial attribute if empty
+	Interfaces []USBInterface
+}
+
+// AddUSB writes the device into sysfs under root
+func AddUSB(t testing.TB, root string, d USBDevice) {
+	t.Helper()
+	dir := filepath.Join(root, usbDevicesDir, d.Name)
+	attrs := map[string]string{
+		"idVendor":            d.Vendor,
+		"idProduct":           d.Product,
+		"bcdDevice":           d.BCD,
+		"busnum":              "1",
+		"devnum":              d.Devnum,
+		"bConfigurationValue": "1",
+	}
+	if d.Serial != "" {
+		attrs["serial"] = d.Serial
+	}
+	for name, value := range attrs {
+		WriteFile(t, dir, name, value+"\n")
+	}
+	for i, iface := range d.Interfaces {
+		ifaceDir := filepath.Join(dir, fmt.Sprintf("%s:1.%d", d.Name, i))
+		WriteFile(t, ifaceDir, "bInterfaceNumber", fmt.Sprintf("%02x\n", i))
+		WriteFile(t, ifaceDir, "bAlternateSetting", "00\n")
+		WriteFile(t, ifaceDir, "bInterfaceClass", iface.Class+"\n")
+		for _, ep := range iface.Endpoints {
+			WriteFile(t, ifaceDir, filepath.Join("ep_"+ep, "type"), "Interrupt\n")
+		}
+	}
+	symlink(t, dir, filepath.Join(root, "sys", "bus", "usb", "devices", d.Name))
+}
+
+// Hidraw is a hidraw node of HID interface of USB device
+type Hidraw struct {
+	Node             string // like hidraw0
+	Port             string // name of the USB device, like 1-2
+	Interface        int
+	HIDID            string // bus, vendor and product, like 0003:0000534C:00000001
+	Serial           string
+	ReportDescriptor []byte
+}
+
+// AddHidraw writes the HID device under the interface of the USB device,
+// which can be left out, links it from /sys/class/hidraw,
+// and writes an empty device node
+func AddHidraw(t testing.TB, root string, h Hidraw) {
+	t.Helper()
+	ifaceDir := filepath.Join(root, usbDevicesDir, h.Port, fmt.Sprintf("%s:1.%d", h.Port, h.Interface))
+	WriteFile(t, ifaceDir, "bInterfaceNumber", fmt.Sprintf("%02x\n", h.Interface))
+
+	// the instance number at the end changes on reconnect
+	hidDir := filepath.Join(ifaceDir, h.HIDID+"."+strings.TrimPrefix(h.Node, "hidraw"))
+	uevent := "DRIVER=hid-generic\nHID_ID=" + h.HIDID + "\nHID_NAME=SatoshiLabs TREZOR\nHID_UNIQ=" + h.Serial + "\n"
+	WriteFile(t, hidDir, "uevent", uevent)
+	WriteFile(t, hidDir, "report_descriptor", string(h.ReportDescriptor))
+
+	symlink(t, hidDir, filepath.Join(root, "sys", "class", "hidraw", h.Node, "device"))
+	WriteFile(t, root, filepath.Join("dev", h.Node), "")
+}
+
+// FakeRoot returns a new root with one Model T, as 1-2 with device
+// number 5 and serial number ABCDEF, with its device node; T1 HID
+// interface as hidraw0, without its USB device; and a rule of other
+// device with the shared vendor ID
+func FakeRoot(t testing.TB) string {
+	t.Helper()
+	root := t.TempDir()
+	AddUSB(t, root, USBDevice{
+		Name: "1-2", Vendor: "1209", Product: "53c1", BCD: "0200", Devnum: "5", Serial: "ABCDEF",
+		Interfaces: []USBInterface{{Class: "ff", Endpoints: []string{"81", "01"}}},
+	})
+	WriteFile(t, root, filepath.Join(usbDevicesDir, "1-2", "descriptors"), "\x12\x01")
+	WriteFile(t, root, "dev/bus/usb/001/005", "")
+
+	AddHidraw(t, root, Hidraw{Node: "hidraw0", Port: "1-3", HIDID: "0003:0000534C:00000001"})
+
+	WriteFile(t, root, "lib/udev/rules.d/60-other.rules",
+		`SUBSYSTEM=="usb", ATTR{idVendor}=="1209", ATTR{idProduct}=="0001", MODE="0666"`+"\n")
+	return root
+}
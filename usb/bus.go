@@ -2,17 +2,35 @@ package usb
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/trezor/trezord-go/core"
 )
 
 type USB struct {
 	buses []core.USBBus
+
+	statusMutex sync.Mutex
+	status      []core.BusStatus // same order as buses
+}
+
+// implemented by all buses in this package,
+// for reporting their state
+type describedBus interface {
+	describe() (name, detail string)
 }
 
 func Init(buses ...core.USBBus) *USB {
+	status := make([]core.BusStatus, 0, len(buses))
+	for _, b := range buses {
+		var st core.BusStatus
+		st.Name, st.Detail = describe(b)
+		status = append(status, st)
+	}
 	return &USB{
-		buses: buses,
+		buses:  buses,
+		status: status,
 	}
 }
 
@@ -25,19 +43,48 @@ func (b *USB) Has(path string) bool {
 	return false
 }
 
+// Enumerate enumerates all the buses, even if some of them fail,
+// so the status of each is up to date; the errors are joined
 func (b *USB) Enumerate() ([]core.USBInfo, error) {
 	infos := make([]core.USBInfo, 0, len(b.buses))
+	var errs []error
 
-	for _, b := range b.buses {
-		l, err := b.Enumerate()
+	for i, bus := range b.buses {
+		l, err := bus.Enumerate()
+		b.saveStatus(i, len(l), err)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
 		infos = append(infos, l...)
 	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 	return infos, nil
 }
 
+func (b *USB) saveStatus(i int, devices int, err error) {
+	b.statusMutex.Lock()
+	defer b.statusMutex.Unlock()
+	st := &b.status[i]
+	now := time.Now()
+	st.LastEnumerate = &now
+	st.Devices = devices
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+	}
+}
+
+func (b *USB) BusStatus() []core.BusStatus {
+	b.statusMutex.Lock()
+	defer b.statusMutex.Unlock()
+	res := make([]core.BusStatus, len(b.status))
+	copy(res, b.status)
+	return res
+}
+
 func (b *USB) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
 	for _, b := range b.buses {
 		if b.Has(path) {
@@ -53,7 +100,8 @@ func (b *USB) Close() {
 	}
 }
 
-var ErrNotFound = errors.New("device not found")
-var errDisconnect = errors.New("device disconnected during action")
-var errClosedDevice = errors.New("closed device")
-var errNotDebug = errors.New("not debug link")
+// the errors are defined in core, so they can be checked without cgo
+var ErrNotFound = core.ErrDeviceNotFound
+var ErrDisconnected = core.ErrDisconnected
+var ErrClosedDevice = core.ErrClosedDevice
+var ErrNotDebug = core.ErrNotDebug
@@ -0,0 +1,79 @@
+package usb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// fixedBus has fixed devices, and connects to dev if it is set
+type fixedBus struct {
+	infos []core.USBInfo
+	err   error
+	dev   core.USBDevice
+}
+
+func (b fixedBus) Enumerate() ([]core.USBInfo, error) {
+	return b.infos, b.err
+}
+
+func (b fixedBus) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	if b.dev == nil {
+		return nil, ErrNotFound
+	}
+	return b.dev, nil
+}
+
+func (b fixedBus) Has(path string) bool {
+	return false
+}
+
+func (b fixedBus) Close() {}
+
+func TestEnumerateAllBuses(t *testing.T) {
+	errBus := errors.New("bus error")
+	b := Init(
+		fixedBus{err: errBus},
+		fixedBus{infos: []core.USBInfo{{Path: "dev"}}},
+	)
+	_, err := b.Enumerate()
+	if !errors.Is(err, errBus) {
+		t.Errorf("expected bus error, got %v", err)
+	}
+	status := b.BusStatus()
+	if status[0].Error != errBus.Error() {
+		t.Errorf("expected error in first bus status, got %+v", status[0])
+	}
+	if status[1].LastEnumerate == nil || status[1].Devices != 1 {
+		t.Errorf("second bus was not enumerated, got %+v", status[1])
+	}
+}
+
+type plainDevice struct{}
+
+func (d plainDevice) Read(p []byte) (int, error)    { return 0, nil }
+func (d plainDevice) Write(p []byte) (int, error)   { return len(p), nil }
+func (d plainDevice) Close(disconnected bool) error { return nil }
+
+type deadlineDevice struct {
+	plainDevice
+	readDeadline
+}
+
+func TestLimitedDeviceDeadline(t *testing.T) {
+	for _, dev := range []core.USBDevice{plainDevice{}, &deadlineDevice{}} {
+		_, expected := dev.(core.DeadlineDevice)
+		buses := LimitMessageSize([]core.USBBus{fixedBus{dev: dev}}, nil, 1024)
+		d, err := buses[0].Connect("dev", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := d.(core.MessageSizeLimiter); !ok {
+			t.Errorf("expected size limit")
+		}
+		if _, ok := d.(core.DeadlineDevice); ok != expected {
+			t.Errorf("expected deadline support %t, got %t", expected, ok)
+		}
+	}
+}
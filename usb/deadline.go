@@ -0,0 +1,36 @@
+package usb
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// readDeadline implements core.DeadlineDevice for the devices
+// that read in a loop, checking the deadline on each transfer
+type readDeadline struct {
+	t int64 // atomic, unix nanoseconds; 0 is no deadline
+}
+
+func (d *readDeadline) SetReadDeadline(t time.Time) error {
+	var n int64
+	if !t.IsZero() {
+		n = t.UnixNano()
+	}
+	atomic.StoreInt64(&d.t, n)
+	return nil
+}
+
+// timeout returns the time left until the deadline, or 0 if there is
+// no deadline; after the deadline, it returns os.ErrDeadlineExceeded
+func (d *readDeadline) timeout() (time.Duration, error) {
+	n := atomic.LoadInt64(&d.t)
+	if n == 0 {
+		return 0, nil
+	}
+	left := time.Until(time.Unix(0, n))
+	if left <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return left, nil
+}
@@ -0,0 +1,165 @@
+package usb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+)
+
+// Filters decide which devices this bridge claims,
+// so more bridges (or other tools) can share one USB bus.
+// Filtered devices are never returned from Enumerate,
+// so core never connects to them.
+
+const (
+	busLibUSB = "libusb"
+	busHIDAPI = "hidapi"
+	busHIDRaw = "hidraw"
+	busUSBFS  = "usbfs"
+	busUDP    = "udp"
+)
+
+// FilterRules is a set of device properties; empty list means "any".
+type FilterRules struct {
+	Ports   []string // OS port path; "1-2.3" for libusb and hidraw, device path for hidapi, port for udp
+	Serials []string
+	Types   []core.DeviceType
+	Buses   []string // libusb, hidapi, hidraw, usbfs, udp
+}
+
+// Filter allows the device if it matches all non-empty Allow lists
+// and does not match any item of any Deny list.
+type Filter struct {
+	Allow FilterRules
+	Deny  FilterRules
+
+	// devices already logged as filtered out, so the log
+	// is not repeated on every enumeration
+	logMutex sync.Mutex
+	logged   map[string]bool
+}
+
+type filterDevice struct {
+	bus    string
+	port   string
+	serial string
+	typ    core.DeviceType
+}
+
+func (d filterDevice) String() string {
+	// serial is not logged, it is potentially sensitive
+	return fmt.Sprintf("bus %s port %s type %d", d.bus, d.port, d.typ)
+}
+
+func (f *Filter) IsEmpty() bool {
+	return f == nil || (f.Allow.isEmpty() && f.Deny.isEmpty())
+}
+
+func (r *FilterRules) isEmpty() bool {
+	return len(r.Ports) == 0 && len(r.Serials) == 0 && len(r.Types) == 0 && len(r.Buses) == 0
+}
+
+// hasSerials is true if the filter checks serial numbers
+func (f *Filter) hasSerials() bool {
+	return f != nil && (len(f.Allow.Serials) != 0 || len(f.Deny.Serials) != 0)
+}
+
+// allowedBeforeSerial checks everything except serial numbers;
+// used for devices that would have to be opened to read the serial.
+func (f *Filter) allowedBeforeSerial(d filterDevice) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	if containsString(f.Deny.Ports, d.port) ||
+		containsType(f.Deny.Types, d.typ) ||
+		containsString(f.Deny.Buses, d.bus) {
+		return false
+	}
+	return (len(f.Allow.Ports) == 0 || containsString(f.Allow.Ports, d.port)) &&
+		(len(f.Allow.Types) == 0 || containsType(f.Allow.Types, d.typ)) &&
+		(len(f.Allow.Buses) == 0 || containsString(f.Allow.Buses, d.bus))
+}
+
+func (f *Filter) allowed(d filterDevice) bool {
+	if !f.allowedBeforeSerial(d) {
+		return false
+	}
+	if f.IsEmpty() {
+		return true
+	}
+	if containsString(f.Deny.Serials, d.serial) {
+		return false
+	}
+	return len(f.Allow.Serials) == 0 || containsString(f.Allow.Serials, d.serial)
+}
+
+func (f *Filter) check(d filterDevice, mw *memorywriter.MemoryWriter) bool {
+	if !f.allowed(d) {
+		f.logFiltered(d, mw)
+		return false
+	}
+	return true
+}
+
+func (f *Filter) checkBeforeSerial(d filterDevice, mw *memorywriter.MemoryWriter) bool {
+	if !f.allowedBeforeSerial(d) {
+		f.logFiltered(d, mw)
+		return false
+	}
+	return true
+}
+
+// logFiltered logs the filtered device once per bus and port
+func (f *Filter) logFiltered(d filterDevice, mw *memorywriter.MemoryWriter) {
+	f.logMutex.Lock()
+	defer f.logMutex.Unlock()
+	key := d.String()
+	if f.logged[key] {
+		return
+	}
+	if f.logged == nil {
+		f.logged = make(map[string]bool)
+	}
+	f.logged[key] = true
+	mw.Log("filtered out " + key)
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func containsType(haystack []core.DeviceType, needle core.DeviceType) bool {
+	for _, t := range haystack {
+		if t == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilterType converts model ID, as used in command line flags,
+// to device type.
+func ParseFilterType(name string) (core.DeviceType, error) {
+	m, ok := core.ModelByID(strings.ToLower(name))
+	if !ok {
+		return 0, fmt.Errorf("unknown device type %q", name)
+	}
+	return m.Type, nil
+}
+
+// ParseFilterBus checks the bus name used in command line flags.
+func ParseFilterBus(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name != busLibUSB && name != busHIDAPI && name != busHIDRaw && name != busUSBFS && name != busUDP {
+		return "", fmt.Errorf("unknown bus %q", name)
+	}
+	return name, nil
+}
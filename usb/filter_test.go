@@ -0,0 +1,62 @@
+package usb
+
+import (
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+func TestFilter(t *testing.T) {
+	t2 := filterDevice{bus: busLibUSB, port: "1-2", serial: "AAA", typ: core.TypeT2}
+	t1 := filterDevice{bus: busHIDAPI, port: "/dev/x", serial: "BBB", typ: core.TypeT1Hid}
+	emu := filterDevice{bus: busUDP, port: "21324", typ: core.TypeEmulator}
+
+	testcases := []struct {
+		name   string
+		filter *Filter
+		dev    filterDevice
+		allow  bool
+	}{
+		{"nil filter", nil, t2, true},
+		{"empty filter", &Filter{}, t2, true},
+		{"allowed port", &Filter{Allow: FilterRules{Ports: []string{"1-2"}}}, t2, true},
+		{"not allowed port", &Filter{Allow: FilterRules{Ports: []string{"1-3"}}}, t2, false},
+		{"denied port", &Filter{Deny: FilterRules{Ports: []string{"1-2"}}}, t2, false},
+		{"allowed serial", &Filter{Allow: FilterRules{Serials: []string{"BBB"}}}, t1, true},
+		{"denied serial", &Filter{Deny: FilterRules{Serials: []string{"BBB"}}}, t1, false},
+		{"allowed serial, no serial", &Filter{Allow: FilterRules{Serials: []string{"BBB"}}}, emu, false},
+		{"allowed type", &Filter{Allow: FilterRules{Types: []core.DeviceType{core.TypeEmulator}}}, emu, true},
+		{"denied type", &Filter{Deny: FilterRules{Types: []core.DeviceType{core.TypeEmulator}}}, emu, false},
+		{"allowed bus", &Filter{Allow: FilterRules{Buses: []string{busHIDAPI}}}, t1, true},
+		{"not allowed bus", &Filter{Allow: FilterRules{Buses: []string{busHIDAPI}}}, t2, false},
+		{"allow and deny", &Filter{
+			Allow: FilterRules{Buses: []string{busLibUSB}},
+			Deny:  FilterRules{Serials: []string{"AAA"}},
+		}, t2, false},
+		{"allow in two categories", &Filter{
+			Allow: FilterRules{Buses: []string{busLibUSB}, Types: []core.DeviceType{core.TypeT2}},
+		}, t2, true},
+	}
+	for _, tc := range testcases {
+		if allow := tc.filter.allowed(tc.dev); allow != tc.allow {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.allow, allow)
+		}
+	}
+}
+
+func TestFilterHasSerials(t *testing.T) {
+	testcases := []struct {
+		filter  *Filter
+		serials bool
+	}{
+		{nil, false},
+		{&Filter{Allow: FilterRules{Ports: []string{"1-2"}}}, false},
+		{&Filter{Allow: FilterRules{Serials: []string{"AAA"}}}, true},
+		{&Filter{Deny: FilterRules{Serials: []string{"AAA"}}}, true},
+	}
+	for _, tc := range testcases {
+		if serials := tc.filter.hasSerials(); serials != tc.serials {
+			t.Errorf("%+v: expected %v, got %v", tc.filter, tc.serials, serials)
+		}
+	}
+}
@@ -26,13 +26,15 @@ const (
 )
 
 type HIDAPI struct {
-	mw *memorywriter.MemoryWriter
+	mw     *memorywriter.MemoryWriter
+	filter *Filter
 }
 
-func InitHIDAPI(mw *memorywriter.MemoryWriter) (*HIDAPI, error) {
+func InitHIDAPI(mw *memorywriter.MemoryWriter, filter *Filter) (*HIDAPI, error) {
 	lowlevel.SetLogWriter(mw)
 	return &HIDAPI{
-		mw: mw,
+		mw:     mw,
+		filter: filter,
 	}, nil
 }
 
@@ -46,26 +48,37 @@ func (b *HIDAPI) Enumerate() ([]core.USBInfo, error) {
 
 	for _, dev := range devs { // enumerate all devices
 		dev := dev
-		if b.match(&dev) {
+		m, model := b.match(&dev)
+		if m && b.filter.check(filterDevice{
+			bus:    busHIDAPI,
+			port:   dev.Path,
+			serial: dev.Serial,
+			typ:    model.Type,
+		}, b.mw) {
 			infos = append(infos, core.USBInfo{
 				Path:      b.identify(&dev),
 				VendorID:  int(dev.VendorID),
 				ProductID: int(dev.ProductID),
-				Type:      core.TypeT1Hid,
+				Type:      model.Type,
 				Debug:     false,
+				Serial:    dev.Serial,
 			})
 		}
 	}
 	return infos, nil
 }
 
+func (b *HIDAPI) describe() (string, string) {
+	return busHIDAPI, ""
+}
+
 func (b *HIDAPI) Has(path string) bool {
 	return strings.HasPrefix(path, hidapiPrefix)
 }
 
 func (b *HIDAPI) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
 	if debug {
-		return nil, errNotDebug
+		return nil, ErrNotDebug
 	}
 	b.mw.Log("enumerate to find")
 	devs := lowlevel.HidEnumerate(0, 0)
@@ -73,7 +86,8 @@ func (b *HIDAPI) Connect(path string, debug bool, reset bool) (core.USBDevice, e
 
 	for _, dev := range devs { // enumerate all devices
 		dev := dev
-		if b.match(&dev) && b.identify(&dev) == path {
+		m, _ := b.match(&dev)
+		if m && b.identify(&dev) == path {
 			b.mw.Log("low level open")
 			d, err := dev.Open()
 			if err != nil {
@@ -95,22 +109,20 @@ func (b *HIDAPI) Connect(path string, debug bool, reset bool) (core.USBDevice, e
 	return nil, ErrNotFound
 }
 
-func (b *HIDAPI) match(d *lowlevel.HidDeviceInfo) bool {
-	vid := d.VendorID
-	pid := d.ProductID
+func (b *HIDAPI) match(d *lowlevel.HidDeviceInfo) (bool, core.Model) {
 	// note that "trezor1" is just the old hidapi one; t2 has the new vid/pid
-	trezor1 := vid == core.VendorT1 && (pid == core.ProductT1Firmware)
-	if trezor1 {
+	model, ok := core.FindModel(int(d.VendorID), int(d.ProductID), d.Release)
+	if ok && model.Interface == core.InterfaceHID {
 		var dCopy = *d
 		// sanitize potentially sensitive info
 		dCopy.Serial = ""
 		dCopy.Path = ""
 		dCopy.Release = 0
-		matchedInterface := (d.Interface == int(normalIface.number) || d.UsagePage == hidUsagePage)
+		matchedInterface := (d.Interface == int(model.USBInterface.Number) || d.UsagePage == hidUsagePage)
 		b.mw.Log(fmt.Sprintf("matched HID - %+v, %t", dCopy, matchedInterface))
-		return matchedInterface
+		return matchedInterface, model
 	}
-	return false
+	return false, core.Model{}
 }
 
 func (b *HIDAPI) identify(dev *lowlevel.HidDeviceInfo) string {
@@ -132,6 +144,9 @@ type HID struct {
 	// closing cannot happen while read/write is hapenning,
 	// otherwise it segfaults on windows
 
+	// reads have short timeouts, so the deadline is checked between them
+	readDeadline
+
 	mw *memorywriter.MemoryWriter
 }
 
@@ -193,7 +208,15 @@ func (d *HID) readWrite(buf []byte, read bool) (int, error) {
 		closed := (atomic.LoadInt32(&d.closed)) == 1
 		if closed {
 			d.mw.Log("closed, skip")
-			return 0, errClosedDevice
+			return 0, ErrClosedDevice
+		}
+
+		if read {
+			_, err := d.timeout()
+			if err != nil {
+				d.mw.Log("deadline exceeded")
+				return 0, err
+			}
 		}
 
 		d.transferMutex.Lock()
@@ -228,7 +251,7 @@ func (d *HID) readWrite(buf []byte, read bool) (int, error) {
 			d.mw.Log("skipping empty transfer - go again")
 		} else {
 			if err.Error() == unknownErrorMessage {
-				return 0, errDisconnect
+				return 0, ErrDisconnected
 			}
 			return 0, err
 		}
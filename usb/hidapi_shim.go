@@ -15,7 +15,7 @@ const HIDUse = false
 type HIDAPI struct {
 }
 
-func InitHIDAPI(mw *memorywriter.MemoryWriter) (*HIDAPI, error) {
+func InitHIDAPI(mw *memorywriter.MemoryWriter, filter *Filter) (*HIDAPI, error) {
 	return &HIDAPI{}, nil
 }
 
@@ -0,0 +1,328 @@
+//go:build linux
+// +build linux
+
+package usb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/udev"
+)
+
+// Backend for T1 HID devices on linux, using /dev/hidraw* directly,
+// without cgo and without detaching the kernel driver.
+// Devices are found in sysfs, as in udev check.
+
+const (
+	hidrawPrefix    = "hidraw"
+	HIDRawAvailable = true
+
+	// item tag of "Report ID" in HID report descriptor, with 1 byte of data
+	hidReportIDItem = 0x85
+)
+
+type HIDRaw struct {
+	mw     *memorywriter.MemoryWriter
+	filter *Filter
+
+	root string // "/", different only in tests
+}
+
+type hidrawInfo struct {
+	node    string // /dev/hidrawN
+	sysPath string // sysfs directory of the HID device
+	port    string // port path, like 1-2.3
+	vid     int
+	pid     int
+	bcd     uint16
+	iface   int
+	serial  string
+	typ     core.DeviceType
+}
+
+func InitHIDRaw(mw *memorywriter.MemoryWriter, filter *Filter) (*HIDRaw, error) {
+	return initHIDRaw(mw, filter, "/")
+}
+
+func initHIDRaw(mw *memorywriter.MemoryWriter, filter *Filter, root string) (*HIDRaw, error) {
+	_, err := os.Stat(filepath.Join(root, "sys", "class"))
+	if err != nil {
+		return nil, fmt.Errorf("hidraw: sysfs not available: %w", err)
+	}
+	return &HIDRaw{
+		mw:     mw,
+		filter: filter,
+		root:   root,
+	}, nil
+}
+
+func (b *HIDRaw) Enumerate() ([]core.USBInfo, error) {
+	devs, err := b.devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []core.USBInfo
+	for _, dev := range devs {
+		infos = append(infos, core.USBInfo{
+			Path:      b.identify(dev),
+			VendorID:  dev.vid,
+			ProductID: dev.pid,
+			Type:      dev.typ,
+			Debug:     false,
+			Serial:    dev.serial,
+		})
+	}
+	return infos, nil
+}
+
+// devices lists matched and not filtered devices
+func (b *HIDRaw) devices() ([]hidrawInfo, error) {
+	b.mw.Log("listing sysfs")
+	nodes, err := udev.HidrawDevices(b.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []hidrawInfo
+	for _, node := range nodes {
+		dev, err := b.readInfo(node)
+		if err != nil {
+			// device can disappear while reading; not fatal
+			b.mw.Log(fmt.Sprintf("skipping %s - %s", node.Name, err.Error()))
+			continue
+		}
+		m, model := b.match(dev)
+		if !m {
+			continue
+		}
+		dev.typ = model.Type
+		if !b.filter.check(filterDevice{
+			bus:    busHIDRaw,
+			port:   dev.port,
+			serial: dev.serial,
+			typ:    model.Type,
+		}, b.mw) {
+			continue
+		}
+		res = append(res, dev)
+	}
+	return res, nil
+}
+
+func (b *HIDRaw) match(dev hidrawInfo) (bool, core.Model) {
+	model, ok := core.FindModel(dev.vid, dev.pid, dev.bcd)
+	if !ok || model.Interface != core.InterfaceHID {
+		return false, core.Model{}
+	}
+	matched := dev.iface == int(model.USBInterface.Number)
+	b.mw.Log(fmt.Sprintf("matched hidraw %s - %t", model.ID, matched))
+	return matched, model
+}
+
+// Reads the rest of the info from sysfs; the class directory links to the HID
+// device, which is a child of the USB interface, which is a child of the USB device:
+//
+//	/sys/class/hidraw/hidraw0/device -> .../1-2/1-2:1.0/0003:534C:0001.0005
+func (b *HIDRaw) readInfo(node udev.Device) (hidrawInfo, error) {
+	sysPath, err := filepath.EvalSymlinks(filepath.Join(node.Dir, "device"))
+	if err != nil {
+		return hidrawInfo{}, err
+	}
+
+	uevent, err := udev.ReadUevent(filepath.Join(sysPath, "uevent"))
+	if err != nil {
+		return hidrawInfo{}, err
+	}
+
+	ifaceDir := filepath.Dir(sysPath)
+	iface, err := udev.ReadSysfs(filepath.Join(ifaceDir, "bInterfaceNumber"), 16)
+	if err != nil {
+		return hidrawInfo{}, err
+	}
+
+	usbDir := filepath.Dir(ifaceDir)
+	bcd, err := udev.ReadSysfs(filepath.Join(usbDir, "bcdDevice"), 16)
+	if err != nil {
+		return hidrawInfo{}, err
+	}
+
+	return hidrawInfo{
+		node:    filepath.Join(b.root, node.Node),
+		sysPath: sysPath,
+		port:    filepath.Base(usbDir),
+		vid:     node.ID.Vendor,
+		pid:     node.ID.Product,
+		bcd:     uint16(bcd),
+		iface:   int(iface),
+		// usbhid fills uniq from the serial number string
+		serial: uevent["HID_UNIQ"],
+	}, nil
+}
+
+func (b *HIDRaw) identify(dev hidrawInfo) string {
+	// sysfs path of the HID device has the instance number at the end,
+	// so it changes on reconnect
+	digest := sha256.Sum256([]byte(dev.sysPath))
+	return hidrawPrefix + hex.EncodeToString(digest[:])
+}
+
+func (b *HIDRaw) describe() (string, string) {
+	return busHIDRaw, ""
+}
+
+func (b *HIDRaw) Has(path string) bool {
+	return strings.HasPrefix(path, hidrawPrefix)
+}
+
+func (b *HIDRaw) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	if debug {
+		return nil, ErrNotDebug
+	}
+	devs, err := b.devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devs {
+		if b.identify(dev) != path {
+			continue
+		}
+		b.mw.Log("detecting report IDs")
+		numbered, err := hasReportIDs(filepath.Join(dev.sysPath, "report_descriptor"))
+		if err != nil {
+			return nil, err
+		}
+		b.mw.Log("opening " + dev.node)
+		f, err := os.OpenFile(dev.node, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		b.mw.Log(fmt.Sprintf("done (numbered reports %t)", numbered))
+		return &HIDRawDevice{
+			f:        f,
+			numbered: numbered,
+			mw:       b.mw,
+		}, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Old T1 firmware uses report ID 63 ('?'), which is also the first byte
+// of each packet; newer firmware has no report IDs, and hidraw then
+// expects 0 as the first byte of each write.
+// This is the same difference as "prepend" in hidapi on windows.
+func hasReportIDs(filename string) (bool, error) {
+	desc, err := os.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < len(desc); {
+		prefix := desc[i]
+		if prefix == 0xfe {
+			// long item; size is in the next byte
+			if i+1 >= len(desc) {
+				break
+			}
+			i += 3 + int(desc[i+1])
+			continue
+		}
+		if prefix == hidReportIDItem {
+			return true, nil
+		}
+		size := int(prefix & 0x03)
+		if size == 3 {
+			size = 4
+		}
+		i += 1 + size
+	}
+	return false, nil
+}
+
+func (b *HIDRaw) Close() {
+	// nothing
+}
+
+type HIDRawDevice struct {
+	f        *os.File
+	numbered bool
+
+	closed int32 // atomic
+
+	mw *memorywriter.MemoryWriter
+}
+
+func (d *HIDRawDevice) Close(disconnected bool) error {
+	d.mw.Log("storing d.closed")
+	atomic.StoreInt32(&d.closed, 1)
+
+	// closing the file also unblocks the pending read
+	d.mw.Log("low level close")
+	err := d.f.Close()
+	d.mw.Log("done")
+	return err
+}
+
+func (d *HIDRawDevice) mapError(err error) error {
+	if atomic.LoadInt32(&d.closed) == 1 {
+		return ErrClosedDevice
+	}
+	if errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.EIO) {
+		return ErrDisconnected
+	}
+	return err
+}
+
+func (d *HIDRawDevice) SetReadDeadline(t time.Time) error {
+	return d.f.SetReadDeadline(t)
+}
+
+func (d *HIDRawDevice) Write(buf []byte) (int, error) {
+	d.mw.Log("write start")
+	if atomic.LoadInt32(&d.closed) == 1 {
+		return 0, ErrClosedDevice
+	}
+	report := buf
+	if !d.numbered {
+		report = append([]byte{0}, buf...)
+	}
+	w, err := d.f.Write(report)
+	if err != nil {
+		return 0, d.mapError(err)
+	}
+	if !d.numbered {
+		w--
+	}
+	if w <= 0 {
+		return 0, errors.New("hidraw - empty write")
+	}
+	return w, nil
+}
+
+func (d *HIDRawDevice) Read(buf []byte) (int, error) {
+	d.mw.Log("read start")
+	for {
+		if atomic.LoadInt32(&d.closed) == 1 {
+			return 0, ErrClosedDevice
+		}
+		r, err := d.f.Read(buf)
+		if err != nil {
+			return 0, d.mapError(err)
+		}
+		// sometimes, empty report is read, skip it
+		if r > 0 {
+			return r, nil
+		}
+		d.mw.Log("skipping empty transfer - go again")
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+// shim for other systems than linux, hidraw is linux-only
+
+package usb
+
+import (
+	"errors"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+)
+
+const HIDRawAvailable = false
+
+type HIDRaw struct {
+}
+
+func InitHIDRaw(mw *memorywriter.MemoryWriter, filter *Filter) (*HIDRaw, error) {
+	return nil, errors.New("hidraw is available only on linux")
+}
+
+func (b *HIDRaw) Enumerate() ([]core.USBInfo, error) {
+	panic("not implemented outside linux")
+}
+
+func (b *HIDRaw) Has(path string) bool {
+	panic("not implemented outside linux")
+}
+
+func (b *HIDRaw) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	panic("not implemented outside linux")
+}
+
+func (b *HIDRaw) Close() {
+	panic("not implemented outside linux")
+}
@@ -0,0 +1,157 @@
+//go:build linux
+// +build linux
+
+package usb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/udev/udevtest"
+)
+
+// report descriptor of T1 without report IDs (shortened)
+var t1ReportDescriptor = []byte{0x06, 0x00, 0xff, 0x09, 0x01, 0xa1, 0x01, 0x09, 0x20, 0x15, 0x00, 0x26, 0xff, 0x00, 0x75, 0x08, 0x95, 0x40, 0x81, 0x02, 0xc0}
+
+// the same with report ID 63
+var t1OldReportDescriptor = []byte{0x06, 0x00, 0xff, 0x09, 0x01, 0xa1, 0x01, 0x85, 0x3f, 0x09, 0x20, 0x75, 0x08, 0x95, 0x3f, 0x81, 0x02, 0xc0}
+
+type fakeHidraw struct {
+	node     string
+	port     string
+	hidID    string
+	iface    int
+	serial   string
+	reportID bool
+}
+
+// makeFakeSysfs returns a root with the hidraw nodes, on T1 USB devices
+func makeFakeSysfs(t *testing.T, devs []fakeHidraw) string {
+	root := t.TempDir()
+	ports := make(map[string]bool)
+	for _, d := range devs {
+		if !ports[d.port] {
+			ports[d.port] = true
+			udevtest.AddUSB(t, root, udevtest.USBDevice{
+				Name: d.port, Vendor: "534c", Product: "0001", BCD: "0100", Devnum: "1",
+			})
+		}
+		desc := t1ReportDescriptor
+		if d.reportID {
+			desc = t1OldReportDescriptor
+		}
+		udevtest.AddHidraw(t, root, udevtest.Hidraw{
+			Node:             d.node,
+			Port:             d.port,
+			Interface:        d.iface,
+			HIDID:            d.hidID,
+			Serial:           d.serial,
+			ReportDescriptor: desc,
+		})
+	}
+	return root
+}
+
+func TestHIDRawEnumerate(t *testing.T) {
+	root := makeFakeSysfs(t, []fakeHidraw{
+		{node: "hidraw0", port: "1-2", hidID: "0003:0000534C:00000001", iface: 0, serial: "ABC"},
+		// keyboard
+		{node: "hidraw1", port: "1-3", hidID: "0003:0000046D:0000C31C", iface: 0},
+		// second interface of a trezor
+		{node: "hidraw2", port: "1-2", hidID: "0003:0000534C:00000001", iface: 1},
+		// bluetooth
+		{node: "hidraw3", port: "1-4", hidID: "0005:0000534C:00000001", iface: 0},
+		{node: "hidraw4", port: "1-5", hidID: "0003:0000534C:00000001", iface: 0, serial: "DEF"},
+	})
+	mw := memorywriter.New(100, 10, false, nil)
+
+	b, err := initHIDRaw(mw, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := b.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 devices, got %+v", infos)
+	}
+	for _, info := range infos {
+		if info.Type != core.TypeT1Hid || info.VendorID != core.VendorT1 || !b.Has(info.Path) {
+			t.Errorf("wrong info %+v", info)
+		}
+	}
+
+	filtered, err := initHIDRaw(mw, &Filter{Deny: FilterRules{Ports: []string{"1-5"}}}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = filtered.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Serial != "ABC" {
+		t.Fatalf("expected only device on 1-2, got %+v", infos)
+	}
+}
+
+func TestHIDRawWrite(t *testing.T) {
+	root := makeFakeSysfs(t, []fakeHidraw{
+		{node: "hidraw0", port: "1-2", hidID: "0003:0000534C:00000001", iface: 0},
+		{node: "hidraw1", port: "1-3", hidID: "0003:0000534C:00000001", iface: 0, reportID: true},
+	})
+	mw := memorywriter.New(100, 10, false, nil)
+	b, err := initHIDRaw(mw, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := b.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := append([]byte{'?', '#', '#'}, bytes.Repeat([]byte{1}, 61)...)
+	for _, info := range infos {
+		d, err := b.Connect(info.Path, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := d.Write(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != len(packet) {
+			t.Errorf("expected %d written, got %d", len(packet), w)
+		}
+		err = d.Close(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = d.Write(packet); err != ErrClosedDevice {
+			t.Errorf("expected closed device error, got %v", err)
+		}
+	}
+
+	written, err := os.ReadFile(filepath.Join(root, "dev", "hidraw0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, append([]byte{0}, packet...)) {
+		t.Errorf("report without IDs should be prepended with 0, got %x", written)
+	}
+	written, err = os.ReadFile(filepath.Join(root, "dev", "hidraw1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, packet) {
+		t.Errorf("report with ID 63 should be written as is, got %x", written)
+	}
+
+	if _, err = b.Connect(infos[0].Path, true, false); err != ErrNotDebug {
+		t.Errorf("expected not debug error, got %v", err)
+	}
+}
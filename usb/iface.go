@@ -0,0 +1,7 @@
+package usb
+
+// Interface layout of Trezor devices is in core.Model,
+// used by both libusb and usbfs backends (and hidapi/hidraw
+// for interface number)
+
+const usbConfigNum = 1
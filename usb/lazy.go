@@ -0,0 +1,98 @@
+package usb
+
+import (
+	"sync"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// Lazy initializes the buses on the first use, so that
+// a socket-activated bridge holds no USB resources
+// until the first request comes.
+type Lazy struct {
+	init func() ([]core.USBBus, error)
+
+	mutex sync.Mutex
+	bus   *USB
+}
+
+func InitLazy(init func() ([]core.USBBus, error)) *Lazy {
+	return &Lazy{
+		init: init,
+	}
+}
+
+// get returns the initialized buses; on error,
+// initialization is tried again on next use
+func (b *Lazy) get() (*USB, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.bus == nil {
+		buses, err := b.init()
+		if err != nil {
+			return nil, err
+		}
+		b.bus = Init(buses...)
+	}
+	return b.bus, nil
+}
+
+// Init initializes the buses now, if they are not yet
+func (b *Lazy) Init() error {
+	_, err := b.get()
+	return err
+}
+
+func (b *Lazy) Initialized() bool {
+	return b.initialized() != nil
+}
+
+// initialized returns the buses, or nil before initialization
+func (b *Lazy) initialized() *USB {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.bus
+}
+
+func (b *Lazy) Enumerate() ([]core.USBInfo, error) {
+	bus, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Enumerate()
+}
+
+func (b *Lazy) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	bus, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	return bus.Connect(path, debug, reset)
+}
+
+func (b *Lazy) Has(path string) bool {
+	// before initialization, nothing was enumerated,
+	// so no path can belong to us
+	bus := b.initialized()
+	if bus == nil {
+		return false
+	}
+	return bus.Has(path)
+}
+
+func (b *Lazy) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.bus != nil {
+		b.bus.Close()
+	}
+}
+
+// BusStatus is empty before the buses are initialized
+func (b *Lazy) BusStatus() []core.BusStatus {
+	bus := b.initialized()
+	if bus == nil {
+		return nil
+	}
+	return bus.BusStatus()
+}
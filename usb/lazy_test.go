@@ -0,0 +1,34 @@
+package usb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+func TestLazyRetry(t *testing.T) {
+	calls := 0
+	b := InitLazy(func() ([]core.USBBus, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("not yet")
+		}
+		return nil, nil
+	})
+	if b.Has("udp1") || b.BusStatus() != nil {
+		t.Errorf("uninitialized bus has devices")
+	}
+	if err := b.Init(); err == nil {
+		t.Errorf("expected first init to fail")
+	}
+	if b.Initialized() {
+		t.Errorf("initialized after failed init")
+	}
+	if _, err := b.Enumerate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Init(); err != nil || !b.Initialized() || calls != 2 {
+		t.Errorf("expected one successful init, got %v, %d calls", err, calls)
+	}
+}
@@ -1,11 +1,18 @@
+//go:build !linux || !usbfs
+// +build !linux !usbfs
+
 package usb
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	lowlevel "github.com/trezor/trezord-go/usb/lowlevel/libusb"
 
@@ -15,50 +22,31 @@ import (
 
 const (
 	libusbPrefix   = "lib"
-	usbConfigNum   = 1
 	usbConfigIndex = 0
 )
 
-type libusbIfaceData struct {
-	number     uint8
-	altSetting uint8
-	epIn       uint8
-	epOut      uint8
-}
-
-var normalIface = libusbIfaceData{
-	number:     0,
-	altSetting: 0,
-	epIn:       0x81,
-	epOut:      0x01,
-}
-
-// Old bootloader has different epOut
-// We need it here, since on Linux,
-// we use libusb instead of hidapi for old BL
-var oldBLIface = libusbIfaceData{
-	number:     0,
-	altSetting: 0,
-	epIn:       0x81,
-	epOut:      0x02,
-}
-
-var debugIface = libusbIfaceData{
-	number:     1,
-	altSetting: 0,
-	epIn:       0x82,
-	epOut:      0x02,
-}
-
 type LibUSB struct {
 	usb    lowlevel.Context
 	mw     *memorywriter.MemoryWriter
 	only   bool
 	cancel bool
 	detach bool
+	filter *Filter
+
+	// reading serial number needs opening the device (except on linux,
+	// where it is in sysfs), so we read it only once per port path
+	// and remember it, or the failure, until the device disappears.
+	// Enumerate is never run concurrently (it is locked in core),
+	// so this does not need a mutex.
+	serials map[string]libusbSerial
 }
 
-func InitLibUSB(mw *memorywriter.MemoryWriter, onlyLibusb, allowCancel, detach bool) (*LibUSB, error) {
+type libusbSerial struct {
+	serial string
+	ok     bool
+}
+
+func InitLibUSB(mw *memorywriter.MemoryWriter, onlyLibusb, allowCancel, detach bool, filter *Filter) (*LibUSB, error) {
 	var usb lowlevel.Context
 	mw.Log("init")
 	lowlevel.SetLogWriter(mw)
@@ -79,15 +67,24 @@ Original error: %v`, err)
 		only:   onlyLibusb,
 		cancel: allowCancel,
 		detach: detach,
+		filter: filter,
+
+		serials: make(map[string]libusbSerial),
 	}, nil
 }
 
+// InitNativeUSB inits the backend for non-HID USB devices;
+// it is libusb, unless built with -tags usbfs on linux
+func InitNativeUSB(mw *memorywriter.MemoryWriter, onlyNative, allowCancel, detach bool, filter *Filter) (core.USBBus, error) {
+	return InitLibUSB(mw, onlyNative, allowCancel, detach, filter)
+}
+
 func (b *LibUSB) Close() {
 	b.mw.Log("all close (should happen only on exit)")
 	lowlevel.Exit(b.usb)
 }
 
-func hasIface(dev lowlevel.Device, dIface libusbIfaceData, dClass uint8) (bool, error) {
+func hasIface(dev lowlevel.Device, dIface core.USBInterface, dClass uint8) (bool, error) {
 	config, err := lowlevel.Get_Config_Descriptor(dev, usbConfigIndex)
 	if err != nil {
 		return false, err
@@ -97,12 +94,12 @@ func hasIface(dev lowlevel.Device, dIface libusbIfaceData, dClass uint8) (bool,
 	ifaces := config.Interface
 	for _, iface := range ifaces {
 		for _, alt := range iface.Altsetting {
-			if alt.BInterfaceNumber == dIface.number &&
-				alt.BAlternateSetting == dIface.altSetting &&
+			if alt.BInterfaceNumber == dIface.Number &&
+				alt.BAlternateSetting == dIface.AltSetting &&
 				alt.BNumEndpoints == 2 &&
 				alt.BInterfaceClass == dClass &&
-				alt.Endpoint[0].BEndpointAddress == dIface.epIn &&
-				alt.Endpoint[1].BEndpointAddress == dIface.epOut {
+				alt.Endpoint[0].BEndpointAddress == dIface.EpIn &&
+				alt.Endpoint[1].BEndpointAddress == dIface.EpOut {
 				return true, nil
 			}
 		}
@@ -110,12 +107,15 @@ func hasIface(dev lowlevel.Device, dIface libusbIfaceData, dClass uint8) (bool,
 	return false, nil
 }
 
-func detectDebug(dev lowlevel.Device) (bool, error) {
-	return hasIface(dev, debugIface, uint8(lowlevel.CLASS_VENDOR_SPEC))
+func detectDebug(dev lowlevel.Device, model core.Model) (bool, error) {
+	return hasIface(dev, model.DebugUSBInterface, uint8(lowlevel.CLASS_VENDOR_SPEC))
 }
 
-func detectOldBL(dev lowlevel.Device) (bool, error) {
-	return hasIface(dev, oldBLIface, uint8(lowlevel.CLASS_HID))
+func detectOldBL(dev lowlevel.Device, model core.Model) (bool, error) {
+	if model.OldBootloaderUSBInterface == nil {
+		return false, nil
+	}
+	return hasIface(dev, *model.OldBootloaderUSBInterface, uint8(lowlevel.CLASS_HID))
 }
 
 func (b *LibUSB) Enumerate() ([]core.USBInfo, error) {
@@ -141,9 +141,10 @@ func (b *LibUSB) Enumerate() ([]core.USBInfo, error) {
 	// however, 2.0.12 has other problems with windows, so we
 	// patchfix it here
 	paths := make(map[string]bool)
+	serials := make(map[string]libusbSerial)
 
 	for _, dev := range list {
-		m, t := b.match(dev)
+		m, model := b.match(dev)
 		if m {
 			b.mw.Log("getting device descriptor")
 			dd, err := lowlevel.Get_Device_Descriptor(dev)
@@ -154,25 +155,90 @@ func (b *LibUSB) Enumerate() ([]core.USBInfo, error) {
 			path := b.identify(dev)
 			inset := paths[path]
 			if !inset {
-				debug, err := detectDebug(dev)
-				if err != nil {
-					b.mw.Log("error detecting debug " + err.Error())
+				fdev := filterDevice{
+					bus:  busLibUSB,
+					port: b.portPath(dev),
+					typ:  model.Type,
+				}
+				// check before opening the device for serial
+				if !b.filter.checkBeforeSerial(fdev, b.mw) {
+					continue
+				}
+				debug := false
+				if model.DebugLink {
+					debug, err = detectDebug(dev, model)
+					if err != nil {
+						b.mw.Log("error detecting debug " + err.Error())
+						continue
+					}
+				}
+				serial, ok := b.serial(dev, dd, path, fdev.port)
+				serials[path] = libusbSerial{serial: serial, ok: ok}
+				fdev.serial = serial
+				if !b.filter.check(fdev, b.mw) {
 					continue
 				}
 				infos = append(infos, core.USBInfo{
 					Path:      path,
 					VendorID:  int(dd.IDVendor),
 					ProductID: int(dd.IDProduct),
-					Type:      t,
+					Type:      model.Type,
 					Debug:     debug,
+					Serial:    serial,
 				})
 				paths[path] = true
 			}
 		}
 	}
+	b.serials = serials
 	return infos, nil
 }
 
+// Returns USB serial number of the device, or empty string
+// if the device has none; ok is false if it could not be read.
+// On linux, the serial is read from sysfs. Elsewhere, the device
+// might be already in use, so it is opened only if there is
+// a serial filter, and only if it was not seen on the same path
+// in the previous enumeration.
+func (b *LibUSB) serial(
+	dev lowlevel.Device,
+	dd *lowlevel.Device_Descriptor,
+	path string,
+	port string,
+) (serial string, ok bool) {
+	if cached, seen := b.serials[path]; seen {
+		return cached.serial, cached.ok
+	}
+	if dd.ISerialNumber == 0 {
+		return "", true
+	}
+	if serial, ok := sysfsSerial(sysfsUSBDevices, port); ok {
+		return serial, true
+	}
+	if !b.filter.hasSerials() {
+		return "", false
+	}
+	b.mw.Log("opening to read serial")
+	d, err := lowlevel.Open(dev)
+	if err != nil {
+		b.mw.Log("error opening device for serial " + err.Error())
+		return "", false
+	}
+	defer lowlevel.Close(d)
+
+	var buf [256]byte
+	s, err := lowlevel.Get_String_Descriptor_ASCII(d, dd.ISerialNumber, buf[:])
+	if err != nil {
+		b.mw.Log("error reading serial " + err.Error())
+		return "", false
+	}
+	return string(s), true
+}
+
+func (b *LibUSB) describe() (string, string) {
+	return busLibUSB, ""
+}
+
 func (b *LibUSB) Has(path string) bool {
 	return strings.HasPrefix(path, libusbPrefix)
 }
@@ -198,16 +264,18 @@ func (b *LibUSB) Connect(path string, debug bool, reset bool) (core.USBDevice, e
 	// however, 2.0.12 has other problems with windows, so we
 	// patchfix it here
 	mydevs := make([]lowlevel.Device, 0)
+	models := make([]core.Model, 0)
 	for _, dev := range list {
-		m, _ := b.match(dev)
+		m, model := b.match(dev)
 		if m && b.identify(dev) == path {
 			mydevs = append(mydevs, dev)
+			models = append(models, model)
 		}
 	}
 
 	err = ErrNotFound
-	for _, dev := range mydevs {
-		res, errConn := b.connect(dev, debug, reset)
+	for i, dev := range mydevs {
+		res, errConn := b.connect(dev, models[i], debug, reset)
 		if errConn == nil {
 			return res, nil
 		}
@@ -244,12 +312,9 @@ func (b *LibUSB) setConfiguration(d lowlevel.Device_Handle) {
 	}
 }
 
-func (b *LibUSB) claimInterface(d lowlevel.Device_Handle, debug bool) (bool, error) {
+func (b *LibUSB) claimInterface(d lowlevel.Device_Handle, iface core.USBInterface) (bool, error) {
 	attach := false
-	usbIfaceNum := int(normalIface.number)
-	if debug {
-		usbIfaceNum = int(debugIface.number)
-	}
+	usbIfaceNum := int(iface.Number)
 	if b.detach {
 		b.mw.Log("detecting kernel driver")
 		kernel, errD := lowlevel.Kernel_Driver_Active(d, usbIfaceNum)
@@ -282,13 +347,20 @@ func (b *LibUSB) claimInterface(d lowlevel.Device_Handle, debug bool) (bool, err
 	return attach, nil
 }
 
-func (b *LibUSB) connect(dev lowlevel.Device, debug bool, reset bool) (*LibUSBDevice, error) {
+func (b *LibUSB) connect(dev lowlevel.Device, model core.Model, debug bool, reset bool) (*LibUSBDevice, error) {
 
 	b.mw.Log("detect old BL")
-	oldBL, err := detectOldBL(dev)
+	oldBL, err := detectOldBL(dev, model)
 	if err != nil {
 		return nil, err
 	}
+	iface := model.USBInterface
+	if oldBL {
+		iface = *model.OldBootloaderUSBInterface
+	}
+	if debug {
+		iface = model.DebugUSBInterface
+	}
 
 	b.mw.Log("low level")
 	d, err := lowlevel.Open(dev)
@@ -307,7 +379,7 @@ func (b *LibUSB) connect(dev lowlevel.Device, debug bool, reset bool) (*LibUSBDe
 	}
 
 	b.setConfiguration(d)
-	attach, err := b.claimInterface(d, debug)
+	attach, err := b.claimInterface(d, iface)
 	if err != nil {
 		return nil, err
 	}
@@ -319,58 +391,37 @@ func (b *LibUSB) connect(dev lowlevel.Device, debug bool, reset bool) (*LibUSBDe
 		cancel: b.cancel,
 		attach: attach,
 		debug:  debug,
-		oldBL:  oldBL,
+		iface:  iface,
 	}, nil
 }
 
-func matchType(dd *lowlevel.Device_Descriptor) core.DeviceType {
-	if dd.IDProduct == core.ProductT1Firmware {
-		// this is HID, in platforms where we don't use hidapi (linux, bsd)
-		return core.TypeT1Hid
-	}
-
-	if dd.IDProduct == core.ProductT2Bootloader {
-		if int(dd.BcdDevice>>8) == 1 {
-			return core.TypeT1WebusbBoot
-		}
-		return core.TypeT2Boot
-	}
-
-	if int(dd.BcdDevice>>8) == 1 {
-		return core.TypeT1Webusb
-	}
-
-	return core.TypeT2
-}
-
-func (b *LibUSB) match(dev lowlevel.Device) (bool, core.DeviceType) {
+func (b *LibUSB) match(dev lowlevel.Device) (bool, core.Model) {
 	b.mw.Log("start")
 	dd, err := lowlevel.Get_Device_Descriptor(dev)
 	if err != nil {
 		b.mw.Log("error getting descriptor -" + err.Error())
-		return false, 0
+		return false, core.Model{}
 	}
 
-	vid := dd.IDVendor
-	pid := dd.IDProduct
-	if !b.matchVidPid(vid, pid) {
+	model, ok := b.matchModel(dd)
+	if !ok {
 		b.mw.Log("unmatched")
-		return false, 0
+		return false, core.Model{}
 	}
 
 	b.mw.Log("matched, get active config")
 	c, err := lowlevel.Get_Active_Config_Descriptor(dev)
 	if err != nil {
 		b.mw.Log("error getting config descriptor " + err.Error())
-		return false, 0
+		return false, core.Model{}
 	}
 	defer lowlevel.Free_Config_Descriptor(c)
 
 	b.mw.Log("let's test")
 
 	var is bool
-	usbIfaceNum := normalIface.number
-	usbAltSetting := normalIface.altSetting
+	usbIfaceNum := model.USBInterface.Number
+	usbAltSetting := model.USBInterface.AltSetting
 	if b.only {
 
 		// if we don't use hidapi at all, keep HID devices
@@ -386,23 +437,25 @@ func (b *LibUSB) match(dev lowlevel.Device) (bool, core.DeviceType) {
 
 	if !is {
 		b.mw.Log("not matched")
-		return false, 0
+		return false, core.Model{}
 	}
-	b.mw.Log("matched")
-	return true, matchType(dd)
+	b.mw.Log(fmt.Sprintf("matched %s", model.ID))
+	return true, model
 
 }
 
-func (b *LibUSB) matchVidPid(vid uint16, pid uint16) bool {
-	// Note: Trezor1 libusb will actually have the T2 vid/pid
-	trezor2 := vid == core.VendorT2 && (pid == core.ProductT2Firmware || pid == core.ProductT2Bootloader)
-
-	if b.only {
-		trezor1 := vid == core.VendorT1 && (pid == core.ProductT1Firmware)
-		return trezor1 || trezor2
+func (b *LibUSB) matchModel(dd *lowlevel.Device_Descriptor) (core.Model, bool) {
+	model, ok := core.FindModel(int(dd.IDVendor), int(dd.IDProduct), dd.BcdDevice)
+	if !ok {
+		return model, false
 	}
 
-	return trezor2
+	// Note: Trezor1 libusb will actually have the T2 vid/pid,
+	// HID devices are read by hidapi where we have it
+	if model.Interface == core.InterfaceHID && !b.only {
+		return model, false
+	}
+	return model, true
 }
 
 func (b *LibUSB) identify(dev lowlevel.Device) string {
@@ -415,6 +468,24 @@ func (b *LibUSB) identify(dev lowlevel.Device) string {
 	return libusbPrefix + hex.EncodeToString(p)
 }
 
+// Port path in the format used by linux sysfs, for example 1-2.3
+func (b *LibUSB) portPath(dev lowlevel.Device) string {
+	var ports [8]byte
+	p, err := lowlevel.Get_Port_Numbers(dev, ports[:])
+	if err != nil {
+		b.mw.Log(fmt.Sprintf("error getting port numbers %s", err.Error()))
+		return ""
+	}
+	res := strconv.Itoa(int(lowlevel.Get_Bus_Number(dev))) + "-"
+	for i, port := range p {
+		if i > 0 {
+			res += "."
+		}
+		res += strconv.Itoa(int(port))
+	}
+	return res
+}
+
 type LibUSBDevice struct {
 	dev lowlevel.Device_Handle
 
@@ -429,7 +500,10 @@ type LibUSBDevice struct {
 	attach bool
 	debug  bool
 
-	oldBL bool
+	// interface in use, normal or debug
+	iface core.USBInterface
+
+	readDeadline
 
 	mw *memorywriter.MemoryWriter
 }
@@ -453,15 +527,12 @@ func (d *LibUSBDevice) Close(disconnected bool) error {
 		// (since when we don't allow cancelling, we don't allow session stealing)
 		if !disconnected {
 			d.mw.Log("finishing read queue")
-			d.finishReadQueue(d.debug)
+			d.finishReadQueue()
 		}
 	}
 
 	d.mw.Log("releasing interface")
-	iface := int(normalIface.number)
-	if d.debug {
-		iface = int(debugIface.number)
-	}
+	iface := int(d.iface.Number)
 	err := lowlevel.Release_Interface(d.dev, iface)
 	if err != nil {
 		// do not throw error, it is just release anyway
@@ -483,11 +554,10 @@ func (d *LibUSBDevice) Close(disconnected bool) error {
 	return nil
 }
 
-func (d *LibUSBDevice) finishReadQueue(debug bool) {
-	usbEpIn := normalIface.epIn
+func (d *LibUSBDevice) finishReadQueue() {
+	usbEpIn := d.iface.EpIn
 	mutex := &d.normalReadMutex
-	if debug {
-		usbEpIn = debugIface.epIn
+	if d.debug {
 		mutex = &d.debugReadMutex
 	}
 	mutex.Lock()
@@ -503,28 +573,48 @@ func (d *LibUSBDevice) finishReadQueue(debug bool) {
 	mutex.Unlock()
 }
 
-func (d *LibUSBDevice) readWrite(buf []byte, endpoint uint8, mutex sync.Locker) (int, error) {
+// deadline is nil for writes
+func (d *LibUSBDevice) readWrite(buf []byte, endpoint uint8, mutex sync.Locker, deadline *readDeadline) (int, error) {
 	d.mw.Log("start")
 	for {
 		d.mw.Log("checking closed")
 		closed := (atomic.LoadInt32(&d.closed)) == 1
 		if closed {
 			d.mw.Log("closed, skip")
-			return 0, errClosedDevice
+			return 0, ErrClosedDevice
+		}
+
+		var timeout uint
+		if deadline != nil {
+			left, err := deadline.timeout()
+			if err != nil {
+				d.mw.Log("deadline exceeded")
+				return 0, err
+			}
+			// rounded up, so that 0 (no timeout) is not used by mistake
+			timeout = uint((left + time.Millisecond - 1) / time.Millisecond)
 		}
 
 		mutex.Lock()
 		d.mw.Log("actual interrupt transport")
-		// This has no timeout, but is stopped by Cancel_Sync_Transfers_On_Device
-		p, err := lowlevel.Interrupt_Transfer(d.dev, endpoint, buf, 0)
+		// Without deadline, this has no timeout, but is stopped by Cancel_Sync_Transfers_On_Device
+		p, err := lowlevel.Interrupt_Transfer(d.dev, endpoint, buf, timeout)
 		mutex.Unlock()
 		d.mw.Log("single transfer done")
 
 		if err != nil {
 			d.mw.Log(fmt.Sprintf("error seen - %s", err.Error()))
+			if timeout != 0 && errors.Is(err, lowlevel.ErrTimeout) {
+				if len(p) > 0 {
+					// the packet came just before the timeout
+					return len(p), nil
+				}
+				d.mw.Log("deadline exceeded")
+				return 0, os.ErrDeadlineExceeded
+			}
 			if isErrorDisconnect(err) {
 				d.mw.Log("device probably disconnected")
-				return 0, errDisconnect
+				return 0, ErrDisconnected
 			}
 
 			d.mw.Log("other error")
@@ -547,33 +637,28 @@ func isErrorDisconnect(err error) bool {
 	// LIBUSB_ERROR_NO_DEVICE error, but in real life, it causes also
 	// LIBUSB_ERROR_IO, LIBUSB_ERROR_PIPE, LIBUSB_ERROR_OTHER
 
-	return (err.Error() == lowlevel.Error_Name(int(lowlevel.ERROR_IO)) ||
-		err.Error() == lowlevel.Error_Name(int(lowlevel.ERROR_NO_DEVICE)) ||
-		err.Error() == lowlevel.Error_Name(int(lowlevel.ERROR_OTHER)) ||
-		err.Error() == lowlevel.Error_Name(int(lowlevel.ERROR_PIPE)))
+	return errors.Is(err, lowlevel.ErrIO) ||
+		errors.Is(err, lowlevel.ErrNoDevice) ||
+		errors.Is(err, lowlevel.ErrOther) ||
+		errors.Is(err, lowlevel.ErrPipe)
 }
 
 func (d *LibUSBDevice) Write(buf []byte) (int, error) {
 	d.mw.Log("write start")
-	usbEpOut := normalIface.epOut
+	usbEpOut := d.iface.EpOut
 	mutex := &d.normalWriteMutex
-	if d.oldBL {
-		usbEpOut = oldBLIface.epOut
-	}
 	if d.debug {
-		usbEpOut = debugIface.epOut
 		mutex = &d.debugWriteMutex
 	}
-	return d.readWrite(buf, usbEpOut, mutex)
+	return d.readWrite(buf, usbEpOut, mutex, nil)
 }
 
 func (d *LibUSBDevice) Read(buf []byte) (int, error) {
 	d.mw.Log("read start")
-	usbEpIn := normalIface.epIn
+	usbEpIn := d.iface.EpIn
 	mutex := &d.normalReadMutex
 	if d.debug {
-		usbEpIn = debugIface.epIn
 		mutex = &d.debugReadMutex
 	}
-	return d.readWrite(buf, usbEpIn, mutex)
+	return d.readWrite(buf, usbEpIn, mutex, &d.readDeadline)
 }
@@ -0,0 +1,79 @@
+package usb
+
+import (
+	"fmt"
+
+	"github.com/trezor/trezord-go/core"
+)
+
+// LimitMessageSize limits the size of messages read from devices
+// of the buses. limits are by bus name, as in filters (libusb, hidapi, hidraw, usbfs, udp);
+// buses without a limit get def. Zero limit is wire.DefaultMaxMessageSize.
+func LimitMessageSize(buses []core.USBBus, limits map[string]uint32, def uint32) []core.USBBus {
+	res := make([]core.USBBus, 0, len(buses))
+	for _, bus := range buses {
+		name, _ := describe(bus)
+		size, ok := limits[name]
+		if !ok {
+			size = def
+		}
+		if size == 0 {
+			res = append(res, bus)
+			continue
+		}
+		res = append(res, &limitedBus{
+			USBBus:  bus,
+			maxSize: size,
+		})
+	}
+	return res
+}
+
+func describe(bus core.USBBus) (string, string) {
+	if d, ok := bus.(describedBus); ok {
+		return d.describe()
+	}
+	return fmt.Sprintf("%T", bus), ""
+}
+
+type limitedBus struct {
+	core.USBBus
+	maxSize uint32
+}
+
+func (b *limitedBus) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	d, err := b.USBBus.Connect(path, debug, reset)
+	if err != nil {
+		return nil, err
+	}
+	ld := &limitedDevice{
+		USBDevice: d,
+		maxSize:   b.maxSize,
+	}
+	// keep deadlines only on devices that have them
+	if dd, ok := d.(core.DeadlineDevice); ok {
+		return &limitedDeadlineDevice{
+			limitedDevice:  ld,
+			DeadlineDevice: dd,
+		}, nil
+	}
+	return ld, nil
+}
+
+func (b *limitedBus) describe() (string, string) {
+	return describe(b.USBBus)
+}
+
+type limitedDevice struct {
+	core.USBDevice
+	maxSize uint32
+}
+
+func (d *limitedDevice) MaxMessageSize() uint32 {
+	return d.maxSize
+}
+
+type limitedDeadlineDevice struct {
+	*limitedDevice
+	core.DeadlineDevice
+}
@@ -104,7 +104,9 @@ import "C"
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"syscall"
 	"unsafe"
 )
 
@@ -952,6 +954,29 @@ func (e *libusb_error) Error() string {
 	return Error_Name(e.Code)
 }
 
+// Is matches libusb errors by code, so the errors below work with errors.Is;
+// access, busy and no device errors also match the errors of the OS
+func (e *libusb_error) Is(target error) bool {
+	switch target {
+	case os.ErrPermission:
+		return e.Code == int(ERROR_ACCESS)
+	case syscall.EBUSY:
+		return e.Code == int(ERROR_BUSY)
+	case syscall.ENODEV:
+		return e.Code == int(ERROR_NO_DEVICE)
+	}
+	t, ok := target.(*libusb_error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	ErrTimeout  error = &libusb_error{int(ERROR_TIMEOUT)}
+	ErrIO       error = &libusb_error{int(ERROR_IO)}
+	ErrNoDevice error = &libusb_error{int(ERROR_NO_DEVICE)}
+	ErrPipe     error = &libusb_error{int(ERROR_PIPE)}
+	ErrOther    error = &libusb_error{int(ERROR_OTHER)}
+)
+
 //-----------------------------------------------------------------------------
 // Library initialization/deinitialization
 
@@ -1455,7 +1480,8 @@ func Interrupt_Transfer(hdl Device_Handle, endpoint uint8, data []byte, timeout
 	var transferred C.int
 	rc := int(C.libusb_interrupt_transfer(hdl, (C.uchar)(endpoint), (*C.uchar)(&data[0]), (C.int)(len(data)), &transferred, (C.uint)(timeout)))
 	if rc != 0 {
-		return nil, &libusb_error{rc}
+		// on timeout, some data could have been transferred
+		return data[:int(transferred)], &libusb_error{rc}
 	}
 	return data[:int(transferred)], nil
 }
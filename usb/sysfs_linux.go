@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package usb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/trezor/trezord-go/udev"
+)
+
+const sysfsUSBDevices = "/sys/bus/usb/devices"
+
+// sysfsSerial reads USB serial number of the device on port path
+// (like 1-2.3) from sysfs, without opening the device;
+// ok is false if sysfs does not have the device
+func sysfsSerial(root, port string) (serial string, ok bool) {
+	if port == "" {
+		return "", false
+	}
+	dir := filepath.Join(root, port)
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+	serial, err := udev.ReadSysfsString(filepath.Join(dir, "serial"))
+	if err != nil {
+		// the file is not present on devices without serial number
+		return "", errors.Is(err, os.ErrNotExist)
+	}
+	return serial, true
+}
@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package usb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/trezor/trezord-go/udev/udevtest"
+)
+
+func TestSysfsSerial(t *testing.T) {
+	root := t.TempDir()
+	udevtest.WriteFile(t, root, "1-2/serial", "ABC123\n")
+	err := os.MkdirAll(filepath.Join(root, "1-3"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		port   string
+		serial string
+		ok     bool
+	}{
+		{"1-2", "ABC123", true},
+		{"1-3", "", true}, // device without serial
+		{"1-4", "", false},
+		{"", "", false},
+	}
+	for _, tc := range testcases {
+		serial, ok := sysfsSerial(root, tc.port)
+		if serial != tc.serial || ok != tc.ok {
+			t.Errorf("%q: expected %q %v, got %q %v", tc.port, tc.serial, tc.ok, serial, ok)
+		}
+	}
+}
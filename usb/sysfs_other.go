@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package usb
+
+const sysfsUSBDevices = ""
+
+// sysfsSerial is available only on linux
+func sysfsSerial(root, port string) (serial string, ok bool) {
+	return "", false
+}
@@ -32,6 +32,7 @@ type udpLowlevel struct {
 type UDP struct {
 	ports     []PortTouple
 	lowlevels map[int]*udpLowlevel
+	filter    *Filter
 
 	mw *memorywriter.MemoryWriter
 }
@@ -81,10 +82,11 @@ func (udp *UDP) makeLowlevel(port int) error {
 	return nil
 }
 
-func InitUDP(ports []PortTouple, mw *memorywriter.MemoryWriter) (*UDP, error) {
+func InitUDP(ports []PortTouple, mw *memorywriter.MemoryWriter, filter *Filter) (*UDP, error) {
 	udp := UDP{
 		ports:     ports,
 		lowlevels: make(map[int](*udpLowlevel)),
+		filter:    filter,
 		mw:        mw,
 	}
 	for _, port := range ports {
@@ -120,6 +122,13 @@ func (udp *UDP) Enumerate() ([]core.USBInfo, error) {
 
 	udp.mw.Log("checking ports")
 	for _, port := range udp.ports {
+		if !udp.filter.check(filterDevice{
+			bus:  busUDP,
+			port: strconv.Itoa(port.Normal),
+			typ:  core.TypeEmulator,
+		}, udp.mw) {
+			continue
+		}
 		udp.mw.Log(fmt.Sprintf("check normal port %d", port.Normal))
 		normal := udp.lowlevels[port.Normal]
 		presentN, err := checkPort(normal.ping, normal.writer)
@@ -151,6 +160,18 @@ func (udp *UDP) Enumerate() ([]core.USBInfo, error) {
 	return infos, nil
 }
 
+func (udp *UDP) describe() (string, string) {
+	ports := make([]string, 0, len(udp.ports))
+	for _, port := range udp.ports {
+		p := strconv.Itoa(port.Normal)
+		if port.Debug != 0 {
+			p += ":" + strconv.Itoa(port.Debug)
+		}
+		ports = append(ports, p)
+	}
+	return busUDP, strings.Join(ports, ",")
+}
+
 func (udp *UDP) Has(path string) bool {
 	return strings.HasPrefix(path, emulatorPrefix)
 }
@@ -165,7 +186,7 @@ func (udp *UDP) Connect(path string, debug bool, reset bool) (core.USBDevice, er
 			return nil, err
 		}
 		if debugP == 0 {
-			return nil, errNotDebug
+			return nil, ErrNotDebug
 		}
 		port = debugP
 	} else {
@@ -189,6 +210,8 @@ type UDPDevice struct {
 	lowlevel *udpLowlevel
 
 	closed int32 // atomic
+
+	readDeadline
 }
 
 func (d *UDPDevice) Close(disconnected bool) error {
@@ -201,24 +224,33 @@ func (d *UDPDevice) readWrite(buf []byte, read bool) (int, error) {
 	for {
 		closed := (atomic.LoadInt32(&d.closed)) == 1
 		if closed {
-			return 0, errClosedDevice
+			return 0, ErrClosedDevice
 		}
 		check, err := checkPort(lowlevel.ping, lowlevel.writer)
 		if err != nil {
 			return 0, err
 		}
 		if !check {
-			return 0, errDisconnect
+			return 0, ErrDisconnected
 		}
 		if !read {
 			return lowlevel.writer.Write(buf)
 		}
 
+		wait := emulatorPingTimeout
+		left, err := d.timeout()
+		if err != nil {
+			return 0, err
+		}
+		if left > 0 && left < wait {
+			wait = left
+		}
+
 		select {
 		case response := <-lowlevel.data:
 			copy(buf, response)
 			return len(response), nil
-		case <-time.After(emulatorPingTimeout):
+		case <-time.After(wait):
 			// timeout, continue for cycle
 		}
 	}
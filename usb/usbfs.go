@@ -0,0 +1,797 @@
+//go:build linux && usbfs
+// +build linux,usbfs
+
+package usb
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/udev"
+)
+
+// Pure go backend for linux, talking to /dev/bus/usb with usbfs ioctls.
+// Used instead of libusb when built with -tags usbfs, so we don't need cgo.
+//
+// Devices are enumerated from sysfs, as in udev check, so enumeration
+// does not open anything;
+// transfers are asynchronous URBs, so they can be cancelled on close
+// (which is what our libusb patch Cancel_Sync_Transfers_On_Device does).
+
+const (
+	usbfsPrefix      = "usbfs"
+	usbfsPollTimeout = 100 * time.Millisecond
+
+	usbClassHID        = 0x03
+	usbClassVendorSpec = 0xff
+
+	usbfsURBTypeInterrupt = 1
+	usbfsMaxDriverName    = 256
+)
+
+// Linux ioctl number encoding, as in asm-generic/ioctl.h
+// (not correct for mips, powerpc and sparc, where we don't run)
+const (
+	iocNone  = 0
+	iocWrite = 1
+	iocRead  = 2
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'U'<<8 | nr
+}
+
+// struct usbdevfs_urb from linux/usbdevice_fs.h;
+// go alignment is the same as C alignment here
+type usbfsURB struct {
+	typ          uint8
+	endpoint     uint8
+	status       int32
+	_            uint32 // flags
+	buffer       uintptr
+	bufferLength int32
+	actualLength int32
+	_            int32   // start_frame
+	_            int32   // number_of_packets
+	_            int32   // error_count
+	_            uint32  // signr
+	_            uintptr // usercontext
+}
+
+// struct usbdevfs_ioctl
+type usbfsIoctl struct {
+	ifno int32
+	code int32
+	_    uintptr // data
+}
+
+// struct usbdevfs_getdriver
+type usbfsGetDriver struct {
+	iface uint32
+	_     [usbfsMaxDriverName]byte // driver name
+}
+
+var (
+	usbdevfsSetConfiguration = ioc(iocRead, 5, 4)
+	usbdevfsGetDriver        = ioc(iocWrite, 8, unsafe.Sizeof(usbfsGetDriver{}))
+	usbdevfsSubmitURB        = ioc(iocRead, 10, unsafe.Sizeof(usbfsURB{}))
+	usbdevfsDiscardURB       = ioc(iocNone, 11, 0)
+	usbdevfsReapURBNDelay    = ioc(iocWrite, 13, unsafe.Sizeof(uintptr(0)))
+	usbdevfsClaimInterface   = ioc(iocRead, 15, 4)
+	usbdevfsReleaseInterface = ioc(iocRead, 16, 4)
+	usbdevfsIoctl            = ioc(iocRead|iocWrite, 18, unsafe.Sizeof(usbfsIoctl{}))
+	usbdevfsReset            = ioc(iocNone, 20, 0)
+	usbdevfsDisconnect       = ioc(iocNone, 22, 0)
+	usbdevfsConnect          = ioc(iocNone, 23, 0)
+)
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// struct pollfd
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+const (
+	pollOut = 0x4
+	pollErr = 0x8
+	pollHup = 0x10
+)
+
+// usbfs signals finished URBs as "writable"
+func pollURBs(fd int, timeout time.Duration) (int16, error) {
+	pfd := pollFd{
+		fd:     int32(fd),
+		events: pollOut,
+	}
+	ts := syscall.NsecToTimespec(int64(timeout))
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return 0, errno
+	}
+	return pfd.revents, nil
+}
+
+type USBFS struct {
+	mw     *memorywriter.MemoryWriter
+	only   bool
+	detach bool
+	filter *Filter
+
+	root string // "/", different only in tests
+}
+
+type usbfsIface struct {
+	number     uint8
+	altSetting uint8
+	class      uint8
+	endpoints  map[uint8]bool
+}
+
+type usbfsInfo struct {
+	name    string // sysfs name, like 1-2.3
+	node    string // /dev/bus/usb/BBB/DDD
+	vid     int
+	pid     int
+	bcd     uint16
+	config  int
+	serial  string
+	ifaces  []usbfsIface
+	model   core.Model
+	ports   []byte
+	hasConf bool
+}
+
+func InitUSBFS(mw *memorywriter.MemoryWriter, onlyUSBFS, detach bool, filter *Filter) (*USBFS, error) {
+	return initUSBFS(mw, onlyUSBFS, detach, filter, "/")
+}
+
+func initUSBFS(mw *memorywriter.MemoryWriter, onlyUSBFS, detach bool, filter *Filter, root string) (*USBFS, error) {
+	mw.Log("init")
+	_, err := os.Stat(filepath.Join(root, "sys", "bus", "usb", "devices"))
+	if err != nil {
+		return nil, fmt.Errorf(`error when initializing usbfs.
+If you run trezord in an environment without USB (for example, docker or travis), use '-u=false'. For example, './trezord-go -e 21324 -u=false'.
+
+Original error: %v`, err)
+	}
+	return &USBFS{
+		mw:     mw,
+		only:   onlyUSBFS,
+		detach: detach,
+		filter: filter,
+		root:   root,
+	}, nil
+}
+
+// InitNativeUSB inits the backend for non-HID USB devices;
+// with -tags usbfs, it is usbfs
+func InitNativeUSB(mw *memorywriter.MemoryWriter, onlyNative, allowCancel, detach bool, filter *Filter) (core.USBBus, error) {
+	// usbfs can always cancel transfers
+	return InitUSBFS(mw, onlyNative, detach, filter)
+}
+
+func (b *USBFS) Close() {
+	b.mw.Log("all close (should happen only on exit)")
+}
+
+func (b *USBFS) Enumerate() ([]core.USBInfo, error) {
+	devs, err := b.devices()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]core.USBInfo, 0, len(devs))
+	for _, dev := range devs {
+		debug := false
+		if dev.model.DebugLink {
+			debug = hasUSBFSIface(dev, dev.model.DebugUSBInterface, usbClassVendorSpec)
+		}
+		infos = append(infos, core.USBInfo{
+			Path:      b.identify(dev),
+			VendorID:  dev.vid,
+			ProductID: dev.pid,
+			Type:      dev.model.Type,
+			Debug:     debug,
+			Serial:    dev.serial,
+		})
+	}
+	return infos, nil
+}
+
+// devices lists matched and not filtered devices
+func (b *USBFS) devices() ([]usbfsInfo, error) {
+	b.mw.Log("listing sysfs")
+	// only known models, without interfaces and root hubs
+	sysDevs, err := udev.USBDevices(b.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []usbfsInfo
+	for _, sysDev := range sysDevs {
+		dev, err := b.readInfo(sysDev)
+		if err != nil {
+			// device can disappear while reading; not fatal
+			b.mw.Log(fmt.Sprintf("skipping %s - %s", sysDev.Name, err.Error()))
+			continue
+		}
+		if !b.match(&dev) {
+			continue
+		}
+		if !b.filter.check(filterDevice{
+			bus:    busUSBFS,
+			port:   dev.name,
+			serial: dev.serial,
+			typ:    dev.model.Type,
+		}, b.mw) {
+			continue
+		}
+		res = append(res, dev)
+	}
+	return res, nil
+}
+
+// readInfo reads the configuration and interfaces of the device from sysfs
+func (b *USBFS) readInfo(sysDev udev.Device) (usbfsInfo, error) {
+	dir, name := sysDev.Dir, sysDev.Name
+	dev := usbfsInfo{
+		name: name,
+		node: filepath.Join(b.root, sysDev.Node),
+		vid:  sysDev.ID.Vendor,
+		pid:  sysDev.ID.Product,
+		bcd:  sysDev.BCD,
+	}
+	// unconfigured device has empty bConfigurationValue
+	config, err := udev.ReadSysfs(filepath.Join(dir, "bConfigurationValue"), 10)
+	dev.config, dev.hasConf = int(config), err == nil
+	// serial is not present on devices without serial number
+	dev.serial, _ = udev.ReadSysfsString(filepath.Join(dir, "serial"))
+
+	// 1-2.3 => ports 2, 3
+	split := strings.SplitN(name, "-", 2)
+	if len(split) != 2 {
+		return dev, fmt.Errorf("unknown device name %s", name)
+	}
+	for _, p := range strings.Split(split[1], ".") {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return dev, err
+		}
+		dev.ports = append(dev.ports, byte(port))
+	}
+
+	ifaceDirs, err := filepath.Glob(filepath.Join(dir, name+":*"))
+	if err != nil {
+		return dev, err
+	}
+	for _, ifaceDir := range ifaceDirs {
+		iface, err := readUSBFSIface(ifaceDir)
+		if err != nil {
+			return dev, err
+		}
+		dev.ifaces = append(dev.ifaces, iface)
+	}
+	return dev, nil
+}
+
+func readUSBFSIface(dir string) (usbfsIface, error) {
+	var iface usbfsIface
+	number, err := udev.ReadSysfs(filepath.Join(dir, "bInterfaceNumber"), 16)
+	if err != nil {
+		return iface, err
+	}
+	alt, err := udev.ReadSysfs(filepath.Join(dir, "bAlternateSetting"), 16)
+	if err != nil {
+		return iface, err
+	}
+	class, err := udev.ReadSysfs(filepath.Join(dir, "bInterfaceClass"), 16)
+	if err != nil {
+		return iface, err
+	}
+	iface.number = uint8(number)
+	iface.altSetting = uint8(alt)
+	iface.class = uint8(class)
+	iface.endpoints = make(map[uint8]bool)
+
+	eps, err := filepath.Glob(filepath.Join(dir, "ep_*"))
+	if err != nil {
+		return iface, err
+	}
+	for _, ep := range eps {
+		addr, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(ep), "ep_"), 16, 8)
+		if err != nil {
+			return iface, err
+		}
+		iface.endpoints[uint8(addr)] = true
+	}
+	return iface, nil
+}
+
+func hasUSBFSIface(dev usbfsInfo, dIface core.USBInterface, dClass uint8) bool {
+	for _, iface := range dev.ifaces {
+		if iface.number == dIface.Number &&
+			iface.altSetting == dIface.AltSetting &&
+			len(iface.endpoints) == 2 &&
+			iface.class == dClass &&
+			iface.endpoints[dIface.EpIn] &&
+			iface.endpoints[dIface.EpOut] {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *USBFS) match(dev *usbfsInfo) bool {
+	model, ok := core.FindModel(dev.vid, dev.pid, dev.bcd)
+	if !ok {
+		return false
+	}
+	// HID devices are read by hidapi/hidraw, if we use it
+	if model.Interface == core.InterfaceHID && !b.only {
+		return false
+	}
+	dev.model = model
+
+	b.mw.Log("matched, let's test")
+	for _, iface := range dev.ifaces {
+		if iface.number == model.USBInterface.Number && iface.altSetting == model.USBInterface.AltSetting {
+			// if we don't use hidapi at all, keep HID devices
+			if b.only || iface.class == usbClassVendorSpec {
+				b.mw.Log(fmt.Sprintf("matched %s", model.ID))
+				return true
+			}
+		}
+	}
+	b.mw.Log("not matched")
+	return false
+}
+
+func (b *USBFS) identify(dev usbfsInfo) string {
+	return usbfsPrefix + hex.EncodeToString(dev.ports)
+}
+
+func (b *USBFS) describe() (string, string) {
+	return busUSBFS, ""
+}
+
+func (b *USBFS) Has(path string) bool {
+	return strings.HasPrefix(path, usbfsPrefix)
+}
+
+func (b *USBFS) Connect(path string, debug bool, reset bool) (core.USBDevice, error) {
+	devs, err := b.devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devs {
+		if b.identify(dev) == path {
+			return b.connect(dev, debug, reset)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (b *USBFS) connect(dev usbfsInfo, debug bool, reset bool) (*USBFSDevice, error) {
+	if debug && !hasUSBFSIface(dev, dev.model.DebugUSBInterface, usbClassVendorSpec) {
+		return nil, ErrNotDebug
+	}
+	iface := dev.model.USBInterface
+	oldBL := dev.model.OldBootloaderUSBInterface
+	if oldBL != nil && hasUSBFSIface(dev, *oldBL, usbClassHID) {
+		iface = *oldBL
+	}
+	if debug {
+		iface = dev.model.DebugUSBInterface
+	}
+
+	b.mw.Log("opening " + dev.node)
+	f, err := os.OpenFile(dev.node, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+
+	if reset {
+		b.mw.Log("reset")
+		err = ioctl(fd, usbdevfsReset, nil)
+		if err != nil {
+			// don't abort if reset fails
+			b.mw.Log(fmt.Sprintf("Warning: error at device reset: %s", err))
+		}
+	}
+
+	if !dev.hasConf || dev.config != usbConfigNum {
+		b.mw.Log("set_configuration")
+		conf := uint32(usbConfigNum)
+		err = ioctl(fd, usbdevfsSetConfiguration, unsafe.Pointer(&conf))
+		if err != nil {
+			// don't abort if set configuration fails
+			b.mw.Log(fmt.Sprintf("Warning: error at configuration set: %s", err))
+		}
+	} else {
+		b.mw.Log("not setting config, same")
+	}
+
+	attach, err := b.claimInterface(fd, iface.Number)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	d := &USBFSDevice{
+		f:       f,
+		fd:      fd,
+		iface:   iface,
+		attach:  attach,
+		debug:   debug,
+		pending: make(map[uintptr]*usbfsTransfer),
+		reaped:  make(chan struct{}),
+		mw:      b.mw,
+	}
+	go d.reap()
+	return d, nil
+}
+
+func (b *USBFS) claimInterface(fd int, iface uint8) (bool, error) {
+	attach := false
+	if b.detach {
+		b.mw.Log("detecting kernel driver")
+		gd := usbfsGetDriver{
+			iface: uint32(iface),
+		}
+		err := ioctl(fd, usbdevfsGetDriver, unsafe.Pointer(&gd))
+		// ENODATA means no driver
+		if err == nil {
+			attach = true
+			b.mw.Log("kernel driver active, detach")
+			cmd := usbfsIoctl{
+				ifno: int32(iface),
+				code: int32(usbdevfsDisconnect),
+			}
+			err = ioctl(fd, usbdevfsIoctl, unsafe.Pointer(&cmd))
+			if err != nil {
+				b.mw.Log("detaching kernel driver failed")
+				return false, err
+			}
+		}
+	}
+
+	b.mw.Log("claiming interface")
+	num := uint32(iface)
+	err := ioctl(fd, usbdevfsClaimInterface, unsafe.Pointer(&num))
+	if err != nil {
+		b.mw.Log("claiming interface failed")
+		return false, err
+	}
+	b.mw.Log("claiming interface done")
+	return attach, nil
+}
+
+type usbfsTransfer struct {
+	urb  *usbfsURB
+	done chan struct{}
+}
+
+type USBFSDevice struct {
+	f  *os.File
+	fd int
+
+	// interface in use, normal or debug
+	iface  core.USBInterface
+	attach bool
+	debug  bool
+
+	closed int32 // atomic
+	// reaper stops after close, when there are no transfers left
+	stopping int32 // atomic
+
+	pendingMutex sync.Mutex
+	pending      map[uintptr]*usbfsTransfer
+	// set by reaper under pendingMutex when it stops taking transfers,
+	// so no transfer is submitted that nobody would reap
+	reaperStopped bool
+	reaped        chan struct{} // closed when reaper ends
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	// two transfers should not happen at the same time on the same endpoint
+
+	readDeadline
+
+	mw *memorywriter.MemoryWriter
+}
+
+var errTransferTimeout = errors.New("transfer timeout")
+
+// reap collects finished URBs and wakes up their transfers;
+// it is the only one calling REAPURB, since the kernel returns
+// any finished URB of the device, not the one we wait for
+func (d *USBFSDevice) reap() {
+	defer close(d.reaped)
+	for {
+		d.pendingMutex.Lock()
+		stop := atomic.LoadInt32(&d.stopping) == 1 && len(d.pending) == 0
+		if stop {
+			d.reaperStopped = true
+		}
+		d.pendingMutex.Unlock()
+		if stop {
+			return
+		}
+
+		revents, err := pollURBs(d.fd, usbfsPollTimeout)
+		if err != nil {
+			d.mw.Log(fmt.Sprintf("poll error %s", err.Error()))
+		}
+
+		for {
+			var ptr uintptr
+			err = ioctl(d.fd, usbdevfsReapURBNDelay, unsafe.Pointer(&ptr))
+			if err != nil {
+				break
+			}
+			d.finish(ptr, false)
+		}
+		if errors.Is(err, syscall.ENODEV) || revents&(pollHup|pollErr) != 0 {
+			// all URBs were reaped and the device is gone
+			d.mw.Log("device disconnected")
+			d.finishAll()
+			return
+		}
+	}
+}
+
+func (d *USBFSDevice) finish(ptr uintptr, disconnected bool) {
+	d.pendingMutex.Lock()
+	t, ok := d.pending[ptr]
+	delete(d.pending, ptr)
+	d.pendingMutex.Unlock()
+	if ok {
+		if disconnected {
+			t.urb.status = -int32(syscall.ENODEV)
+		}
+		close(t.done)
+	}
+}
+
+func (d *USBFSDevice) finishAll() {
+	d.pendingMutex.Lock()
+	d.reaperStopped = true
+	ptrs := make([]uintptr, 0, len(d.pending))
+	for ptr := range d.pending {
+		ptrs = append(ptrs, ptr)
+	}
+	d.pendingMutex.Unlock()
+	for _, ptr := range ptrs {
+		d.finish(ptr, true)
+	}
+}
+
+func (d *USBFSDevice) discard(ptr uintptr) {
+	// error is returned when URB already finished, which is fine
+	_, _, _ = syscall.Syscall(syscall.SYS_IOCTL, uintptr(d.fd), usbdevfsDiscardURB, ptr)
+}
+
+func (d *USBFSDevice) discardAll() {
+	d.pendingMutex.Lock()
+	defer d.pendingMutex.Unlock()
+	for ptr := range d.pending {
+		d.discard(ptr)
+	}
+}
+
+// transfer does one interrupt transfer; timeout 0 means no timeout
+func (d *USBFSDevice) transfer(endpoint uint8, buf []byte, timeout time.Duration) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	urb := &usbfsURB{
+		typ:          usbfsURBTypeInterrupt,
+		endpoint:     endpoint,
+		bufferLength: int32(len(buf)),
+	}
+	// kernel keeps pointers to both the URB and the buffer until
+	// the URB is reaped, so they must not be moved or collected
+	var pinner runtime.Pinner
+	pinner.Pin(urb)
+	pinner.Pin(&buf[0])
+	defer pinner.Unpin()
+	urb.buffer = uintptr(unsafe.Pointer(&buf[0]))
+
+	t := &usbfsTransfer{
+		urb:  urb,
+		done: make(chan struct{}),
+	}
+	ptr := uintptr(unsafe.Pointer(urb))
+
+	d.pendingMutex.Lock()
+	if d.reaperStopped {
+		d.pendingMutex.Unlock()
+		return 0, ErrDisconnected
+	}
+	err := ioctl(d.fd, usbdevfsSubmitURB, unsafe.Pointer(urb))
+	if err != nil {
+		d.pendingMutex.Unlock()
+		return 0, err
+	}
+	d.pending[ptr] = t
+	d.pendingMutex.Unlock()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	timedOut := false
+	select {
+	case <-t.done:
+	case <-timer:
+		timedOut = true
+		d.discard(ptr)
+		<-t.done
+	}
+
+	status := syscall.Errno(-urb.status)
+	switch {
+	case urb.status == 0:
+		return int(urb.actualLength), nil
+	case status == syscall.ENOENT || status == syscall.ECONNRESET:
+		// discarded
+		if timedOut {
+			return 0, errTransferTimeout
+		}
+		return 0, ErrClosedDevice
+	default:
+		return 0, status
+	}
+}
+
+func (d *USBFSDevice) Close(disconnected bool) error {
+	d.mw.Log("storing d.closed")
+	atomic.StoreInt32(&d.closed, 1)
+
+	d.mw.Log("canceling previous transfers")
+	d.discardAll()
+
+	// reading recently disconnected device sometimes causes weird issues
+	// => if we *know* it is disconnected, don't finish read queue
+	if !disconnected {
+		d.mw.Log("finishing read queue")
+		d.finishReadQueue()
+	}
+
+	atomic.StoreInt32(&d.stopping, 1)
+	<-d.reaped
+
+	d.mw.Log("releasing interface")
+	num := uint32(d.iface.Number)
+	err := ioctl(d.fd, usbdevfsReleaseInterface, unsafe.Pointer(&num))
+	if err != nil {
+		// do not throw error, it is just release anyway
+		d.mw.Log(fmt.Sprintf("Warning: error at releasing interface: %s", err))
+	}
+
+	if d.attach {
+		cmd := usbfsIoctl{
+			ifno: int32(d.iface.Number),
+			code: int32(usbdevfsConnect),
+		}
+		err = ioctl(d.fd, usbdevfsIoctl, unsafe.Pointer(&cmd))
+		if err != nil {
+			// do not throw error, it is just re-attach anyway
+			d.mw.Log(fmt.Sprintf("Warning: error at re-attaching driver: %s", err))
+		}
+	}
+
+	d.mw.Log("low level close")
+	err = d.f.Close()
+	d.mw.Log("done")
+	return err
+}
+
+func (d *USBFSDevice) finishReadQueue() {
+	usbEpIn := d.iface.EpIn
+	d.readMutex.Lock()
+	defer d.readMutex.Unlock()
+	var err error
+	var buf [64]byte
+	for err == nil {
+		d.mw.Log("transfer")
+		_, err = d.transfer(usbEpIn, buf[:], 50*time.Millisecond)
+	}
+}
+
+// deadline is nil for writes
+func (d *USBFSDevice) readWrite(buf []byte, endpoint uint8, mutex sync.Locker, deadline *readDeadline) (int, error) {
+	d.mw.Log("start")
+	for {
+		d.mw.Log("checking closed")
+		if atomic.LoadInt32(&d.closed) == 1 {
+			d.mw.Log("closed, skip")
+			return 0, ErrClosedDevice
+		}
+
+		var timeout time.Duration
+		if deadline != nil {
+			var err error
+			timeout, err = deadline.timeout()
+			if err != nil {
+				d.mw.Log("deadline exceeded")
+				return 0, err
+			}
+		}
+
+		mutex.Lock()
+		d.mw.Log("actual interrupt transport")
+		// without deadline, no timeout, but it is cancelled on close
+		p, err := d.transfer(endpoint, buf, timeout)
+		mutex.Unlock()
+		d.mw.Log("single transfer done")
+
+		if err != nil {
+			d.mw.Log(fmt.Sprintf("error seen - %s", err.Error()))
+			if errors.Is(err, errTransferTimeout) && deadline != nil {
+				d.mw.Log("deadline exceeded")
+				return 0, os.ErrDeadlineExceeded
+			}
+			if isUSBFSErrorDisconnect(err) {
+				d.mw.Log("device probably disconnected")
+				return 0, ErrDisconnected
+			}
+			return 0, err
+		}
+
+		// sometimes, empty report is read, skip it
+		if p > 0 {
+			d.mw.Log("single transfer successful")
+			return p, nil
+		}
+		d.mw.Log("skipping empty transfer, go again")
+	}
+}
+
+func isUSBFSErrorDisconnect(err error) bool {
+	// the same set of errors as with libusb; on disconnect, URBs end
+	// with ESHUTDOWN or EPROTO, and new submits with ENODEV
+	return errors.Is(err, ErrDisconnected) ||
+		errors.Is(err, syscall.ENODEV) ||
+		errors.Is(err, syscall.ESHUTDOWN) ||
+		errors.Is(err, syscall.EPROTO) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.EIO)
+}
+
+func (d *USBFSDevice) Write(buf []byte) (int, error) {
+	d.mw.Log("write start")
+	return d.readWrite(buf, d.iface.EpOut, &d.writeMutex, nil)
+}
+
+func (d *USBFSDevice) Read(buf []byte) (int, error) {
+	d.mw.Log("read start")
+	return d.readWrite(buf, d.iface.EpIn, &d.readMutex, &d.readDeadline)
+}
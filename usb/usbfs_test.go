@@ -0,0 +1,123 @@
+//go:build linux && usbfs
+// +build linux,usbfs
+
+package usb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/trezor/trezord-go/core"
+	"github.com/trezor/trezord-go/memorywriter"
+	"github.com/trezor/trezord-go/udev/udevtest"
+)
+
+// makeFakeUSBSysfs returns a root with the devices and a root hub
+func makeFakeUSBSysfs(t *testing.T, devs []udevtest.USBDevice) string {
+	root := t.TempDir()
+	for _, d := range devs {
+		udevtest.AddUSB(t, root, d)
+	}
+	// root hub, should be skipped
+	udevtest.WriteFile(t, root, "sys/bus/usb/devices/usb1/idVendor", "1d6b\n")
+	return root
+}
+
+func TestUSBFSEnumerate(t *testing.T) {
+	root := makeFakeUSBSysfs(t, []udevtest.USBDevice{
+		{
+			Name: "1-2", Vendor: "1209", Product: "53c1", BCD: "0200", Serial: "T2SERIAL", Devnum: "5",
+			Interfaces: []udevtest.USBInterface{
+				{Class: "ff", Endpoints: []string{"81", "01"}},
+				{Class: "ff", Endpoints: []string{"82", "02"}},
+			},
+		},
+		{
+			Name: "1-3.1", Vendor: "1209", Product: "53c1", BCD: "0100", Devnum: "6",
+			Interfaces: []udevtest.USBInterface{
+				{Class: "ff", Endpoints: []string{"81", "01"}},
+			},
+		},
+		// T1 HID, for hidapi/hidraw
+		{
+			Name: "1-4", Vendor: "534c", Product: "0001", BCD: "0100", Devnum: "7",
+			Interfaces: []udevtest.USBInterface{
+				{Class: "03", Endpoints: []string{"81", "01"}},
+			},
+		},
+		// keyboard
+		{
+			Name: "1-5", Vendor: "046d", Product: "c31c", BCD: "6400", Devnum: "8",
+			Interfaces: []udevtest.USBInterface{
+				{Class: "03", Endpoints: []string{"81"}},
+			},
+		},
+	})
+	mw := memorywriter.New(100, 10, false, nil)
+
+	b, err := initUSBFS(mw, false, false, nil, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := b.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 devices, got %+v", infos)
+	}
+	expected := []core.USBInfo{
+		{Path: "usbfs02", VendorID: 0x1209, ProductID: 0x53c1, Type: core.TypeT2, Debug: true, Serial: "T2SERIAL"},
+		{Path: "usbfs0301", VendorID: 0x1209, ProductID: 0x53c1, Type: core.TypeT1Webusb, Debug: false},
+	}
+	for i, info := range infos {
+		if info != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], info)
+		}
+	}
+
+	only, err := initUSBFS(mw, true, false, &Filter{Allow: FilterRules{Types: []core.DeviceType{core.TypeT1Hid}}}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = only.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Type != core.TypeT1Hid || infos[0].Path != "usbfs04" {
+		t.Fatalf("expected only T1 HID device, got %+v", infos)
+	}
+
+	_, err = b.Connect("usbfs0301", false, false)
+	if err == nil {
+		t.Errorf("connecting to device without device node should fail")
+	}
+	_, err = b.Connect("usbfs0301", true, false)
+	if err != ErrNotDebug {
+		t.Errorf("expected not debug error, got %v", err)
+	}
+}
+
+func TestUSBFSTransferAfterReaperStopped(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d := &USBFSDevice{
+		f:       f,
+		fd:      int(f.Fd()),
+		pending: make(map[uintptr]*usbfsTransfer),
+		reaped:  make(chan struct{}),
+		mw:      memorywriter.New(100, 10, false, nil),
+	}
+	// reaper saw the device disconnect, but did not close reaped yet;
+	// nobody would reap a transfer submitted now
+	d.finishAll()
+
+	var buf [64]byte
+	_, err = d.transfer(0x81, buf[:], 0)
+	if err != ErrDisconnected {
+		t.Errorf("expected disconnected error, got %v", err)
+	}
+}
@@ -1,57 +1,134 @@
 package wire
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 )
 
-const (
-	ioSeekCurrent = 1 // We define this constant (instead of using directly io.SeekCurrent) to be compatible with go1.6
-)
-
 var (
 	ErrMalformedProtobuf = errors.New("malformed protobuf")
+	ErrProtobufTooLarge  = errors.New("protobuf message too large")
+	ErrProtobufTooDeep   = errors.New("protobuf messages nested too deep")
 )
 
+const (
+	wireVarint  = 0 // int32, int64, uint32, uint64, sint32, sint64, bool, enum
+	wireFixed64 = 1 // fixed64, sfixed64, double
+	wireData    = 2 // string, bytes, embedded messages, packed repeated fields
+	wireFixed32 = 5 // fixed32, sfixed32, float
+	// 3 and 4 are groups, deprecated and not used by trezor
+
+	maxFieldNumber = 1<<29 - 1
+)
+
+// ValidateLimits limits the messages accepted by Validate.
+type ValidateLimits struct {
+	// MaxSize is the maximal size of the whole message; 0 is no limit
+	MaxSize int
+
+	// MaxFieldSize is the maximal size of one length-delimited field; 0 is no limit
+	MaxFieldSize int
+
+	// MaxDepth is how deep Validate descends into embedded messages; 0 is not at all.
+	// Without the message definitions, length-delimited fields that are valid
+	// messages are treated as embedded messages, the others as strings or bytes.
+	// Messages nested deeper than MaxDepth are refused.
+	//
+	// Strings and bytes that happen to be valid messages (short strings
+	// often are) are false positives, counted as one more level, so a valid
+	// message can be refused as too deep; MaxDepth should not be tight.
+	MaxDepth int
+}
+
+// DefaultValidateLimits are used by Validate;
+// trezor-common messages are nested less than 10 levels deep,
+// so MaxDepth leaves plenty of room for the false positives
+var DefaultValidateLimits = ValidateLimits{
+	MaxSize:      1024 * 1024 * 8, // 8mb message size
+	MaxFieldSize: 1024 * 1024 * 4, // 4mb field size
+	MaxDepth:     32,
+}
+
+// Validate checks that buf is well-formed protobuf message, using DefaultValidateLimits
 func Validate(buf []byte) error {
-	const (
-		wireVarint   = 0               // int32, int64, uint32, uint64, sint32, sint64, bool, enum
-		wireData     = 2               // string, bytes, embedded messages, packed repeated fields
-		maxFieldSize = 1024 * 1024 * 4 // 4mb field size
-	)
+	return DefaultValidateLimits.Validate(buf)
+}
 
-	r := bytes.NewReader(buf)
+// Validate checks that buf is well-formed protobuf message within the limits
+func (l ValidateLimits) Validate(buf []byte) error {
+	if l.MaxSize > 0 && len(buf) > l.MaxSize {
+		return ErrProtobufTooLarge
+	}
+	return l.validate(buf, 0)
+}
 
-	for r.Len() > 0 {
+func (l ValidateLimits) validate(buf []byte, depth int) error {
+	if depth > l.MaxDepth {
+		// valid message here is nested too deep; otherwise it is just bytes
+		if (ValidateLimits{}).validate(buf, 0) == nil {
+			return ErrProtobufTooDeep
+		}
+		return ErrMalformedProtobuf
+	}
+
+	// error of a nested message; the rest of buf is checked first,
+	// since if it is malformed, buf is not a message at all
+	var nestedErr error
+	for len(buf) > 0 {
 		// read the field key (combination of tag and type)
-		key, err := binary.ReadUvarint(r)
-		if err != nil {
-			return err
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return ErrMalformedProtobuf
 		}
+		buf = buf[n:]
 
-		// validate the field type
-		typ := key & 7
-		if typ != wireVarint && typ != wireData {
+		if number := key >> 3; number == 0 || number > maxFieldNumber {
 			return ErrMalformedProtobuf
 		}
 
 		// read the field value
-		val, err := binary.ReadUvarint(r)
-		if err != nil {
-			return err
-		}
-		if typ == wireData {
-			// field is length-delimited data, skip the data
-			if val > maxFieldSize || int64(val) < 0 {
+		switch key & 7 {
+		case wireVarint:
+			_, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return ErrMalformedProtobuf
+			}
+			buf = buf[n:]
+
+		case wireFixed64:
+			if len(buf) < 8 {
+				return ErrMalformedProtobuf
+			}
+			buf = buf[8:]
+
+		case wireFixed32:
+			if len(buf) < 4 {
+				return ErrMalformedProtobuf
+			}
+			buf = buf[4:]
+
+		case wireData:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
 				return ErrMalformedProtobuf
 			}
-			_, err = r.Seek(int64(val), ioSeekCurrent)
-			if err != nil {
-				return err
+			if l.MaxFieldSize > 0 && size > uint64(l.MaxFieldSize) {
+				return ErrProtobufTooLarge
+			}
+			end := n + int(size)
+			if l.MaxDepth > 0 && size > 0 {
+				err := l.validate(buf[n:end], depth+1)
+				// malformed data is not a message, but string or bytes
+				if err != nil && !errors.Is(err, ErrMalformedProtobuf) && nestedErr == nil {
+					nestedErr = err
+				}
 			}
+			buf = buf[end:]
+
+		default:
+			return ErrMalformedProtobuf
 		}
 	}
 
-	return nil
+	return nestedErr
 }
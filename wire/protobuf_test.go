@@ -0,0 +1,166 @@
+package wire
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	errReferenceNumber = errors.New("invalid field number")
+	errReferenceGroup  = errors.New("groups are not used")
+)
+
+// referenceValidate parses the fields with protowire, independent
+// of this package; groups are malformed, as in Validate
+func referenceValidate(buf []byte) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		// ConsumeTag checks only the minimum, proto.Unmarshal both
+		if !num.IsValid() {
+			return errReferenceNumber
+		}
+		if typ == protowire.StartGroupType || typ == protowire.EndGroupType {
+			return errReferenceGroup
+		}
+		buf = buf[n:]
+		n = protowire.ConsumeFieldValue(num, typ, buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// nested returns message with embedded messages depth levels deep
+func nested(depth int) []byte {
+	msg := []byte{0x08, 0x01} // varint field 1
+	for i := 0; i < depth; i++ {
+		msg = append([]byte{0x12, byte(len(msg))}, msg...)
+	}
+	return msg
+}
+
+func TestValidate(t *testing.T) {
+	testcases := []struct {
+		data string
+		err  error
+	}{
+		{"", nil},
+		// varint, fixed64, length-delimited, fixed32
+		{"0801", nil},
+		{"08ffffffffffffffffff01", nil},
+		{"090102030405060708", nil},
+		{"12026869", nil},
+		{"0d01020304", nil},
+		// groups
+		{"0b", ErrMalformedProtobuf},
+		{"0c", ErrMalformedProtobuf},
+		// unknown wire types
+		{"0e", ErrMalformedProtobuf},
+		{"0f", ErrMalformedProtobuf},
+		// field number 0
+		{"0001", ErrMalformedProtobuf},
+		// truncated key, varint, fixed and data
+		{"80", ErrMalformedProtobuf},
+		{"0880", ErrMalformedProtobuf},
+		{"08ffffffffffffffffffff01", ErrMalformedProtobuf},
+		{"0901020304050607", ErrMalformedProtobuf},
+		{"0d010203", ErrMalformedProtobuf},
+		{"120568", ErrMalformedProtobuf},
+		{"12ffffffffffffffff7f", ErrMalformedProtobuf},
+	}
+	for _, tc := range testcases {
+		data, err := hex.DecodeString(tc.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Validate(data)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.data, tc.err, err)
+		}
+		if (err == nil) != (referenceValidate(data) == nil) {
+			t.Errorf("%s: differs from reference decoder", tc.data)
+		}
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	l := ValidateLimits{MaxSize: 10, MaxFieldSize: 4}
+	if err := l.Validate([]byte{0x12, 0x04, 1, 2, 3, 4}); err != nil {
+		t.Errorf("expected field within limits, got %v", err)
+	}
+	if err := l.Validate([]byte{0x12, 0x05, 1, 2, 3, 4, 5}); !errors.Is(err, ErrProtobufTooLarge) {
+		t.Errorf("expected too large field, got %v", err)
+	}
+	if err := l.Validate([]byte{0x08, 1, 0x08, 1, 0x08, 1, 0x08, 1, 0x08, 1, 0x08, 1}); !errors.Is(err, ErrProtobufTooLarge) {
+		t.Errorf("expected too large message, got %v", err)
+	}
+
+	for depth := 0; depth < 5; depth++ {
+		msg := nested(depth)
+		if err := (ValidateLimits{MaxDepth: 4}).Validate(msg); err != nil {
+			t.Errorf("depth %d: expected valid, got %v", depth, err)
+		}
+	}
+	if err := (ValidateLimits{MaxDepth: 4}).Validate(nested(5)); !errors.Is(err, ErrProtobufTooDeep) {
+		t.Errorf("expected too deep, got %v", err)
+	}
+	// without recursion, depth is not checked
+	if err := (ValidateLimits{}).Validate(nested(5)); err != nil {
+		t.Errorf("expected valid, got %v", err)
+	}
+	// default limits descend into messages, too
+	if err := Validate(nested(10)); err != nil {
+		t.Errorf("expected valid with default limits, got %v", err)
+	}
+	if err := Validate(nested(DefaultValidateLimits.MaxDepth + 1)); !errors.Is(err, ErrProtobufTooDeep) {
+		t.Errorf("expected too deep with default limits, got %v", err)
+	}
+	// too deep field in a message that is malformed after it
+	if err := (ValidateLimits{MaxDepth: 1}).Validate(append(nested(2), 0x08)); !errors.Is(err, ErrMalformedProtobuf) {
+		t.Errorf("expected malformed, got %v", err)
+	}
+	// data that are not a message are bytes, on any depth
+	if err := (ValidateLimits{MaxDepth: 1}).Validate([]byte{0x12, 0x03, 0x12, 0x01, 0x0b}); err != nil {
+		t.Errorf("expected valid, got %v", err)
+	}
+}
+
+func FuzzValidate(f *testing.F) {
+	seeds := []string{
+		"", "0801", "090102030405060708", "12026869", "0d01020304",
+		"0b", "0001", "120568", "0a020801",
+	}
+	for _, s := range seeds {
+		data, _ := hex.DecodeString(s)
+		f.Add(data)
+	}
+	f.Add(nested(10))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		flat := (ValidateLimits{}).Validate(data)
+		ref := referenceValidate(data)
+		if (flat == nil) != (ref == nil) {
+			t.Fatalf("%x: validate %v, reference %v", data, flat, ref)
+		}
+		if flat != nil && !errors.Is(flat, ErrMalformedProtobuf) {
+			t.Fatalf("%x: unexpected error %v", data, flat)
+		}
+
+		// recursion only adds the depth check
+		deep := (ValidateLimits{MaxDepth: 3}).Validate(data)
+		if flat == nil && deep != nil && !errors.Is(deep, ErrProtobufTooDeep) {
+			t.Fatalf("%x: unexpected error %v", data, deep)
+		}
+		if flat != nil && !errors.Is(deep, ErrMalformedProtobuf) {
+			t.Fatalf("%x: expected malformed, got %v", data, deep)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package wire
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/trezor/trezord-go/memorywriter"
@@ -70,15 +71,31 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 
 var (
 	ErrMalformedMessage = errors.New("malformed wire format")
+	ErrMessageTooLarge  = errors.New("message too large")
 )
 
-func ReadFrom(r io.Reader, mw *memorywriter.MemoryWriter) (*Message, error) {
+// DefaultMaxMessageSize is the size limit of read messages, if not set otherwise
+const DefaultMaxMessageSize = 1024 * 1024 * 8 // 8mb
+
+// Reader reads the data of one message, packet by packet,
+// so that large messages do not need to be buffered.
+type Reader struct {
+	Kind uint16
+	Size uint32
+
+	r    io.Reader
+	mw   *memorywriter.MemoryWriter
+	left uint32 // data not returned yet
+	buf  []byte // rest of the last packet
+}
+
+// NewReader reads the first packet with the message header.
+// Messages larger than maxSize are refused before reading their data;
+// 0 is no limit.
+func NewReader(r io.Reader, maxSize uint32, mw *memorywriter.MemoryWriter) (*Reader, error) {
 	mw.Log("start")
-	var (
-		rep  [packetLen]byte
-		read = 0 // number of read bytes
-	)
-	n, err := r.Read(rep[:])
+	var rep [packetLen]byte
+	_, err := r.Read(rep[:])
 	if err != nil {
 		return nil, err
 	}
@@ -86,40 +103,80 @@ func ReadFrom(r io.Reader, mw *memorywriter.MemoryWriter) (*Message, error) {
 	// skip all the previous messages in the bus
 	for rep[0] != repMarker || rep[1] != repMagic || rep[2] != repMagic {
 		mw.Log("detected previous message, skipping")
-		n, err = r.Read(rep[:])
+		_, err = r.Read(rep[:])
 		if err != nil {
 			return nil, err
 		}
 	}
-	read += n
-
-	mw.Log("actual reading started")
 
 	// parse header
 	var (
 		kind = binary.BigEndian.Uint16(rep[3:])
 		size = binary.BigEndian.Uint32(rep[5:])
-		data = make([]byte, 0, size)
 	)
-	data = append(data, rep[9:]...) // read data after header
+	if maxSize != 0 && size > maxSize {
+		mw.Log(fmt.Sprintf("message size %d over limit %d", size, maxSize))
+		return nil, ErrMessageTooLarge
+	}
+
+	mw.Log("actual reading started")
+
+	return &Reader{
+		Kind: kind,
+		Size: size,
 
-	for uint32(len(data)) < size {
-		n, err := r.Read(rep[:])
+		r:    r,
+		mw:   mw,
+		left: size,
+		buf:  rep[9:], // data after header
+	}, nil
+}
+
+// Read reads the message data; it returns io.EOF after Size bytes
+func (m *Reader) Read(p []byte) (int, error) {
+	if m.left == 0 {
+		return 0, io.EOF
+	}
+	if len(m.buf) == 0 {
+		var rep [packetLen]byte
+		_, err := m.r.Read(rep[:])
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 		if rep[0] != repMarker {
-			return nil, ErrMalformedMessage
+			return 0, ErrMalformedMessage
 		}
-		read += n
-		data = append(data, rep[1:]...) // read data after marker
+		m.buf = rep[1:] // data after marker
 	}
-	data = data[:size]
+	buf := m.buf
+	if uint32(len(buf)) > m.left {
+		buf = buf[:m.left]
+	}
+	n := copy(p, buf)
+	m.buf = m.buf[n:]
+	m.left -= uint32(n)
+	if m.left == 0 {
+		m.mw.Log("actual reading finished")
+	}
+	return n, nil
+}
 
-	mw.Log("actual reading finished")
+// ReadFrom reads the whole message; messages larger than maxSize
+// are refused, 0 is no limit.
+func ReadFrom(r io.Reader, maxSize uint32, mw *memorywriter.MemoryWriter) (*Message, error) {
+	rd, err := NewReader(r, maxSize, mw)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, rd.Size)
+	_, err = io.ReadFull(rd, data)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Message{
-		Kind: kind,
+		Kind: rd.Kind,
 		Data: data,
 
 		Log: mw,
@@ -0,0 +1,103 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/trezor/trezord-go/memorywriter"
+)
+
+// packets reads one packet per Read, like the devices
+type packets struct {
+	data  [][]byte
+	reads int
+}
+
+func (p *packets) Read(b []byte) (int, error) {
+	if p.reads == len(p.data) {
+		return 0, io.EOF
+	}
+	n := copy(b, p.data[p.reads])
+	p.reads++
+	return n, nil
+}
+
+func writePackets(t *testing.T, kind uint16, data []byte) *packets {
+	t.Helper()
+	var buf bytes.Buffer
+	msg := Message{Kind: kind, Data: data, Log: memorywriter.New(100, 100, false, nil)}
+	_, err := msg.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &packets{}
+	for buf.Len() > 0 {
+		p.data = append(p.data, buf.Next(packetLen))
+	}
+	return p
+}
+
+func TestReadFrom(t *testing.T) {
+	mw := memorywriter.New(100, 100, false, nil)
+	data := bytes.Repeat([]byte{1, 2, 3}, 100)
+	p := writePackets(t, 17, data)
+	// leftover packet of previous message is skipped
+	p.data = append([][]byte{append([]byte{repMarker}, make([]byte, packetLen-1)...)}, p.data...)
+
+	msg, err := ReadFrom(p, 0, mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Kind != 17 || !bytes.Equal(msg.Data, data) {
+		t.Errorf("unexpected message %d %x", msg.Kind, msg.Data)
+	}
+}
+
+func TestReaderStreams(t *testing.T) {
+	mw := memorywriter.New(100, 100, false, nil)
+	data := bytes.Repeat([]byte{1, 2, 3}, 100)
+	p := writePackets(t, 3, data)
+
+	r, err := NewReader(p, uint32(len(data)), mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Kind != 3 || r.Size != uint32(len(data)) {
+		t.Errorf("unexpected header %d %d", r.Kind, r.Size)
+	}
+	if p.reads != 1 {
+		t.Errorf("expected only the header packet read, read %d", p.reads)
+	}
+
+	res, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Errorf("unexpected data %x", res)
+	}
+}
+
+func TestReaderTooLarge(t *testing.T) {
+	mw := memorywriter.New(100, 100, false, nil)
+	header := []byte{repMarker, repMagic, repMagic, 0, 3, 0xff, 0xff, 0xff, 0xff}
+	p := &packets{data: [][]byte{append(header, make([]byte, packetLen-len(header))...)}}
+
+	_, err := ReadFrom(p, DefaultMaxMessageSize, mw)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("expected too large error, got %v", err)
+	}
+}
+
+func TestReaderMalformed(t *testing.T) {
+	mw := memorywriter.New(100, 100, false, nil)
+	p := writePackets(t, 3, bytes.Repeat([]byte{1}, 100))
+	p.data[1][0] = 0
+
+	_, err := ReadFrom(p, 0, mw)
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("expected malformed error, got %v", err)
+	}
+}